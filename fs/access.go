@@ -0,0 +1,348 @@
+// copyright 2016 Christophe-Marie Duquesne
+
+package fs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// The permission checks of POSIX, so that the mount does not depend on the
+// default_permissions option of fuse.
+
+const (
+	accessRead    = 4
+	accessWrite   = 2
+	accessExecute = 1
+	// The uid or gid of chown(2) which keeps the current one
+	keepOwner = ^uint32(0)
+)
+
+func (fs *BufferFS) Access(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	defer fs.RLocked()()
+
+	if mode&^(accessRead|accessWrite|accessExecute) != 0 {
+		return fuse.EINVAL
+	}
+	return fs.checkAccess(name, mode, newRequest(context))
+}
+
+// Checks the lookups, which do not change anything: the caller may search the
+// directories leading to the path, and has the permissions on it. Pathfs
+// looks some paths up on its own, without a context.
+func (fs *BufferFS) checkLookup(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if context == nil || context.Uid == 0 {
+		return fuse.OK
+	}
+	req := &request{Context: context, caller: newCaller(context)}
+	if mode == 0 {
+		return fs.checkSearch(name, req)
+	}
+	return fs.checkAccess(name, mode, req)
+}
+
+// Checks that the caller has the permissions on the path, and may search
+// the directories leading to it. The file system must be locked.
+func (fs *BufferFS) checkAccess(name string, mode uint32, req *request) fuse.Status {
+	if code := fs.checkSearch(name, req); code != fuse.OK {
+		return code
+	}
+	attr, code := fs.getAttr(name, req.Context)
+	if code != fuse.OK {
+		return code
+	}
+	if !req.caller.permitted(attr, mode) {
+		return fuse.EACCES
+	}
+	return fuse.OK
+}
+
+// Checks that each directory on the way to the path is searchable
+func (fs *BufferFS) checkSearch(name string, req *request) fuse.Status {
+	for _, dir := range ancestors(name) {
+		attr, code := fs.getAttr(dir, req.Context)
+		if code != fuse.OK {
+			return code
+		}
+		if !req.caller.permitted(attr, accessExecute) {
+			return fuse.EACCES
+		}
+	}
+	return fuse.OK
+}
+
+// Checks that the caller may add an entry for the path in its directory,
+// which it must be able to search and write
+func (fs *BufferFS) checkAdd(name string, req *request) fuse.Status {
+	if code := fs.checkSearch(name, req); code != fuse.OK {
+		return code
+	}
+	dirName, _ := pathSplit(name)
+	dir, code := fs.getAttr(dirName, req.Context)
+	if code != fuse.OK {
+		return code
+	}
+	if !req.caller.permitted(dir, accessWrite) {
+		return fuse.EACCES
+	}
+	return fuse.OK
+}
+
+// Checks that the caller may remove the entry of the path from its
+// directory: as for adding one, and in a sticky directory, only the owners
+// of the directory and of the path may
+func (fs *BufferFS) checkRemove(name string, req *request) fuse.Status {
+	if code := fs.checkAdd(name, req); code != fuse.OK {
+		return code
+	}
+	attr, code := fs.getAttr(name, req.Context)
+	if code != fuse.OK {
+		// Nothing to protect
+		return fuse.OK
+	}
+	dirName, _ := pathSplit(name)
+	dir, code := fs.getAttr(dirName, req.Context)
+	if code != fuse.OK {
+		return code
+	}
+	if !req.caller.mayRemove(dir, attr) {
+		return fuse.EPERM
+	}
+	return fuse.OK
+}
+
+// The permissions that opening a file with the flags requires
+func openAccess(flags uint32) uint32 {
+	var mode uint32
+	switch flags & syscall.O_ACCMODE {
+	case syscall.O_RDONLY:
+		mode = accessRead
+	case syscall.O_WRONLY:
+		mode = accessWrite
+	case syscall.O_RDWR:
+		mode = accessRead | accessWrite
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		mode |= accessWrite
+	}
+	return mode
+}
+
+// Returns the directories leading to a path, from the root
+func ancestors(name string) []string {
+	dirs := make([]string, 0)
+	for name != "" {
+		name, _ = pathSplit(name)
+		dirs = append([]string{name}, dirs...)
+	}
+	return dirs
+}
+
+// Who asks for the access
+type caller struct {
+	uid uint32
+	gid uint32
+	pid uint32
+	// The supplementary groups, read when they are needed
+	groups []uint32
+	loaded bool
+}
+
+func newCaller(context *fuse.Context) *caller {
+	return &caller{
+		uid: context.Uid,
+		gid: context.Gid,
+		pid: context.Pid,
+	}
+}
+
+// Reads the supplementary groups of a process. Fuse does not tell them, and
+// the process may be gone already, in which case it only has its primary
+// group.
+func supplementaryGroups(pid uint32) []uint32 {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		groups := make([]uint32, 0)
+		for _, field := range strings.Fields(line[len("Groups:"):]) {
+			gid, err := strconv.ParseUint(field, 10, 32)
+			if err == nil {
+				groups = append(groups, uint32(gid))
+			}
+		}
+		return groups
+	}
+	return nil
+}
+
+// The supplementary groups of the caller
+func (c *caller) supplementary() []uint32 {
+	if !c.loaded {
+		c.groups = supplementaryGroups(c.pid)
+		c.loaded = true
+	}
+	return c.groups
+}
+
+func (c *caller) inGroup(gid uint32) bool {
+	if c.gid == gid {
+		return true
+	}
+	for _, g := range c.supplementary() {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the caller has all the requested permissions (a combination of
+// accessRead, accessWrite and accessExecute) on the path
+func (c *caller) permitted(attr *fuse.Attr, mode uint32) bool {
+	// Root overrides the permissions (CAP_DAC_OVERRIDE), except that a
+	// file is only executable if someone may execute it
+	if c.uid == 0 {
+		if mode&accessExecute == 0 || attr.IsDir() {
+			return true
+		}
+		return attr.Mode&0111 != 0
+	}
+
+	// Only the bits of the class of the caller count
+	perms := attr.Mode & 07
+	switch {
+	case attr.Owner.Uid == c.uid:
+		perms = (attr.Mode >> 6) & 07
+	case c.inGroup(attr.Owner.Gid):
+		perms = (attr.Mode >> 3) & 07
+	}
+	return perms&mode == mode
+}
+
+// Checks that the caller may change the mode of the path, and returns the
+// mode to set: only the owner and root may change it, and the setgid bit of a
+// file is dropped when the caller is not in its group (man 2 chmod)
+func (c *caller) chmod(attr *fuse.Attr, mode uint32) (uint32, fuse.Status) {
+	if c.uid == 0 {
+		return mode, fuse.OK
+	}
+	if c.uid != attr.Owner.Uid {
+		return 0, fuse.EPERM
+	}
+	if !attr.IsDir() && !c.inGroup(attr.Owner.Gid) {
+		mode &^= syscall.S_ISGID
+	}
+	return mode, fuse.OK
+}
+
+// Checks that the caller may give the path to the owner and group, and
+// returns them with keepOwner replaced by the current ones. Only root may
+// change the owner; the owner may change the group to one of its own
+// (man 2 chown).
+func (c *caller) chown(attr *fuse.Attr, uid uint32, gid uint32) (uint32, uint32, fuse.Status) {
+	if c.uid != 0 {
+		// Even giving the path its current owner or group takes being
+		// its owner
+		if uid != keepOwner && (c.uid != attr.Owner.Uid || uid != attr.Owner.Uid) {
+			return 0, 0, fuse.EPERM
+		}
+		if gid != keepOwner && (c.uid != attr.Owner.Uid ||
+			(gid != attr.Owner.Gid && !c.inGroup(gid))) {
+			return 0, 0, fuse.EPERM
+		}
+	}
+	if uid == keepOwner {
+		uid = attr.Owner.Uid
+	}
+	if gid == keepOwner {
+		gid = attr.Owner.Gid
+	}
+	return uid, gid, fuse.OK
+}
+
+// Checks that the caller may set the times of the path: the owner may set
+// any, and the ones who may write it may set them to the current time
+// (man 2 utimensat). Fuse passes the current time for UTIME_NOW, which we
+// only tell apart from an explicit time by being current.
+func (c *caller) touch(attr *fuse.Attr, atime *time.Time, mtime *time.Time, now time.Time) fuse.Status {
+	if c.uid == 0 || c.uid == attr.Owner.Uid {
+		return fuse.OK
+	}
+	for _, t := range []*time.Time{atime, mtime} {
+		if t != nil && (t.After(now) || now.Sub(*t) > time.Second) {
+			return fuse.EPERM
+		}
+	}
+	if !c.permitted(attr, accessWrite) {
+		return fuse.EACCES
+	}
+	return fuse.OK
+}
+
+// Checks that the caller may read (accessRead) or change (accessWrite) the
+// extended attribute of the path (man 7 xattr). The trusted ones are only
+// visible to root (CAP_SYS_ADMIN). The user ones are for regular files and
+// directories, with their permissions; the owner may always change them. The
+// owner may change the other ones.
+func (c *caller) xattr(attr *fuse.Attr, name string, mode uint32) fuse.Status {
+	if c.uid == 0 {
+		return fuse.OK
+	}
+	switch {
+	case strings.HasPrefix(name, "trusted."):
+		if mode == accessWrite {
+			return fuse.EPERM
+		}
+		return fuse.ENODATA
+	case strings.HasPrefix(name, "user."):
+		if !attr.IsRegular() && !attr.IsDir() {
+			if mode == accessWrite {
+				return fuse.EPERM
+			}
+			return fuse.ENODATA
+		}
+		if c.uid != attr.Owner.Uid && !c.permitted(attr, mode) {
+			return fuse.EACCES
+		}
+	case mode == accessWrite && c.uid != attr.Owner.Uid:
+		return fuse.EPERM
+	}
+	return fuse.OK
+}
+
+// Whether the caller may remove or replace the entry of the path in the
+// directory: in a sticky directory, only the owners of the directory and of
+// the path may (man 2 unlink)
+func (c *caller) mayRemove(dir *fuse.Attr, attr *fuse.Attr) bool {
+	if dir.Mode&syscall.S_ISVTX == 0 || c.uid == 0 {
+		return true
+	}
+	return c.uid == dir.Owner.Uid || c.uid == attr.Owner.Uid
+}
+
+// The mode of a file once the setuid and setgid bits are dropped, as after a
+// write or a chown. Without the group execute bit, the setgid bit marks
+// mandatory locking, and stays.
+func withoutPrivileges(mode uint32) uint32 {
+	mode &^= syscall.S_ISUID
+	if mode&syscall.S_IXGRP != 0 {
+		mode &^= syscall.S_ISGID
+	}
+	return mode
+}
@@ -1,5 +1,15 @@
 package fs
 
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
 type input struct {
 	offset int64
 	data   string
@@ -70,3 +80,121 @@ type input struct {
 //		}
 //	}
 //}
+
+// Random writes and truncations must read as they would in a plain file
+func TestRandomWrites(t *testing.T) {
+	attr := NewOverlayAttrFromScratch(fuse.S_IFREG|0644, 0, 0, time.Now())
+	f := NewOverlayFile(attr, NoSource).(*OverlayFile)
+	var expected []byte
+	for i := 0; i < 1000; i++ {
+		off := rand.Intn(256)
+		if i%10 == 0 {
+			f.Truncate(uint64(off))
+			if off < len(expected) {
+				expected = expected[:off]
+			} else {
+				expected = append(expected, make([]byte, off-len(expected))...)
+			}
+			continue
+		}
+		data := make([]byte, rand.Intn(32)+1)
+		rand.Read(data)
+		f.Write(data, int64(off), nil, nil)
+		if end := off + len(data); end > len(expected) {
+			expected = append(expected, make([]byte, end-len(expected))...)
+		}
+		copy(expected[off:], data)
+
+		buf := make([]byte, 512)
+		r, code := f.Read(buf, 0, nil, nil)
+		if code != fuse.OK {
+			t.Fatalf("Read failed: %v", code)
+		}
+		if got, _ := r.Bytes(buf); !bytes.Equal(got, expected) {
+			t.Fatalf("After %v operations, got %v, want %v", i+1, got, expected)
+		}
+	}
+}
+
+// The data that the slices of a file do not reference anymore is given back
+// right away, unless a frozen copy still references it
+func TestReleasedSlices(t *testing.T) {
+	used := func() int64 {
+		scratch.lock.Lock()
+		defer scratch.lock.Unlock()
+		return scratch.used
+	}
+	before := used()
+
+	attr := NewOverlayAttrFromScratch(fuse.S_IFREG|0644, 0, 0, time.Now())
+	f := NewOverlayFile(attr, NoSource).(*OverlayFile)
+	f.retain()
+	for i := 0; i < 1000; i++ {
+		data := make([]byte, rand.Intn(32)+1)
+		f.Write(data, int64(rand.Intn(4096)), nil, nil)
+		if i%100 == 0 {
+			f.Allocate(4096, 4096, fallocInsertRange, nil, nil)
+			f.Allocate(0, 4096, fallocCollapseRange, nil, nil)
+		}
+	}
+	frozen := freeze(f)
+	retainOverlay(frozen)
+
+	size := int(f.Size())
+	f.Write(make([]byte, size), 0, nil, nil)
+	if got := used() - before; got <= int64(size) {
+		t.Fatalf("The frozen data was released: %v bytes used", got)
+	}
+	releaseOverlay(frozen)
+	if got := used() - before; got != int64(size) {
+		t.Fatalf("Got %v bytes used, want %v", got, size)
+	}
+	f.release()
+	if got := used() - before; got != 0 {
+		t.Fatalf("Got %v bytes used after the release", got)
+	}
+}
+
+const benchmarkPage = 4096
+
+// Returns a file of n pages, written in a random order. One byte per page
+// is enough to get a slice per page.
+func pagedOverlayFile(n int) *OverlayFile {
+	attr := NewOverlayAttrFromScratch(fuse.S_IFREG|0644, 0, 0, time.Now())
+	f := NewOverlayFile(attr, NoSource).(*OverlayFile)
+	for _, i := range rand.Perm(n) {
+		f.Write([]byte{1}, int64(i)*benchmarkPage, nil, nil)
+	}
+	return f
+}
+
+// Random page writes, in files already holding many slices. The cost of a
+// write should barely grow with the number of slices.
+func BenchmarkRandomWrite(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("pages=%d", n), func(b *testing.B) {
+			f := pagedOverlayFile(n)
+			page := make([]byte, benchmarkPage)
+			b.SetBytes(benchmarkPage)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				f.Write(page, int64(rand.Intn(n))*benchmarkPage, nil, nil)
+			}
+		})
+	}
+}
+
+// Random page reads, in files already holding many slices
+func BenchmarkRandomRead(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("pages=%d", n), func(b *testing.B) {
+			f := pagedOverlayFile(n)
+			buf := make([]byte, benchmarkPage)
+			b.SetBytes(benchmarkPage)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				f.Read(buf, int64(rand.Intn(n))*benchmarkPage, nil, nil)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ package fs
 import (
 	"path"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
@@ -18,8 +19,33 @@ type BufferFS struct {
 	// We also want a wrapped target, but we don't rely on its
 	// implementation by default
 	Wrapped   pathfs.FileSystem
-	Overlayed map[string]OverlayPath
-	lock      sync.Mutex
+	Overlayed *OverlayTree
+	// Guards what is overlayed: the operations which change it hold the
+	// lock, the lookups share it. Reads and writes through the file
+	// handles only lock the file.
+	lock sync.RWMutex
+	// The overlays of the wrapped files which have several names, by inode
+	links map[uint64]*OverlayFile
+	// Set once mounted, to invalidate the kernel caches
+	nodeFs *pathfs.PathNodeFs
+	// The states we can roll back to, by name
+	checkpoints map[string]checkpoint
+}
+
+// An operation in progress: who asks for it, and the time it happens at. The
+// journal replays the operations as they were recorded.
+type request struct {
+	*fuse.Context
+	caller *caller
+	time   time.Time
+}
+
+func newRequest(context *fuse.Context) *request {
+	return &request{
+		Context: context,
+		caller:  newCaller(context),
+		time:    time.Now(),
+	}
 }
 
 func pathSplit(name string) (dir string, base string) {
@@ -34,7 +60,8 @@ func NewBufferFS(wrapped pathfs.FileSystem) pathfs.FileSystem {
 	return &BufferFS{
 		FileSystem: pathfs.NewDefaultFileSystem(),
 		Wrapped:    wrapped,
-		Overlayed:  make(map[string]OverlayPath),
+		Overlayed:  NewOverlayTree(),
+		links:      make(map[uint64]*OverlayFile),
 	}
 }
 
@@ -43,326 +70,689 @@ func (fs *BufferFS) Locked() func() {
 	return func() { fs.lock.Unlock() }
 }
 
+func (fs *BufferFS) RLocked() func() {
+	fs.lock.RLock()
+	return func() { fs.lock.RUnlock() }
+}
+
 func (fs *BufferFS) StatFs(name string) *fuse.StatfsOut {
 	// We rely entirely on the underlying FS
-	return fs.Wrapped.StatFs(name)
+	unlock := fs.RLocked()
+	source := fs.Overlayed.Source(name)
+	unlock()
+	if source == NoSource {
+		source = ""
+	}
+	return fs.Wrapped.StatFs(source)
 }
 
-func (fs *BufferFS) OnMount(nodeFs *pathfs.PathNodeFs) {}
+func (fs *BufferFS) OnMount(nodeFs *pathfs.PathNodeFs) {
+	fs.nodeFs = nodeFs
+}
 
 func (fs *BufferFS) OnUnmount() {}
 
 func (fs *BufferFS) GetAttr(name string, context *fuse.Context) (a *fuse.Attr, code fuse.Status) {
-	if name != "" {
-		// If a file is not listed in its parent directory, it does not exist
-		// (except for the root directory which does not list itself)
-		dir, base := pathSplit(name)
-		entries, status := fs.OpenDir(dir, context)
-		if status != fuse.OK {
-			// We could not open the parent
-			return nil, status
-		} else {
-			found := false
-			for _, e := range entries {
-				if e.Name == base {
-					found = true
-					break
-				}
-			}
-			if !found {
-				// the parent did not list us
-				return nil, fuse.ENOENT
-			}
-		}
+	defer fs.RLocked()()
+	if code := fs.checkLookup(name, 0, context); code != fuse.OK {
+		return nil, code
+	}
+	return fs.getAttr(name, context)
+}
+
+func (fs *BufferFS) getAttr(name string, context *fuse.Context) (a *fuse.Attr, code fuse.Status) {
+	// If a file is not listed in an overlayed directory on its way, it
+	// does not exist. Past them, the wrapped file system knows.
+	overlayPath, source, code := fs.Overlayed.Lookup(name)
+	if code != fuse.OK {
+		return nil, code
 	}
 	// The file exists, but we may have overlayed it
-	overlayPath := fs.Overlayed[name]
 	if overlayPath != nil {
 		a = &fuse.Attr{}
 		code = overlayPath.GetAttr(a)
 		return
 	}
 	// The file is not overlayed, we resort to the underlying file system
-	a, code = fs.Wrapped.GetAttr(name, context)
+	if source == NoSource {
+		return nil, fuse.ENOENT
+	}
+	a, code = fs.Wrapped.GetAttr(source, context)
+	if code == fuse.OK {
+		// Another name of the file may have been overlayed
+		if f := fs.linkedOverlay(a); f != nil {
+			a = &fuse.Attr{}
+			code = f.GetAttr(a)
+		}
+	}
 	return
 }
 
 func (fs *BufferFS) OpenDir(name string, context *fuse.Context) (stream []fuse.DirEntry, status fuse.Status) {
-	overlayPath := fs.Overlayed[name]
+	defer fs.RLocked()()
+	if code := fs.checkLookup(name, accessRead, context); code != fuse.OK {
+		return nil, code
+	}
+	return fs.openDir(name, context)
+}
+
+func (fs *BufferFS) openDir(name string, context *fuse.Context) (stream []fuse.DirEntry, status fuse.Status) {
+	overlayPath, source, code := fs.Overlayed.Lookup(name)
+	if code != fuse.OK {
+		return nil, code
+	}
 	if overlayPath != nil {
 		return overlayPath.Entries(context)
 	}
-	return fs.Wrapped.OpenDir(name, context)
+	if source == NoSource {
+		return nil, fuse.ENOENT
+	}
+	return fs.Wrapped.OpenDir(source, context)
+}
+
+// Returns what shows at a path: its overlay, or nil and the path of the
+// wrapped file system
+func (fs *BufferFS) shown(name string, context *fuse.Context) (o OverlayPath, source string, code fuse.Status) {
+	o, source, code = fs.Overlayed.Lookup(name)
+	if code != fuse.OK || o != nil {
+		return o, source, code
+	}
+	if source == NoSource {
+		return nil, source, fuse.ENOENT
+	}
+	if len(fs.links) > 0 {
+		// Another name of the file may have been overlayed
+		if a, code := fs.Wrapped.GetAttr(source, context); code == fuse.OK {
+			if f := fs.linkedOverlay(a); f != nil {
+				return f, source, fuse.OK
+			}
+		}
+	}
+	return nil, source, fuse.OK
 }
 
-func (fs *BufferFS) OverlayFile(name string, mode uint32, context *fuse.Context) OverlayPath {
-	overlayPath := fs.Overlayed[name]
+// The overlay constructors below fail with the status of the wrapped file
+// system when they cannot copy what it has. We never overlay a path with
+// only part of its content. The file system must be locked.
+
+func (fs *BufferFS) OverlayFile(name string, mode uint32, req *request) (OverlayPath, fuse.Status) {
+	overlayPath := fs.Overlayed.Get(name)
 	if overlayPath == nil {
 		//log.Printf("Creating OverlayFile('%v')", name)
-		attr := NewOverlayAttrFromScratch(fuse.S_IFREG|mode, context.Uid, context.Gid)
+		attr := NewOverlayAttrFromScratch(fuse.S_IFREG|mode, req.Uid, req.Gid, req.time)
 		source := NoSource
-		a, code := fs.GetAttr(name, context)
-		if code == fuse.OK {
+		a, code := fs.getAttr(name, req.Context)
+		switch code {
+		case fuse.OK:
+			if f := fs.linkedOverlay(a); f != nil {
+				fs.Overlayed.Set(name, f)
+				return f, fuse.OK
+			}
 			attr = NewOverlayAttrFromExisting(a)
-			source = name
+			source = fs.Overlayed.Source(name)
+			code = copyWrappedXAttrs(attr, source, fs.Wrapped, req.Context)
+			if code != fuse.OK {
+				return nil, code
+			}
+		case fuse.ENOENT:
+		default:
+			return nil, code
 		}
-		overlayPath = NewOverlayFile(attr, source)
-		fs.Overlayed[name] = overlayPath
+		f := NewOverlayFile(attr, source).(*OverlayFile)
+		if source != NoSource {
+			fs.addLinks(f, a)
+		}
+		overlayPath = f
+		fs.Overlayed.Set(name, overlayPath)
 	}
-	return overlayPath
+	return overlayPath, fuse.OK
 }
 
-func (fs *BufferFS) OverlayDir(name string, mode uint32, context *fuse.Context) OverlayPath {
-	overlayPath := fs.Overlayed[name]
+func (fs *BufferFS) OverlayDir(name string, mode uint32, req *request) (OverlayPath, fuse.Status) {
+	overlayPath := fs.Overlayed.Get(name)
 	if overlayPath == nil {
 		//log.Printf("Creating OverlayDir('%v')", name)
-		attr := NewOverlayAttrFromScratch(fuse.S_IFDIR|mode, context.Uid, context.Gid)
+		attr := NewOverlayAttrFromScratch(fuse.S_IFDIR|mode, req.Uid, req.Gid, req.time)
+		source := NoSource
 		entries := make([]fuse.DirEntry, 0)
-		a, code := fs.GetAttr(name, context)
-		if code == fuse.OK {
+		a, code := fs.getAttr(name, req.Context)
+		switch code {
+		case fuse.OK:
+			source = fs.Overlayed.Source(name)
+			entries, code = fs.openDir(name, req.Context)
+			if code != fuse.OK {
+				return nil, contentStatus(code)
+			}
+			// Listing the directory may have changed its access time.
+			// We keep the attributes it has after, which another copy
+			// (e.g. when replaying the journal) would find too.
+			a, code = fs.getAttr(name, req.Context)
+			if code != fuse.OK {
+				return nil, code
+			}
 			attr = NewOverlayAttrFromExisting(a)
-			entries, _ = fs.OpenDir(name, context)
+			code = copyWrappedXAttrs(attr, source, fs.Wrapped, req.Context)
+			if code != fuse.OK {
+				return nil, code
+			}
+		case fuse.ENOENT:
+		default:
+			return nil, code
 		}
-		overlayPath = NewOverlayDir(attr, entries)
-		fs.Overlayed[name] = overlayPath
+		overlayPath = NewOverlayDir(attr, source, entries)
+		fs.Overlayed.Set(name, overlayPath)
 	}
-	return overlayPath
+	return overlayPath, fuse.OK
 }
 
-func (fs *BufferFS) OverlaySymlink(name string, target string, context *fuse.Context) OverlayPath {
-	overlayPath := fs.Overlayed[name]
+func (fs *BufferFS) OverlaySymlink(name string, target string, req *request) (OverlayPath, fuse.Status) {
+	overlayPath := fs.Overlayed.Get(name)
 	if overlayPath == nil {
 		//log.Printf("Creating OverlaySymlink('%v')", name)
-		attr := NewOverlayAttrFromScratch(fuse.S_IFLNK|0777, context.Uid, context.Gid)
-		existingTarget, code := fs.Readlink(name, context)
-		if code == fuse.OK {
-			target = existingTarget
+		attr := NewOverlayAttrFromScratch(fuse.S_IFLNK|0777, req.Uid, req.Gid, req.time)
+		// Readlink does not know about removed entries
+		_, code := fs.getAttr(name, req.Context)
+		switch code {
+		case fuse.OK:
+			target, code = fs.readlink(name, req.Context)
+			if code != fuse.OK {
+				return nil, contentStatus(code)
+			}
+		case fuse.ENOENT:
+		default:
+			return nil, code
 		}
 		overlayPath = NewOverlaySymlink(attr, target)
-		fs.Overlayed[name] = overlayPath
+		fs.Overlayed.Set(name, overlayPath)
 	}
-	return overlayPath
+	return overlayPath, fuse.OK
 }
 
+func (fs *BufferFS) OverlaySpecial(name string, mode uint32, rdev uint32, req *request) (OverlayPath, fuse.Status) {
+	overlayPath := fs.Overlayed.Get(name)
+	if overlayPath == nil {
+		attr := NewOverlayAttrFromScratch(mode, req.Uid, req.Gid, req.time)
+		attr.SetRdev(rdev)
+		a, code := fs.getAttr(name, req.Context)
+		switch code {
+		case fuse.OK:
+			attr = NewOverlayAttrFromExisting(a)
+			code = copyWrappedXAttrs(attr, fs.Overlayed.Source(name), fs.Wrapped, req.Context)
+			if code != fuse.OK {
+				return nil, code
+			}
+		case fuse.ENOENT:
+		default:
+			return nil, code
+		}
+		overlayPath = NewOverlaySpecial(attr)
+		fs.Overlayed.Set(name, overlayPath)
+	}
+	return overlayPath, fuse.OK
+}
+
+// Whether the mode is the one of a FIFO, a socket or a device node
+func isSpecial(mode uint32) bool {
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFIFO, syscall.S_IFSOCK, syscall.S_IFCHR, syscall.S_IFBLK:
+		return true
+	}
+	return false
+}
+
+// Overlays an existing path, according to its type
+func (fs *BufferFS) overlayExisting(name string, attr *fuse.Attr, req *request) (OverlayPath, fuse.Status) {
+	switch {
+	case attr.IsDir():
+		return fs.OverlayDir(name, 0, req)
+	case attr.IsRegular():
+		return fs.OverlayFile(name, 0, req)
+	case attr.IsSymlink():
+		return fs.OverlaySymlink(name, "", req)
+	case isSpecial(attr.Mode):
+		return fs.OverlaySpecial(name, 0, 0, req)
+	}
+	// We cannot buffer the other types of files
+	return nil, fuse.ENOSYS
+}
+
+// The operations which change the overlay have a variant taking the request,
+// which the journal replays
+
 func (fs *BufferFS) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
-	// Assumes that fuse has checked the permissions
-	overlayPath := fs.OverlayFile(name, 0, context)
-	return NewOverlayFH(overlayPath, context, fs.Wrapped), fuse.OK
+	return fs.open(name, flags, newRequest(context))
+}
+
+func (fs *BufferFS) open(name string, flags uint32, req *request) (nodefs.File, fuse.Status) {
+	defer fs.Locked()()
+	return fs.openLocked(name, flags, req)
+}
+
+func (fs *BufferFS) openLocked(name string, flags uint32, req *request) (nodefs.File, fuse.Status) {
+	if code := fs.checkAccess(name, openAccess(flags), req); code != fuse.OK {
+		return nil, code
+	}
+	overlayPath, code := fs.OverlayFile(name, 0, req)
+	if code != fuse.OK {
+		return nil, code
+	}
+	h := NewOverlayFH(overlayPath, flags, req.Context, fs.Wrapped)
+	if flags&syscall.O_TRUNC != 0 {
+		if code := h.truncate(0, req.time); code != fuse.OK {
+			h.Release()
+			return nil, code
+		}
+	}
+	return h, fuse.OK
 }
 
 func (fs *BufferFS) Chmod(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	return fs.chmod(name, mode, newRequest(context))
+}
+
+func (fs *BufferFS) chmod(name string, mode uint32, req *request) (code fuse.Status) {
+	defer fs.Locked()()
+
+	if code := fs.checkSearch(name, req); code != fuse.OK {
+		return code
+	}
 	// Do we need to do anything? Check the existing mode
-	attr, status := fs.GetAttr(name, context)
+	attr, status := fs.getAttr(name, req.Context)
 	if status != fuse.OK {
 		return status
 	}
-	if attr.Mode&0777 == mode {
+	mode, code = req.caller.chmod(attr, mode)
+	if code != fuse.OK {
+		return code
+	}
+	if attr.Mode&07777 == mode {
+		return fuse.OK
+	}
+	// Permissions on symlinks don't make sense (I think) -> TESTME
+	if attr.IsSymlink() {
 		return fuse.OK
 	}
 	// The mode will change, we need to overlay
-	overlayPath := fs.Overlayed[name]
-	if overlayPath == nil {
-		if attr.IsDir() {
-			overlayPath = fs.OverlayDir(name, 0, context)
-		}
-		if attr.IsRegular() {
-			overlayPath = fs.OverlayFile(name, 0, context)
-		}
-		// Permissions on symlinks don't make sense (I think) -> TESTME
-		if attr.IsSymlink() {
-			return fuse.OK
-		}
+	overlayPath, code := fs.overlayExisting(name, attr, req)
+	if code != fuse.OK {
+		return code
 	}
 	return overlayPath.Chmod(mode)
 }
 
 func (fs *BufferFS) Chown(name string, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
+	return fs.chown(name, uid, gid, newRequest(context))
+}
+
+func (fs *BufferFS) chown(name string, uid uint32, gid uint32, req *request) (code fuse.Status) {
+	defer fs.Locked()()
+
+	if code := fs.checkSearch(name, req); code != fuse.OK {
+		return code
+	}
 	// Do we need to do anything? Check the existing mode
-	attr, status := fs.GetAttr(name, context)
+	attr, status := fs.getAttr(name, req.Context)
 	if status != fuse.OK {
 		return status
 	}
 	//log.Printf("uid: %v -> %v, gid: %v -> %v\n",
 	//	attr.Owner.Uid, uid, attr.Owner.Gid, gid)
+	uid, gid, code = req.caller.chown(attr, uid, gid)
+	if code != fuse.OK {
+		return code
+	}
 	if attr.Owner.Uid == uid && attr.Owner.Gid == gid {
 		return fuse.OK
 	}
 	// The uid/gid will change, we need to OverlayedPaths
-	overlayPath := fs.Overlayed[name]
-	if overlayPath == nil {
-		if attr.IsDir() {
-			overlayPath = fs.OverlayDir(name, 0, context)
-		}
-		if attr.IsRegular() {
-			overlayPath = fs.OverlayFile(name, 0, context)
-		}
-		if attr.IsSymlink() {
-			overlayPath = fs.OverlaySymlink(name, "", context)
-		}
+	overlayPath, code := fs.overlayExisting(name, attr, req)
+	if code != fuse.OK {
+		return code
+	}
+	return setOwner(overlayPath, attr, uid, gid)
+}
+
+// Changes the owner of an overlay. The setuid and setgid bits of files do not
+// survive it.
+func setOwner(o OverlayPath, attr *fuse.Attr, uid uint32, gid uint32) fuse.Status {
+	if code := o.Chown(uid, gid); code != fuse.OK {
+		return code
+	}
+	if mode := withoutPrivileges(attr.Mode); !attr.IsDir() && mode != attr.Mode {
+		return o.Chmod(mode & 07777)
+	}
+	return fuse.OK
+}
+
+// In a setgid directory, new paths belong to the group of the directory, and
+// new directories are setgid as well
+func inheritGroup(parent OverlayPath, child OverlayPath) {
+	dir := fuse.Attr{}
+	parent.GetAttr(&dir)
+	if dir.Mode&syscall.S_ISGID == 0 {
+		return
+	}
+	attr := fuse.Attr{}
+	child.GetAttr(&attr)
+	child.Chown(attr.Owner.Uid, dir.Owner.Gid)
+	if attr.IsDir() {
+		child.Chmod(attr.Mode&07777 | syscall.S_ISGID)
 	}
-	return overlayPath.Chown(uid, gid)
 }
 
 func (fs *BufferFS) Truncate(path string, offset uint64, context *fuse.Context) (code fuse.Status) {
-	overlayFH, status := fs.Open(path, fuse.W_OK, context)
+	return fs.truncate(path, offset, newRequest(context))
+}
+
+func (fs *BufferFS) truncate(path string, offset uint64, req *request) (code fuse.Status) {
+	defer fs.Locked()()
+
+	overlayFH, status := fs.openLocked(path, syscall.O_WRONLY, req)
 	if status != fuse.OK {
 		return status
 	}
-	return overlayFH.Truncate(offset)
+	defer overlayFH.Release()
+	return overlayFH.(*OverlayFH).truncate(offset, req.time)
 }
 
 func (fs *BufferFS) Readlink(name string, context *fuse.Context) (out string, code fuse.Status) {
-	overlayPath := fs.Overlayed[name]
+	defer fs.RLocked()()
+	if code := fs.checkLookup(name, 0, context); code != fuse.OK {
+		return "", code
+	}
+	return fs.readlink(name, context)
+}
+
+func (fs *BufferFS) readlink(name string, context *fuse.Context) (out string, code fuse.Status) {
+	overlayPath, source, code := fs.Overlayed.Lookup(name)
+	if code != fuse.OK {
+		return "", code
+	}
 	if overlayPath != nil {
 		return overlayPath.Target()
 	}
-	return fs.Wrapped.Readlink(name, context)
+	if source == NoSource {
+		return "", fuse.ENOENT
+	}
+	return fs.Wrapped.Readlink(source, context)
 }
 
 func (fs *BufferFS) Unlink(name string, context *fuse.Context) (code fuse.Status) {
+	return fs.unlink(name, newRequest(context))
+}
+
+func (fs *BufferFS) unlink(name string, req *request) (code fuse.Status) {
+	defer fs.Locked()()
+
+	if code := fs.checkRemove(name, req); code != fuse.OK {
+		return code
+	}
+
 	// remove the entry in the parent dir
 	dir, base := pathSplit(name)
-	parent := fs.OverlayDir(dir, 0, context)
-	parent.RemoveEntry(base)
+	parent, code := fs.OverlayDir(dir, 0, req)
+	if code != fuse.OK {
+		return code
+	}
+	// The other names of the file see one less
+	f, code := fs.linkedFile(name, req)
+	if code != fuse.OK {
+		return code
+	}
+	if f != nil {
+		f.addNlink(-1)
+	}
+	parent.RemoveEntry(base, req.time)
 	// unmap
-	delete(fs.Overlayed, name)
+	fs.Overlayed.Delete(name)
 	return fuse.OK
 }
 
 func (fs *BufferFS) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
+	return fs.rmdir(name, newRequest(context))
+}
+
+func (fs *BufferFS) rmdir(name string, req *request) (code fuse.Status) {
+	defer fs.Locked()()
+
+	if code := fs.checkRemove(name, req); code != fuse.OK {
+		return code
+	}
+
 	// remove the entry in the parent dir
 	dir, base := pathSplit(name)
-	parent := fs.OverlayDir(dir, 0, context)
-	parent.RemoveEntry(base)
+	parent, code := fs.OverlayDir(dir, 0, req)
+	if code != fuse.OK {
+		return code
+	}
+	parent.RemoveEntry(base, req.time)
 	// unmap
-	delete(fs.Overlayed, name)
+	fs.Overlayed.Delete(name)
 	return fuse.OK
 }
 
 func (fs *BufferFS) Symlink(target string, name string, context *fuse.Context) (code fuse.Status) {
+	return fs.symlink(target, name, newRequest(context))
+}
+
+func (fs *BufferFS) symlink(target string, name string, req *request) (code fuse.Status) {
+	defer fs.Locked()()
+
+	if code := fs.checkAdd(name, req); code != fuse.OK {
+		return code
+	}
+
+	dir, base := pathSplit(name)
+	parent, code := fs.OverlayDir(dir, 0, req)
+	if code != fuse.OK {
+		return code
+	}
 	// map
-	fs.OverlaySymlink(name, target, context)
+	child, code := fs.OverlaySymlink(name, target, req)
+	if code != fuse.OK {
+		return code
+	}
+	inheritGroup(parent, child)
 
 	// create the entry in the parent dir
-	dir, base := pathSplit(name)
-	parent := fs.OverlayDir(dir, 0, context)
-	parent.AddEntry(fuse.S_IFLNK|0777, base)
+	parent.AddEntry(fuse.S_IFLNK|0777, base, req.time)
 	return fuse.OK
 }
 
 func (fs *BufferFS) Mkdir(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	return fs.mkdir(name, mode, newRequest(context))
+}
+
+func (fs *BufferFS) mkdir(name string, mode uint32, req *request) (code fuse.Status) {
+	defer fs.Locked()()
+
+	if code := fs.checkAdd(name, req); code != fuse.OK {
+		return code
+	}
+
+	dir, base := pathSplit(name)
+	parent, code := fs.OverlayDir(dir, 0, req)
+	if code != fuse.OK {
+		return code
+	}
 	// map
-	fs.OverlayDir(name, mode, context)
+	child, code := fs.OverlayDir(name, mode, req)
+	if code != fuse.OK {
+		return code
+	}
+	inheritGroup(parent, child)
 
 	// create the entry in the parent dir
+	parent.AddEntry(fuse.S_IFDIR|mode, base, req.time)
+	return fuse.OK
+}
+
+func (fs *BufferFS) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) (code fuse.Status) {
+	return fs.mknod(name, mode, dev, newRequest(context))
+}
+
+func (fs *BufferFS) mknod(name string, mode uint32, dev uint32, req *request) (code fuse.Status) {
+	defer fs.Locked()()
+
+	if code := fs.checkAdd(name, req); code != fuse.OK {
+		return code
+	}
+
 	dir, base := pathSplit(name)
-	parent := fs.OverlayDir(dir, 0, context)
-	parent.AddEntry(fuse.S_IFDIR|mode, base)
+	parent, code := fs.OverlayDir(dir, 0, req)
+	if code != fuse.OK {
+		return code
+	}
+	// map
+	var child OverlayPath
+	switch {
+	case mode&syscall.S_IFMT == syscall.S_IFREG:
+		child, code = fs.OverlayFile(name, mode&07777, req)
+	case isSpecial(mode):
+		child, code = fs.OverlaySpecial(name, mode, dev, req)
+	default:
+		return fuse.EINVAL
+	}
+	if code != fuse.OK {
+		return code
+	}
+	inheritGroup(parent, child)
+
+	// create the entry in the parent dir
+	parent.AddEntry(mode, base, req.time)
 	return fuse.OK
 }
 
 func (fs *BufferFS) Create(name string, flags uint32, mode uint32, context *fuse.Context) (fuseFile nodefs.File, code fuse.Status) {
+	return fs.create(name, flags, mode, newRequest(context))
+}
+
+func (fs *BufferFS) create(name string, flags uint32, mode uint32, req *request) (fuseFile nodefs.File, code fuse.Status) {
+	defer fs.Locked()()
+
+	// man 2 open: without O_EXCL, an existing file is opened
+	if a, code := fs.getAttr(name, req.Context); code == fuse.OK {
+		if flags&syscall.O_EXCL != 0 {
+			return nil, fuse.ToStatus(syscall.EEXIST)
+		}
+		if a.IsDir() {
+			return nil, fuse.ToStatus(syscall.EISDIR)
+		}
+		return fs.openLocked(name, flags, req)
+	}
+	if code := fs.checkAdd(name, req); code != fuse.OK {
+		return nil, code
+	}
+
+	dir, base := pathSplit(name)
+	parent, code := fs.OverlayDir(dir, 0, req)
+	if code != fuse.OK {
+		return nil, code
+	}
 	// map
-	child := fs.OverlayFile(name, mode, context)
+	child, code := fs.OverlayFile(name, mode, req)
+	if code != fuse.OK {
+		return nil, code
+	}
+	inheritGroup(parent, child)
 
 	// create the entry in the parent dir
-	dir, base := pathSplit(name)
-	parent := fs.OverlayDir(dir, 0, context)
-	parent.AddEntry(fuse.S_IFREG|mode, base)
-	return NewOverlayFH(child, context, fs.Wrapped), fuse.OK
+	parent.AddEntry(fuse.S_IFREG|mode, base, req.time)
+	return NewOverlayFH(child, flags, req.Context, fs.Wrapped), fuse.OK
 }
 
 func (fs *BufferFS) Rename(oldPath string, newPath string, context *fuse.Context) (code fuse.Status) {
-	// TODO: Fuse checks existence of oldPath and the dir of the new path
-	// for us. It does not check access.
-	overlayPath := fs.Overlayed[oldPath]
-	if overlayPath == nil {
-		attr, _ := fs.GetAttr(oldPath, context)
-		if attr.IsDir() {
-			overlayPath = fs.OverlayDir(oldPath, 0, context)
-		}
-		if attr.IsRegular() {
-			overlayPath = fs.OverlayFile(oldPath, 0, context)
+	return fs.rename(oldPath, newPath, newRequest(context))
+}
+
+func (fs *BufferFS) rename(oldPath string, newPath string, req *request) (code fuse.Status) {
+	defer fs.Locked()()
+
+	// Fuse checks existence of oldPath and the dir of the new path for us
+	for _, name := range []string{oldPath, newPath} {
+		if code := fs.checkRemove(name, req); code != fuse.OK {
+			return code
 		}
-		if attr.IsSymlink() {
-			overlayPath = fs.OverlaySymlink(oldPath, "", context)
+	}
+	oldDir, oldBase := pathSplit(oldPath)
+	newDir, newBase := pathSplit(newPath)
+	attr, code := fs.getAttr(oldPath, req.Context)
+	if code != fuse.OK {
+		return code
+	}
+	// man 2 rename: a directory moving elsewhere needs write permission,
+	// to update its .. entry
+	if attr.IsDir() && oldDir != newDir && !req.caller.permitted(attr, accessWrite) {
+		return fuse.EACCES
+	}
+	overlayPath := fs.Overlayed.Get(oldPath)
+	if overlayPath == nil {
+		overlayPath, code = fs.overlayExisting(oldPath, attr, req)
+		if code != fuse.OK {
+			return code
 		}
 	}
 
-	oldDir, oldBase := pathSplit(oldPath)
-	oldParent := fs.OverlayDir(oldDir, 0, context)
+	oldParent, code := fs.OverlayDir(oldDir, 0, req)
+	if code != fuse.OK {
+		return code
+	}
 
-	newDir, newBase := pathSplit(newPath)
-	newParent := fs.OverlayDir(newDir, 0, context)
+	newParent, code := fs.OverlayDir(newDir, 0, req)
+	if code != fuse.OK {
+		return code
+	}
 
-	// Map the new path
-	fs.Overlayed[newPath] = overlayPath
-	// Install the new entry in its parent
-	attr := fuse.Attr{}
-	overlayPath.GetAttr(&attr)
-	newParent.RemoveEntry(newBase)
-	newParent.AddEntry(attr.Mode, newBase)
-	// If are moving a dir, we need to also remap the children before
-	// unmapping the parent
-	if attr.IsDir() {
-		entries, status := fs.OpenDir(oldPath, context)
-		if status != fuse.OK {
-			return status
-		}
-		for _, e := range entries {
-			toRename := path.Join(oldPath, e.Name)
-			dest := path.Join(newPath, e.Name)
-			status := fs.Rename(toRename, dest, context)
-			if status != fuse.OK {
-				return status
-			}
+	// The file we replace loses a name, unless it is the one we rename
+	replaced, code := fs.linkedFile(newPath, req)
+	if code != fuse.OK {
+		return code
+	}
+	if replaced != nil {
+		if OverlayPath(replaced) == overlayPath {
+			return fuse.OK
 		}
+		replaced.addNlink(-1)
 	}
 
+	// Install the new entry in its parent
+	overlayPath.GetAttr(attr)
+	newParent.RemoveEntry(newBase, req.time)
+	newParent.AddEntry(attr.Mode, newBase, req.time)
 	if oldParent != newParent || oldBase != newBase {
-		oldParent.RemoveEntry(oldBase)
+		oldParent.RemoveEntry(oldBase, req.time)
 	}
 
-	// Unmap the OverlayPath from its old path
-	delete(fs.Overlayed, oldPath)
+	// Move the overlay along with what is below it. The children of a
+	// directory which are not overlayed follow, since they show what is
+	// below its source.
+	fs.Overlayed.Move(oldPath, newPath)
 	return fuse.OK
 }
 
-func (fs *BufferFS) Access(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
-	attr, code := fs.GetAttr(name, context)
-	if code != fuse.OK {
+func (fs *BufferFS) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) (code fuse.Status) {
+	return fs.utimens(name, atime, mtime, newRequest(context))
+}
+
+func (fs *BufferFS) utimens(name string, atime *time.Time, mtime *time.Time, req *request) (code fuse.Status) {
+	defer fs.Locked()()
+
+	if code := fs.checkSearch(name, req); code != fuse.OK {
 		return code
 	}
-	ownerbits := uint(6)
-	groupbits := uint(3)
-	otherbits := uint(0)
-	b := otherbits
-	if attr.Owner.Gid == context.Owner.Gid {
-		b = groupbits
-	}
-	if attr.Owner.Uid == context.Owner.Uid {
-		b = ownerbits
+	attr, code := fs.getAttr(name, req.Context)
+	if code != fuse.OK {
+		return code
 	}
-	m := attr.Mode & 0777
-	if m&(mode<<b) != 0 {
-		return fuse.OK
+	if code := req.caller.touch(attr, atime, mtime, req.time); code != fuse.OK {
+		return code
 	}
-	return fuse.EACCES
-}
-
-func (fs *BufferFS) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) (code fuse.Status) {
-	overlayPath := fs.Overlayed[name]
+	overlayPath := fs.Overlayed.Get(name)
 	if overlayPath == nil {
-		attr, _ := fs.GetAttr(name, context)
-		if attr.IsDir() {
-			overlayPath = fs.OverlayDir(name, 0, context)
-		}
-		if attr.IsRegular() {
-			overlayPath = fs.OverlayFile(name, 0, context)
-		}
-		if attr.IsSymlink() {
-			overlayPath = fs.OverlaySymlink(name, "", context)
+		overlayPath, code = fs.overlayExisting(name, attr, req)
+		if code != fuse.OK {
+			return code
 		}
 	}
-	return overlayPath.Utimens(atime, mtime)
+	return overlayPath.Touch(atime, mtime, req.time)
 }
@@ -0,0 +1,2673 @@
+package fs
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// The internals of a BufferFS are read under its lock: the kernel may be
+// serving requests at the same time
+
+func overlayedNames(fs *BufferFS) []string {
+	defer fs.RLocked()()
+	return fs.Overlayed.Names()
+}
+
+func overlayed(fs *BufferFS, name string) OverlayPath {
+	defer fs.RLocked()()
+	return fs.Overlayed.Get(name)
+}
+
+func fileSlices(f *OverlayFile) extents {
+	defer f.Locked()()
+	return f.slices
+}
+
+// The number of arenas of the scratch file, or -1 if there is none
+func scratchArenas() int {
+	scratch.lock.Lock()
+	defer scratch.lock.Unlock()
+	if scratch.file == nil {
+		return -1
+	}
+	return len(scratch.file.arenas)
+}
+
+func TestCommit(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	tc.WriteFile(tc.origFile, []byte("hello world"), 0644)
+	tc.Mkdir(tc.origSubdir, 0755)
+	tc.WriteFile(filepath.Join(tc.origSubdir, "deleted"), []byte("bye"), 0644)
+	tc.WriteFile(filepath.Join(tc.origSubdir, "renamed"), []byte("moving"), 0644)
+
+	// Modify the file in place
+	f, err := os.OpenFile(tc.mountFile, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("there"), 6); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	f.Close()
+	if err := os.Chmod(tc.mountFile, 0600); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+
+	// Create, delete, rename and symlink
+	tc.WriteFile(filepath.Join(tc.mnt, "new"), []byte("new content"), 0640)
+	if err := os.Remove(filepath.Join(tc.mountSubdir, "deleted")); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := os.Rename(filepath.Join(tc.mountSubdir, "renamed"),
+		filepath.Join(tc.mnt, "renamed")); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if err := os.Symlink("hello.txt", filepath.Join(tc.mnt, "link")); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+
+	// Nothing reached the original tree yet
+	if _, err := os.Lstat(filepath.Join(tc.orig, "new")); err == nil {
+		t.Fatalf("new file visible in the original before commit")
+	}
+
+	if code := tc.bufferFs.Commit(); code != fuse.OK {
+		t.Fatalf("Commit failed: %v", code)
+	}
+	if len(overlayedNames(tc.bufferFs)) != 0 {
+		t.Errorf("Overlay not empty after commit: %v", overlayedNames(tc.bufferFs))
+	}
+
+	expected := map[string]string{
+		"hello.txt": "hello there",
+		"new":       "new content",
+		"renamed":   "moving",
+	}
+	for name, content := range expected {
+		for _, dir := range []string{tc.orig, tc.mnt} {
+			back, err := ioutil.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatalf("ReadFile failed: %v", err)
+			}
+			CompareSlices(t, back, []byte(content))
+		}
+	}
+
+	fi, err := os.Lstat(tc.origFile)
+	if err != nil {
+		t.Fatalf("Lstat failed: %v", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("Wrong mode %o != %o", fi.Mode().Perm(), 0600)
+	}
+	fi, err = os.Lstat(filepath.Join(tc.orig, "new"))
+	if err != nil {
+		t.Fatalf("Lstat failed: %v", err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("Wrong mode %o != %o", fi.Mode().Perm(), 0640)
+	}
+
+	target, err := os.Readlink(filepath.Join(tc.orig, "link"))
+	if err != nil {
+		t.Fatalf("Readlink failed: %v", err)
+	}
+	if target != "hello.txt" {
+		t.Errorf("Wrong symlink target %q", target)
+	}
+
+	for _, name := range []string{"deleted", "renamed"} {
+		if _, err := os.Lstat(filepath.Join(tc.origSubdir, name)); err == nil {
+			t.Errorf("%v still exists in the original", name)
+		}
+	}
+}
+
+func TestCommitRenamedDirectory(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	tc.Mkdir(tc.origSubdir, 0755)
+	tc.WriteFile(filepath.Join(tc.origSubdir, "file"), []byte("content"), 0644)
+
+	moved := filepath.Join(tc.mnt, "moved")
+	if err := os.Rename(tc.mountSubdir, moved); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if code := tc.bufferFs.Commit(); code != fuse.OK {
+		t.Fatalf("Commit failed: %v", code)
+	}
+
+	if _, err := os.Lstat(tc.origSubdir); err == nil {
+		t.Errorf("Old directory still exists in the original")
+	}
+	back, err := ioutil.ReadFile(filepath.Join(tc.orig, "moved", "file"))
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	CompareSlices(t, back, []byte("content"))
+
+	entries, err := ioutil.ReadDir(tc.orig)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Unexpected entries left in the original: %v", entries)
+	}
+}
+
+// The paths of the wrapped file system that look like the ones the commit
+// stages sources at are user files like the others
+func TestCommitStagingNames(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	tc.Mkdir(tc.origSubdir, 0755)
+	tc.WriteFile(filepath.Join(tc.origSubdir, "renamed"), []byte("moving"), 0644)
+	for _, name := range []string{stagingPrefix + "0", stagingPrefix + "kept"} {
+		tc.WriteFile(filepath.Join(tc.orig, name), []byte("user"), 0644)
+	}
+
+	if err := os.Remove(filepath.Join(tc.mnt, stagingPrefix+"0")); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := os.Rename(filepath.Join(tc.mountSubdir, "renamed"), filepath.Join(tc.mnt, "renamed")); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if code := tc.bufferFs.Commit(); code != fuse.OK {
+		t.Fatalf("Commit failed: %v", code)
+	}
+
+	entries, err := ioutil.ReadDir(tc.orig)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	expected := []string{stagingPrefix + "kept", "renamed", "subdir"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Unexpected entries after commit: %v, want %v", names, expected)
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	tc.WriteFile(tc.origFile, []byte("original"), 0644)
+	tc.Mkdir(tc.origSubdir, 0755)
+
+	tc.WriteFile(tc.mountFile, []byte("modified"), 0644)
+	tc.WriteFile(filepath.Join(tc.mnt, "new"), []byte("new"), 0644)
+	if err := os.Remove(tc.mountSubdir); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+
+	tc.bufferFs.Discard()
+
+	back, err := ioutil.ReadFile(tc.mountFile)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	CompareSlices(t, back, []byte("original"))
+	if _, err := os.Lstat(filepath.Join(tc.mnt, "new")); err == nil {
+		t.Errorf("New file still visible after discard")
+	}
+	if fi, err := os.Lstat(tc.mountSubdir); err != nil || !fi.IsDir() {
+		t.Errorf("Removed directory not restored after discard: %v", err)
+	}
+}
+
+func TestDiscardPath(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	tc.WriteFile(tc.origFile, []byte("original"), 0644)
+	other := filepath.Join(tc.mnt, "other")
+	tc.WriteFile(filepath.Join(tc.orig, "other"), []byte("original"), 0644)
+
+	tc.WriteFile(tc.mountFile, []byte("modified"), 0644)
+	tc.WriteFile(other, []byte("modified"), 0644)
+	tc.WriteFile(filepath.Join(tc.mnt, "new"), []byte("new"), 0644)
+
+	for _, name := range []string{"hello.txt", "new"} {
+		if code := tc.bufferFs.DiscardPath(name); code != fuse.OK {
+			t.Fatalf("DiscardPath(%q) failed: %v", name, code)
+		}
+	}
+
+	back, err := ioutil.ReadFile(tc.mountFile)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	CompareSlices(t, back, []byte("original"))
+	back, err = ioutil.ReadFile(other)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	CompareSlices(t, back, []byte("modified"))
+	if _, err := os.Lstat(filepath.Join(tc.mnt, "new")); err == nil {
+		t.Errorf("New file still visible after discard")
+	}
+}
+
+// The handles open on a discarded file read what the wrapped file system has
+func TestDiscardOpenFile(t *testing.T) {
+	orig, err := ioutil.TempDir("", "ploufs-discard")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(orig)
+	for _, name := range []string{"file", "other"} {
+		if err := ioutil.WriteFile(filepath.Join(orig, name), []byte("original"), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	bufferFs := NewBufferFS(pathfs.NewLoopbackFileSystem(orig)).(*BufferFS)
+	context := ownContext()
+
+	read := func(f nodefs.File) string {
+		buf := make([]byte, 64)
+		r, code := f.Read(buf, 0)
+		if code != fuse.OK {
+			t.Fatalf("Read failed: %v", code)
+		}
+		b, _ := r.Bytes(buf)
+		return string(b)
+	}
+	for _, discard := range []func(){
+		func() { bufferFs.Discard() },
+		func() { bufferFs.DiscardPath("file") },
+	} {
+		f, code := bufferFs.Open("file", syscall.O_RDWR, context)
+		if code != fuse.OK {
+			t.Fatalf("Open failed: %v", code)
+		}
+		f.Write([]byte("modified, longer"), 0)
+		discard()
+		if got := read(f); got != "original" {
+			t.Errorf("Read after discard: got %q, want %q", got, "original")
+		}
+		attr := &fuse.Attr{}
+		if code := f.GetAttr(attr); code != fuse.OK || attr.Size != 8 {
+			t.Errorf("GetAttr after discard: got size %d, %v", attr.Size, code)
+		}
+		f.Release()
+	}
+}
+
+func TestChanges(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	tc.WriteFile(tc.origFile, []byte("original"), 0644)
+	tc.Mkdir(tc.origSubdir, 0755)
+	for _, name := range []string{"deleted", "renamed", "chmoded", "untouched"} {
+		tc.WriteFile(filepath.Join(tc.origSubdir, name), []byte(name), 0644)
+	}
+	if err := os.Symlink("hello.txt", filepath.Join(tc.orig, "link")); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	tc.Mkdir(filepath.Join(tc.orig, "dir"), 0755)
+	for _, name := range []string{"kept", "modified", "removed"} {
+		tc.WriteFile(filepath.Join(tc.orig, "dir", name), []byte(name), 0644)
+	}
+
+	tc.WriteFile(tc.mountFile, []byte("modified"), 0644)
+	tc.WriteFile(filepath.Join(tc.mnt, "new"), []byte("new"), 0644)
+	if err := os.Remove(filepath.Join(tc.mountSubdir, "deleted")); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := os.Rename(filepath.Join(tc.mountSubdir, "renamed"),
+		filepath.Join(tc.mnt, "renamed")); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if err := os.Chmod(filepath.Join(tc.mountSubdir, "chmoded"), 0600); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	if err := os.Remove(filepath.Join(tc.mnt, "link")); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := os.Symlink("new", filepath.Join(tc.mnt, "link")); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	// Reading does not count as a change
+	if _, err := ioutil.ReadFile(filepath.Join(tc.mountSubdir, "untouched")); err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	// What a renamed directory holds moves along with it
+	if err := os.Rename(filepath.Join(tc.mnt, "dir"), filepath.Join(tc.mnt, "moved")); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	tc.WriteFile(filepath.Join(tc.mnt, "moved", "modified"), []byte("changed"), 0644)
+	if err := os.Remove(filepath.Join(tc.mnt, "moved", "removed")); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+
+	changes, code := tc.bufferFs.Changes()
+	if code != fuse.OK {
+		t.Fatalf("Changes failed: %v", code)
+	}
+	expected := []string{
+		"M hello.txt",
+		"L link",
+		"R dir -> moved",
+		"M moved/modified",
+		"D moved/removed",
+		"A new",
+		"R subdir/renamed -> renamed",
+		"T subdir/chmoded",
+		"D subdir/deleted",
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, changes)
+	}
+	for i, c := range changes {
+		if c.String() != expected[i] {
+			t.Errorf("Change %v: expected '%v', got '%v'", i, expected[i], c)
+		}
+	}
+}
+
+func TestControlDiff(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+	defer tc.serveControl()()
+
+	tc.WriteFile(tc.mountFile, []byte("new"), 0644)
+
+	if out := tc.control("diff"); out != "A hello.txt\n" {
+		t.Errorf("Unexpected diff output: %q", out)
+	}
+	if err := Control(tc.mnt, []string{"nonexisting"}, ioutil.Discard); err == nil {
+		t.Errorf("Expected an error for an unknown command")
+	}
+}
+
+// Only the user may reach the control socket
+func TestListenControl(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+	defer tc.serveControl()()
+
+	socket := ControlSocket(tc.mnt)
+	for name, perm := range map[string]os.FileMode{filepath.Dir(socket): 0700, socket: 0600} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		if info.Mode().Perm() != perm {
+			t.Errorf("%s: mode %o, want %o", name, info.Mode().Perm(), perm)
+		}
+	}
+	// A control directory that others may enter is refused
+	if err := os.Chmod(filepath.Dir(socket), 0755); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	defer os.Chmod(filepath.Dir(socket), 0700)
+	if l, err := ListenControl(tc.mnt); err == nil {
+		l.Close()
+		t.Errorf("Expected an error for a shared control directory")
+	}
+
+	// The peers whose user is unknown are refused
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleControl(tc.bufferFs, server)
+	if _, err := io.WriteString(client, "diff\x00\x00"); err != nil {
+		t.Fatalf("WriteString failed: %v", err)
+	}
+	response, err := ioutil.ReadAll(client)
+	if err != nil || string(response) != "-permission denied\n" {
+		t.Errorf("Unexpected response to an unknown peer: %q, %v", response, err)
+	}
+}
+
+func TestControlDiscard(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+	defer tc.serveControl()()
+
+	tc.Mkdir(tc.origSubdir, 0755)
+	tc.WriteFile(tc.mountFile, []byte("new"), 0644)
+	tc.WriteFile(filepath.Join(tc.mountSubdir, "new"), []byte("new"), 0644)
+
+	tc.control("discard", "subdir")
+	if out := tc.control("diff"); out != "A hello.txt\n" {
+		t.Errorf("Unexpected diff output: %q", out)
+	}
+	if err := Control(tc.mnt, []string{"discard", "../hello.txt"}, ioutil.Discard); err == nil {
+		t.Errorf("Expected an error for a path out of the mount")
+	}
+	tc.control("discard")
+	if out := tc.control("diff"); out != "" {
+		t.Errorf("Unexpected diff output: %q", out)
+	}
+}
+
+func TestControlCommit(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+	defer tc.serveControl()()
+
+	tc.WriteFile(tc.mountFile, []byte("new"), 0644)
+
+	tc.control("commit")
+	content, err := ioutil.ReadFile(tc.origFile)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	CompareSlices(t, content, []byte("new"))
+	if out := tc.control("diff"); out != "" {
+		t.Errorf("Unexpected diff output: %q", out)
+	}
+	if err := Control(tc.mnt, []string{"commit", "extra"}, ioutil.Discard); err == nil {
+		t.Errorf("Expected an error for an extra argument")
+	}
+}
+
+func TestControlPatch(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+	defer tc.serveControl()()
+
+	tc.WriteFile(tc.mountFile, []byte("new\n"), 0644)
+
+	if out := tc.control("patch"); !strings.Contains(out, "+++ b/hello.txt\n") {
+		t.Errorf("Unexpected patch output: %q", out)
+	}
+	if err := Control(tc.mnt, []string{"patch", "extra"}, ioutil.Discard); err == nil {
+		t.Errorf("Expected an error for an extra argument")
+	}
+}
+
+func TestControlUpper(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+	defer tc.serveControl()()
+
+	tc.WriteFile(tc.mountFile, []byte("new"), 0644)
+
+	upper := filepath.Join(tc.tmpDir, "upper")
+	tc.control("upper", upper)
+	content, err := ioutil.ReadFile(filepath.Join(upper, "hello.txt"))
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	CompareSlices(t, content, []byte("new"))
+	if err := Control(tc.mnt, []string{"upper", "relative"}, ioutil.Discard); err == nil {
+		t.Errorf("Expected an error for a relative path")
+	}
+}
+
+func TestControlExport(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+	defer tc.serveControl()()
+
+	tc.WriteFile(tc.mountFile, []byte("new"), 0644)
+
+	tr := tar.NewReader(strings.NewReader(tc.control("export", "--format=oci-layer")))
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("Reading the layer failed: %v", err)
+	}
+	if hdr.Name != "hello.txt" {
+		t.Errorf("Unexpected entry in the layer: %v", hdr.Name)
+	}
+	if err := Control(tc.mnt, []string{"export", "--format=zip"}, ioutil.Discard); err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+}
+
+func TestControlSave(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+	defer tc.serveControl()()
+
+	tc.WriteFile(tc.mountFile, []byte("new"), 0644)
+
+	state := filepath.Join(tc.tmpDir, "state")
+	tc.control("save", state)
+	tc.control("discard")
+	tc.control("load", state)
+	if out := tc.control("diff"); out != "A hello.txt\n" {
+		t.Errorf("Unexpected diff output after load: %q", out)
+	}
+	if err := Control(tc.mnt, []string{"load", "relative"}, ioutil.Discard); err == nil {
+		t.Errorf("Expected an error for a relative path")
+	}
+}
+
+func TestControlCheckpoint(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+	defer tc.serveControl()()
+
+	tc.WriteFile(tc.mountFile, []byte("new"), 0644)
+	tc.control("checkpoint", "first")
+	tc.WriteFile(filepath.Join(tc.mnt, "other"), []byte("other"), 0644)
+
+	if out := tc.control("checkpoint"); out != "first\n" {
+		t.Errorf("Unexpected checkpoints: %q", out)
+	}
+	tc.control("rollback", "first")
+	if out := tc.control("diff"); out != "A hello.txt\n" {
+		t.Errorf("Unexpected diff output after rollback: %q", out)
+	}
+	if err := Control(tc.mnt, []string{"rollback", "nonexisting"}, ioutil.Discard); err == nil {
+		t.Errorf("Expected an error for an unknown checkpoint")
+	}
+}
+
+func TestWritePatch(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	tc.WriteFile(tc.origFile, []byte("1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"), 0644)
+	tc.Mkdir(tc.origSubdir, 0755)
+	tc.WriteFile(filepath.Join(tc.origSubdir, "deleted"), []byte("bye\n"), 0644)
+	tc.WriteFile(filepath.Join(tc.origSubdir, "renamed"), []byte("moving"), 0644)
+	tc.WriteFile(filepath.Join(tc.orig, "script"), []byte("#!/bin/sh\n"), 0644)
+	tc.WriteFile(filepath.Join(tc.orig, "with space"), []byte("space\n"), 0644)
+	if err := os.Symlink("hello.txt", filepath.Join(tc.orig, "link")); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	long, changed := &bytes.Buffer{}, &bytes.Buffer{}
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(long, "%d\n", i)
+		if i%100 == 50 {
+			fmt.Fprintf(changed, "changed %d\n", i)
+		} else {
+			fmt.Fprintf(changed, "%d\n", i)
+		}
+	}
+	tc.WriteFile(filepath.Join(tc.orig, "long"), long.Bytes(), 0644)
+	tc.Mkdir(filepath.Join(tc.orig, "dir"), 0755)
+	tc.Mkdir(filepath.Join(tc.orig, "dir", "sub"), 0755)
+	for _, name := range []string{"kept", "modified", "removed", "replaced", "sub/deep"} {
+		tc.WriteFile(filepath.Join(tc.orig, "dir", name), []byte(name+"\n"), 0644)
+	}
+	if err := os.Rename(filepath.Join(tc.mnt, "dir"), filepath.Join(tc.mnt, "moved")); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	for _, name := range []string{"removed", "replaced"} {
+		if err := os.Remove(filepath.Join(tc.mnt, "moved", name)); err != nil {
+			t.Fatalf("Remove failed: %v", err)
+		}
+	}
+
+	expected := map[string]string{
+		"hello.txt":      "1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\neleven",
+		"new":            "new\n",
+		"binary":         "\x00\x01\x02binary",
+		"renamed":        "moving",
+		"script":         "#!/bin/sh\n",
+		"with space":     "more space\n",
+		"quo\"te":        "quote\n",
+		"été":            "summer\n",
+		"long":           changed.String(),
+		"moved/modified": "changed\n",
+		"moved/replaced": "new\n",
+	}
+	if err := os.Rename(filepath.Join(tc.mountSubdir, "renamed"),
+		filepath.Join(tc.mnt, "renamed")); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	for name, content := range expected {
+		tc.WriteFile(filepath.Join(tc.mnt, name), []byte(content), 0644)
+	}
+	// Moved along with their directory
+	expected["moved/kept"] = "kept\n"
+	expected["moved/sub/deep"] = "sub/deep\n"
+	if err := os.Remove(filepath.Join(tc.mountSubdir, "deleted")); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := os.Chmod(filepath.Join(tc.mnt, "script"), 0755); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	if err := os.Remove(filepath.Join(tc.mnt, "link")); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := os.Symlink("new", filepath.Join(tc.mnt, "link")); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+
+	patch := &bytes.Buffer{}
+	if err := tc.bufferFs.WritePatch(patch); err != nil {
+		t.Fatalf("WritePatch failed: %v", err)
+	}
+
+	for _, header := range []string{
+		"diff --git a/with space b/with space\n",
+		"--- a/with space\t\n",
+		`diff --git "a/quo\"te" "b/quo\"te"`,
+		`diff --git "a/\303\251t\303\251" "b/\303\251t\303\251"`,
+	} {
+		if !strings.Contains(patch.String(), header) {
+			t.Errorf("Patch without %q:\n%s", header, patch.String())
+		}
+	}
+
+	cmd := exec.Command("git", "apply", "-")
+	cmd.Dir = tc.orig
+	cmd.Stdin = bytes.NewReader(patch.Bytes())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git apply failed: %v\n%s\n%s", err, out, patch.String())
+	}
+
+	for name, content := range expected {
+		back, err := ioutil.ReadFile(filepath.Join(tc.orig, name))
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		CompareSlices(t, back, []byte(content))
+	}
+	for _, name := range []string{"subdir/deleted", "moved/removed", "dir"} {
+		if _, err := os.Lstat(filepath.Join(tc.orig, name)); err == nil {
+			t.Errorf("%v still exists after applying the patch", name)
+		}
+	}
+	if fi, err := os.Lstat(filepath.Join(tc.orig, "script")); err != nil || fi.Mode().Perm()&0100 == 0 {
+		t.Errorf("Mode change not applied: %v", err)
+	}
+	if target, err := os.Readlink(filepath.Join(tc.orig, "link")); err != nil || target != "new" {
+		t.Errorf("Symlink change not applied: %v %v", target, err)
+	}
+}
+
+func TestExportUpper(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	upper, err := ioutil.TempDir("", "ploufs-upper")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(upper)
+
+	tc.WriteFile(tc.origFile, []byte("hello world"), 0644)
+	tc.WriteFile(filepath.Join(tc.orig, "kept"), []byte("kept"), 0644)
+	tc.Mkdir(tc.origSubdir, 0755)
+	for _, name := range []string{"deleted", "renamed", "stays"} {
+		tc.WriteFile(filepath.Join(tc.origSubdir, name), []byte(name), 0644)
+	}
+	replaced := filepath.Join(tc.orig, "replaced")
+	tc.Mkdir(replaced, 0755)
+	tc.WriteFile(filepath.Join(replaced, "x"), []byte("x"), 0644)
+	tc.WriteFile(filepath.Join(replaced, "y"), []byte("y"), 0644)
+	tc.Mkdir(filepath.Join(tc.orig, "dir"), 0755)
+	tc.Mkdir(filepath.Join(tc.orig, "dir", "sub"), 0755)
+	tc.WriteFile(filepath.Join(tc.orig, "dir", "sub", "deep"), []byte("deep"), 0644)
+
+	tc.WriteFile(tc.mountFile, []byte("hello there"), 0644)
+	if err := os.Chmod(tc.mountFile, 0600); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	if err := os.Remove(filepath.Join(tc.mountSubdir, "deleted")); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := os.Rename(filepath.Join(tc.mountSubdir, "renamed"),
+		filepath.Join(tc.mnt, "renamed")); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if err := os.RemoveAll(filepath.Join(tc.mnt, "replaced")); err != nil {
+		t.Fatalf("RemoveAll failed: %v", err)
+	}
+	tc.Mkdir(filepath.Join(tc.mnt, "replaced"), 0700)
+	tc.WriteFile(filepath.Join(tc.mnt, "replaced", "z"), []byte("z"), 0644)
+	if err := os.Rename(filepath.Join(tc.mnt, "dir"), filepath.Join(tc.mnt, "moved")); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if err := os.Link(tc.mountFile, filepath.Join(tc.mnt, "linked")); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+
+	if err := tc.bufferFs.ExportUpper(upper); err != nil {
+		t.Fatalf("ExportUpper failed: %v", err)
+	}
+
+	expected := map[string]string{
+		"hello.txt":      "hello there",
+		"linked":         "hello there",
+		"moved/sub/deep": "deep",
+		"renamed":        "renamed",
+		"replaced/z":     "z",
+	}
+	for name, content := range expected {
+		back, err := ioutil.ReadFile(filepath.Join(upper, name))
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		CompareSlices(t, back, []byte(content))
+	}
+	for _, name := range []string{"kept", "subdir/stays"} {
+		if _, err := os.Lstat(filepath.Join(upper, name)); err == nil {
+			t.Errorf("Unchanged path %v exported", name)
+		}
+	}
+	if fi, err := os.Lstat(filepath.Join(upper, "hello.txt")); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Mode not exported: %v", err)
+	}
+	first, _ := os.Lstat(filepath.Join(upper, "hello.txt"))
+	if second, err := os.Lstat(filepath.Join(upper, "linked")); err != nil || !os.SameFile(first, second) {
+		t.Errorf("Hard link exported as a copy: %v", err)
+	}
+
+	privileged := os.Geteuid() == 0
+	for _, name := range []string{"subdir/deleted", "subdir/renamed", "dir"} {
+		dir, base := filepath.Split(filepath.Join(upper, name))
+		if privileged {
+			fi, err := os.Lstat(filepath.Join(dir, base))
+			if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+				t.Errorf("No whiteout device for %v: %v", name, err)
+			}
+		} else if _, err := os.Lstat(filepath.Join(dir, ".wh."+base)); err != nil {
+			t.Errorf("No whiteout file for %v: %v", name, err)
+		}
+	}
+	if privileged {
+		buf := make([]byte, 1)
+		n, err := syscall.Getxattr(filepath.Join(upper, "replaced"), "trusted.overlay.opaque", buf)
+		if err != nil || string(buf[:n]) != "y" {
+			t.Errorf("Directory not marked opaque: %v", err)
+		}
+	} else if _, err := os.Lstat(filepath.Join(upper, "replaced", ".wh..wh..opq")); err != nil {
+		t.Errorf("Directory not marked opaque: %v", err)
+	}
+
+	if err := tc.bufferFs.ExportUpper(upper); err == nil {
+		t.Errorf("Expected an error when exporting to a non empty directory")
+	}
+}
+
+func TestWriteLayer(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	tc.WriteFile(tc.origFile, []byte("hello world"), 0644)
+	tc.Mkdir(tc.origSubdir, 0755)
+	tc.WriteFile(filepath.Join(tc.origSubdir, "deleted"), []byte("bye"), 0644)
+	tc.WriteFile(filepath.Join(tc.origSubdir, "stays"), []byte("stays"), 0644)
+	tc.Mkdir(filepath.Join(tc.orig, "emptied"), 0755)
+	tc.WriteFile(filepath.Join(tc.orig, "emptied", "x"), []byte("x"), 0644)
+
+	tc.WriteFile(tc.mountFile, []byte("hello there"), 0644)
+	if err := os.Chmod(tc.mountFile, 0751); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	if err := os.Remove(filepath.Join(tc.mountSubdir, "deleted")); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := os.Remove(filepath.Join(tc.mnt, "emptied", "x")); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := os.Symlink("hello.txt", filepath.Join(tc.mountSubdir, "link")); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	if err := syscall.Mknod(filepath.Join(tc.mountSubdir, "socket"), syscall.S_IFSOCK|0644, 0); err != nil {
+		t.Fatalf("Mknod failed: %v", err)
+	}
+	if err := os.Link(tc.mountFile, filepath.Join(tc.mnt, "linked")); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+
+	layer := &bytes.Buffer{}
+	if err := tc.bufferFs.WriteLayer(layer); err != nil {
+		t.Fatalf("WriteLayer failed: %v", err)
+	}
+
+	headers := make(map[string]*tar.Header)
+	contents := make(map[string]string)
+	tr := tar.NewReader(layer)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("ReadAll failed: %v", err)
+		}
+		headers[hdr.Name] = hdr
+		contents[hdr.Name] = string(content)
+	}
+
+	expected := []string{
+		"hello.txt",
+		"linked",
+		"subdir/",
+		"subdir/.wh.deleted",
+		"subdir/link",
+		"emptied/",
+		"emptied/.wh..wh..opq",
+	}
+	if len(headers) != len(expected) {
+		t.Errorf("Unexpected layer entries: %v", headers)
+	}
+	for _, name := range expected {
+		if headers[name] == nil {
+			t.Fatalf("Missing layer entry %v", name)
+		}
+	}
+	if hdr := headers["subdir/socket"]; hdr != nil {
+		t.Errorf("Socket written to the layer: %v", hdr)
+	}
+	hdr := headers["hello.txt"]
+	if contents["hello.txt"] != "hello there" || hdr.Mode != 0751 ||
+		hdr.Uid != os.Getuid() || hdr.Gid != os.Getgid() {
+		t.Errorf("Unexpected file entry: %v %q", hdr, contents["hello.txt"])
+	}
+	if hdr := headers["linked"]; hdr.Typeflag != tar.TypeLink || hdr.Linkname != "hello.txt" {
+		t.Errorf("Unexpected hard link entry: %v", hdr)
+	}
+	if hdr := headers["subdir/link"]; hdr.Typeflag != tar.TypeSymlink || hdr.Linkname != "hello.txt" {
+		t.Errorf("Unexpected symlink entry: %v", hdr)
+	}
+	if hdr := headers["subdir/"]; hdr.Typeflag != tar.TypeDir || hdr.Mode != 0755 {
+		t.Errorf("Unexpected directory entry: %v", hdr)
+	}
+}
+
+// Checks that two BufferFS overlay the same paths with the same state
+func compareOverlays(t *testing.T, exp *BufferFS, got *BufferFS) {
+	context := ownContext()
+	defer exp.RLocked()()
+	defer got.RLocked()()
+	if exp.Overlayed.Len() != got.Overlayed.Len() {
+		t.Fatalf("Overlayed %v paths, expected %v", got.Overlayed.Len(), exp.Overlayed.Len())
+	}
+	for _, name := range exp.Overlayed.Names() {
+		o := exp.Overlayed.Get(name)
+		p := got.Overlayed.Get(name)
+		if p == nil {
+			t.Fatalf("%q is not overlayed", name)
+		}
+		a, b := fuse.Attr{}, fuse.Attr{}
+		o.GetAttr(&a)
+		p.GetAttr(&b)
+		if a != b {
+			t.Errorf("Attributes of %q differ: %v != %v", name, b, a)
+		}
+		expEntries, _ := o.Entries(context)
+		gotEntries, _ := p.Entries(context)
+		if !reflect.DeepEqual(expEntries, gotEntries) {
+			t.Errorf("Entries of %q differ: %v != %v", name, gotEntries, expEntries)
+		}
+		expBlob, err := exp.overlayBlob(name, context)
+		if err != nil {
+			t.Fatalf("overlayBlob failed: %v", err)
+		}
+		gotBlob, err := got.overlayBlob(name, context)
+		if err != nil {
+			t.Fatalf("overlayBlob failed: %v", err)
+		}
+		if !reflect.DeepEqual(expBlob, gotBlob) {
+			t.Errorf("Content of %q differs: %v != %v", name, gotBlob, expBlob)
+		}
+	}
+}
+
+func TestJournal(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ploufs-journal")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	orig := filepath.Join(tmp, "orig")
+	dir := filepath.Join(tmp, "journal")
+	if err := os.Mkdir(orig, 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(orig, "existing"), []byte("hello world"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	context := ownContext()
+
+	bufferFs := NewBufferFS(pathfs.NewLoopbackFileSystem(orig)).(*BufferFS)
+	journalFs, err := NewJournalFS(bufferFs, dir)
+	if err != nil {
+		t.Fatalf("NewJournalFS failed: %v", err)
+	}
+	journalFs.Sync = true
+	if _, err := NewJournalFS(NewBufferFS(pathfs.NewLoopbackFileSystem(orig)).(*BufferFS), dir); err == nil {
+		t.Fatalf("Expected an error when opening a journal in use")
+	}
+
+	check := func(code fuse.Status) {
+		if code != fuse.OK {
+			t.Fatalf("Operation failed: %v", code)
+		}
+	}
+	check(journalFs.Mkdir("dir", 0750, context))
+	f, code := journalFs.Create("dir/new", syscall.O_WRONLY, 0640, context)
+	check(code)
+	_, code = f.Write([]byte("new content"), 0)
+	check(code)
+	// The handle follows the file when it moves
+	check(journalFs.Rename("dir", "moved", context))
+	_, code = f.Write([]byte("CONTENT"), 4)
+	check(code)
+	check(f.Chmod(0600))
+	f.Release()
+
+	f, code = journalFs.Open("existing", syscall.O_WRONLY, context)
+	check(code)
+	_, code = f.Write([]byte("there"), 6)
+	check(code)
+	check(f.Truncate(8))
+	f.Release()
+	mtime := time.Unix(1234567890, 0)
+	check(journalFs.Utimens("existing", nil, &mtime, context))
+	check(journalFs.Symlink("existing", "link", context))
+	check(journalFs.Chown("link", 1, 2, context))
+	check(journalFs.Symlink("moved/new", "other", context))
+	check(journalFs.Unlink("other", context))
+	check(journalFs.Mkdir("other", 0700, context))
+	check(journalFs.DiscardPath("link"))
+	check(journalFs.Checkpoint("checkpoint"))
+	// The checkpoint compacts the journal into the states of the overlay
+	// and of the checkpoint
+	if states, _ := filepath.Glob(filepath.Join(dir, statePrefix+"*")); len(states) != 2 {
+		t.Errorf("Unexpected states after a checkpoint: %v", states)
+	}
+	check(journalFs.Mkdir("rolledback", 0700, context))
+	check(journalFs.RollbackTo("checkpoint"))
+	journalFs.Close()
+
+	replay := func() *BufferFS {
+		replayed := NewBufferFS(pathfs.NewLoopbackFileSystem(orig)).(*BufferFS)
+		journalFs, err := NewJournalFS(replayed, dir)
+		if err != nil {
+			t.Fatalf("NewJournalFS failed: %v", err)
+		}
+		journalFs.Close()
+		return replayed
+	}
+	replayed := replay()
+	compareOverlays(t, bufferFs, replayed)
+	if names := replayed.Checkpoints(); !reflect.DeepEqual(names, []string{"checkpoint"}) {
+		t.Errorf("Unexpected checkpoints after replay: %v", names)
+	}
+	// The checkpoint read back from the journal rolls back the same way
+	check(replayed.Mkdir("rolledback", 0700, context))
+	check(replayed.RollbackTo("checkpoint"))
+	compareOverlays(t, bufferFs, replayed)
+
+	// An entry interrupted by a crash is dropped
+	journal := filepath.Join(dir, journalName)
+	info, err := os.Stat(journal)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	j, err := os.OpenFile(journal, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	j.Write([]byte{0, 0, 1, 0, 1, 2, 3, 4, 5})
+	j.Close()
+	compareOverlays(t, bufferFs, replay())
+	if after, err := os.Stat(journal); err != nil || after.Size() != info.Size() {
+		t.Errorf("Partial entry not removed from the journal: %v", err)
+	}
+
+	// Discarding the changes empties the journal
+	journalFs, err = NewJournalFS(NewBufferFS(pathfs.NewLoopbackFileSystem(orig)).(*BufferFS), dir)
+	if err != nil {
+		t.Fatalf("NewJournalFS failed: %v", err)
+	}
+	journalFs.Discard()
+	journalFs.Close()
+	if replayed := replay(); len(overlayedNames(replayed)) != 0 {
+		t.Errorf("Changes restored after a discard: %v", overlayedNames(replayed))
+	}
+}
+
+func TestSaveState(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	tc.WriteFile(tc.origFile, []byte("hello world"), 0644)
+	tc.Mkdir(tc.origSubdir, 0755)
+	tc.WriteFile(filepath.Join(tc.origSubdir, "renamed"), []byte("moving"), 0644)
+
+	f, err := os.OpenFile(tc.mountFile, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("there"), 6); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	f.Close()
+	tc.WriteFile(filepath.Join(tc.mountSubdir, "new"), []byte("new"), 0600)
+	if err := os.Rename(filepath.Join(tc.mountSubdir, "renamed"),
+		filepath.Join(tc.mnt, "renamed")); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if err := os.Symlink("hello.txt", filepath.Join(tc.mnt, "link")); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+
+	state := &bytes.Buffer{}
+	if err := tc.bufferFs.SaveState(state); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	saved := state.Bytes()
+
+	loaded := NewBufferFS(pathfs.NewLoopbackFileSystem(tc.orig)).(*BufferFS)
+	if err := loaded.LoadState(bytes.NewReader(saved)); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	compareOverlays(t, tc.bufferFs, loaded)
+
+	// Loading replaces the buffered changes of the mount
+	tc.WriteFile(filepath.Join(tc.mnt, "dropped"), []byte("dropped"), 0644)
+	if err := tc.bufferFs.LoadState(bytes.NewReader(saved)); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	compareOverlays(t, loaded, tc.bufferFs)
+	if _, err := os.Lstat(filepath.Join(tc.mnt, "dropped")); err == nil {
+		t.Errorf("Changes made after the save are still visible")
+	}
+
+	// Corrupted or future states are refused, and do not change anything
+	corrupted := append([]byte{}, saved...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	future := append([]byte{}, saved...)
+	future[len(stateMagic)] = stateVersion + 1
+	for _, bad := range [][]byte{corrupted, future, saved[:len(saved)-1], nil} {
+		if err := loaded.LoadState(bytes.NewReader(bad)); err == nil {
+			t.Errorf("Expected an error when loading an invalid state")
+		}
+	}
+	compareOverlays(t, tc.bufferFs, loaded)
+
+	// States which would change what is outside of the tree are refused
+	attr := NewOverlayAttrFromScratch(fuse.S_IFREG|0644, 0, 0, time.Now())
+	dirAttr := NewOverlayAttrFromScratch(fuse.S_IFDIR|0755, 0, 0, time.Now())
+	unsafe := map[string]OverlayPath{
+		"../escape":   NewOverlayFile(attr, NoSource),
+		"stolen":      NewOverlayFile(attr, "/etc/passwd"),
+		"climbing":    NewOverlayFile(attr, "subdir/../../x"),
+		"dir":         NewOverlayDir(dirAttr, NoSource, []fuse.DirEntry{{Name: "..", Mode: fuse.S_IFDIR}}),
+		"slashed/dir": NewOverlayDir(dirAttr, NoSource, []fuse.DirEntry{{Name: "a/b", Mode: fuse.S_IFREG}}),
+	}
+	for name, o := range unsafe {
+		b := NewBufferFS(pathfs.NewLoopbackFileSystem(tc.orig)).(*BufferFS)
+		b.Overlayed.Set(name, o)
+		buf := &bytes.Buffer{}
+		if err := b.SaveState(buf); err != nil {
+			t.Fatalf("SaveState failed: %v", err)
+		}
+		if err := loaded.LoadState(buf); err == nil {
+			t.Errorf("Expected an error when loading a state with %q", name)
+		}
+	}
+	compareOverlays(t, tc.bufferFs, loaded)
+
+	// A state loaded in a journaled file system survives a restart
+	dir := filepath.Join(tc.tmpDir, "journal")
+	journalFs, err := NewJournalFS(NewBufferFS(pathfs.NewLoopbackFileSystem(tc.orig)).(*BufferFS), dir)
+	if err != nil {
+		t.Fatalf("NewJournalFS failed: %v", err)
+	}
+	if err := journalFs.LoadState(bytes.NewReader(saved)); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	journalFs.Close()
+	replayed := NewBufferFS(pathfs.NewLoopbackFileSystem(tc.orig)).(*BufferFS)
+	journalFs, err = NewJournalFS(replayed, dir)
+	if err != nil {
+		t.Fatalf("NewJournalFS failed: %v", err)
+	}
+	journalFs.Close()
+	compareOverlays(t, tc.bufferFs, replayed)
+}
+
+func TestCheckpoint(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	tc.WriteFile(tc.origFile, []byte("hello world"), 0644)
+	tc.Mkdir(tc.origSubdir, 0755)
+
+	tc.WriteFile(filepath.Join(tc.mountSubdir, "step1"), []byte("step1"), 0644)
+	f, err := os.OpenFile(tc.mountFile, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte("there"), 6); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if code := tc.bufferFs.Checkpoint("step1"); code != fuse.OK {
+		t.Fatalf("Checkpoint failed: %v", code)
+	}
+	saved := &bytes.Buffer{}
+	if err := tc.bufferFs.SaveState(saved); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+
+	// A step that goes wrong
+	if _, err := f.WriteAt([]byte("THERE, and more"), 6); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	tc.WriteFile(filepath.Join(tc.mountSubdir, "step2"), []byte("step2"), 0644)
+	if err := os.Remove(filepath.Join(tc.mountSubdir, "step1")); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := os.Chmod(tc.mountSubdir, 0700); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+
+	expected := NewBufferFS(pathfs.NewLoopbackFileSystem(tc.orig)).(*BufferFS)
+	if err := expected.LoadState(saved); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if code := tc.bufferFs.RollbackTo("step1"); code != fuse.OK {
+			t.Fatalf("RollbackTo failed: %v", code)
+		}
+		compareOverlays(t, expected, tc.bufferFs)
+
+		// The file handle opened before the checkpoint is still usable
+		buf := make([]byte, 32)
+		n, _ := f.ReadAt(buf, 0)
+		CompareSlices(t, buf[:n], []byte("hello there"))
+		if _, err := f.WriteAt([]byte("again"), 6); err != nil {
+			t.Fatalf("WriteAt failed: %v", err)
+		}
+		back, err := ioutil.ReadFile(tc.mountFile)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		CompareSlices(t, back, []byte("hello again"))
+	}
+
+	if _, err := os.Lstat(filepath.Join(tc.mountSubdir, "step2")); err == nil {
+		t.Errorf("File created after the checkpoint still visible")
+	}
+	if code := tc.bufferFs.RollbackTo("nonexisting"); code != fuse.ENOENT {
+		t.Errorf("Expected ENOENT for an unknown checkpoint, got %v", code)
+	}
+	if names := tc.bufferFs.Checkpoints(); !reflect.DeepEqual(names, []string{"step1"}) {
+		t.Errorf("Unexpected checkpoints: %v", names)
+	}
+}
+
+func TestScratch(t *testing.T) {
+	scratchDir, err := ioutil.TempDir("", "ploufs-scratch")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(scratchDir)
+	SetScratch(scratchDir, 16*1024)
+	defer SetScratch("", -1)
+
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	tc.WriteFile(tc.origFile, []byte("hello world"), 0644)
+
+	// Overlapping writes, going past the budget
+	expected := []byte("hello world")
+	f, err := os.OpenFile(tc.mountFile, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	for i := 0; i < 32; i++ {
+		data := bytes.Repeat([]byte{byte('a' + i%26)}, 4096)
+		off := i * 3000
+		if _, err := f.WriteAt(data, int64(off)); err != nil {
+			t.Fatalf("WriteAt failed: %v", err)
+		}
+		if off+len(data) > len(expected) {
+			expected = append(expected, make([]byte, off+len(data)-len(expected))...)
+		}
+		copy(expected[off:], data)
+	}
+	// Extending the file does not allocate memory either
+	if err := f.Truncate(1 << 20); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	expected = append(expected, make([]byte, 1<<20-len(expected))...)
+	f.Close()
+
+	slices := fileSlices(overlayed(tc.bufferFs, "hello.txt").(*OverlayFile))
+	mapped := 0
+	for _, s := range slices.Slices() {
+		if s.buf != nil && s.buf.arena != nil {
+			mapped++
+		}
+	}
+	if mapped == 0 {
+		t.Fatalf("No slice in the scratch directory: %v", slices.Slices())
+	}
+	// The slices share a single arena
+	if arenas := scratchArenas(); arenas != 1 {
+		t.Fatalf("Unexpected number of arenas: %v", arenas)
+	}
+	// The scratch file is only alive through its descriptor
+	if entries, _ := ioutil.ReadDir(scratchDir); len(entries) != 0 {
+		t.Fatalf("Scratch files left: %v", entries)
+	}
+
+	content, err := ioutil.ReadFile(tc.mountFile)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	CompareSlices(t, content, expected)
+
+	if code := tc.bufferFs.Commit(); code != fuse.OK {
+		t.Fatalf("Commit failed: %v", code)
+	}
+	content, err = ioutil.ReadFile(tc.origFile)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	CompareSlices(t, content, expected)
+
+	// Once committed, the data is not needed anymore
+	if arenas := scratchArenas(); arenas != -1 {
+		t.Fatalf("Scratch space not released: %v arenas", arenas)
+	}
+}
+
+func TestScratchFull(t *testing.T) {
+	// The scratch space cannot be created there
+	SetScratch("/nonexistent", 0)
+	defer SetScratch("", -1)
+
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	tc.WriteFile(tc.origFile, []byte("hello world"), 0644)
+
+	f, err := os.OpenFile(tc.mountFile, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	defer f.Close()
+	_, err = f.WriteAt([]byte("HELLO"), 0)
+	if perr, ok := err.(*os.PathError); !ok || perr.Err != syscall.ENOSPC {
+		t.Fatalf("Expected ENOSPC, got %v", err)
+	}
+
+	content, err := ioutil.ReadFile(tc.mountFile)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	CompareSlices(t, content, []byte("hello world"))
+}
+
+func TestHoles(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	tc.WriteFile(tc.origFile, []byte("hello world"), 0644)
+
+	f, err := os.OpenFile(tc.mountFile, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	defer f.Close()
+	// The hole hides the end of the wrapped file
+	if err := f.Truncate(5); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("!"), 1<<20); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	// Writes in the hole split it
+	if _, err := f.WriteAt([]byte("hole"), 1<<19); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	expected := make([]byte, 1<<20+1)
+	copy(expected, "hello")
+	copy(expected[1<<19:], "hole")
+	expected[1<<20] = '!'
+
+	content, err := ioutil.ReadFile(tc.mountFile)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	CompareSlices(t, content, expected)
+
+	// Extending the file costs nothing
+	if err := f.Truncate(100 << 30); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Stat(tc.mountFile, &st); err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if st.Size != 100<<30 || st.Blocks > 8 {
+		t.Errorf("Got size %d and %d blocks, want %d and at most 8 blocks", st.Size, st.Blocks, 100<<30)
+	}
+	buf := make([]byte, 16)
+	if n, err := f.ReadAt(buf, 50<<30); n != len(buf) || err != nil {
+		t.Fatalf("ReadAt failed: %d, %v", n, err)
+	}
+	CompareSlices(t, buf, make([]byte, 16))
+	if err := f.Truncate(1<<20 + 1); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+
+	// The holes survive the state files and the journal
+	saved := &bytes.Buffer{}
+	if err := tc.bufferFs.SaveState(saved); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	loaded := NewBufferFS(pathfs.NewLoopbackFileSystem(tc.orig)).(*BufferFS)
+	if err := loaded.LoadState(saved); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	compareOverlays(t, tc.bufferFs, loaded)
+	want := fileSlices(overlayed(tc.bufferFs, "hello.txt").(*OverlayFile))
+	if got := fileSlices(overlayed(loaded, "hello.txt").(*OverlayFile)); got.Len() != want.Len() {
+		t.Errorf("Got slices %v, want %v", got.Slices(), want.Slices())
+	}
+
+	if code := tc.bufferFs.Commit(); code != fuse.OK {
+		t.Fatalf("Commit failed: %v", code)
+	}
+	content, err = ioutil.ReadFile(tc.origFile)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	CompareSlices(t, content, expected)
+}
+
+// Counts the opened and released files of the wrapped file system
+type countingFS struct {
+	pathfs.FileSystem
+	opened, released int
+}
+
+type countingFile struct {
+	nodefs.File
+	fs *countingFS
+}
+
+func (fs *countingFS) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	file, code := fs.FileSystem.Open(name, flags, context)
+	if code != fuse.OK {
+		return nil, code
+	}
+	fs.opened++
+	return &countingFile{File: file, fs: fs}, fuse.OK
+}
+
+func (f *countingFile) Release() {
+	f.fs.released++
+	f.File.Release()
+}
+
+func TestSourceHandle(t *testing.T) {
+	orig, err := ioutil.TempDir("", "ploufs-source")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(orig)
+	if err := ioutil.WriteFile(filepath.Join(orig, "file"), []byte("hello world"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	wrapped := &countingFS{FileSystem: pathfs.NewLoopbackFileSystem(orig)}
+	bufferFs := NewBufferFS(wrapped).(*BufferFS)
+	context := ownContext()
+
+	f, code := bufferFs.Open("file", syscall.O_RDWR, context)
+	if code != fuse.OK {
+		t.Fatalf("Open failed: %v", code)
+	}
+	if _, code := f.Write([]byte("HELLO"), 0); code != fuse.OK {
+		t.Fatalf("Write failed: %v", code)
+	}
+	buf := make([]byte, 4)
+	for off := int64(0); off < 11; off += int64(len(buf)) {
+		if _, code := f.Read(buf, off); code != fuse.OK {
+			t.Fatalf("Read failed: %v", code)
+		}
+	}
+	if wrapped.opened != 1 || wrapped.released != 0 {
+		t.Errorf("Source opened %v times, released %v times while in use", wrapped.opened, wrapped.released)
+	}
+
+	// The source stays open as long as one handle is
+	g, code := bufferFs.Open("file", syscall.O_RDONLY, context)
+	if code != fuse.OK {
+		t.Fatalf("Open failed: %v", code)
+	}
+	f.Release()
+	r, code := g.Read(make([]byte, 16), 0)
+	if code != fuse.OK {
+		t.Fatalf("Read failed: %v", code)
+	}
+	if got, _ := r.Bytes(nil); string(got) != "HELLO world" {
+		t.Errorf("Got %q, want %q", got, "HELLO world")
+	}
+	g.Release()
+	if wrapped.opened != 1 || wrapped.released != 1 {
+		t.Errorf("Source opened %v times, released %v times", wrapped.opened, wrapped.released)
+	}
+}
+
+// Fails the operations of the wrapped file system on the given paths
+type failingFS struct {
+	pathfs.FileSystem
+	open, read, openDir map[string]fuse.Status
+}
+
+type failingFile struct {
+	nodefs.File
+	read fuse.Status
+}
+
+func (fs *failingFS) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if code, ok := fs.open[name]; ok {
+		return nil, code
+	}
+	file, code := fs.FileSystem.Open(name, flags, context)
+	if code != fuse.OK {
+		return nil, code
+	}
+	if code, ok := fs.read[name]; ok {
+		return &failingFile{File: file, read: code}, fuse.OK
+	}
+	return file, fuse.OK
+}
+
+func (fs *failingFS) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	if code, ok := fs.openDir[name]; ok {
+		return nil, code
+	}
+	return fs.FileSystem.OpenDir(name, context)
+}
+
+func (f *failingFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	return nil, f.read
+}
+
+func TestWrappedFailures(t *testing.T) {
+	orig, err := ioutil.TempDir("", "ploufs-failures")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(orig)
+	for _, name := range []string{"denied", "broken", "vanished"} {
+		if err := ioutil.WriteFile(filepath.Join(orig, name), []byte("hello world"), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(orig, "dir"), 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	wrapped := &failingFS{
+		FileSystem: pathfs.NewLoopbackFileSystem(orig),
+		open:       map[string]fuse.Status{"denied": fuse.EACCES},
+		read:       map[string]fuse.Status{"broken": fuse.EIO},
+		openDir:    map[string]fuse.Status{"dir": fuse.EACCES},
+	}
+	bufferFs := NewBufferFS(wrapped).(*BufferFS)
+	context := ownContext()
+
+	read := func(name string) fuse.Status {
+		f, code := bufferFs.Open(name, syscall.O_RDONLY, context)
+		if code != fuse.OK {
+			t.Fatalf("Open(%q) failed: %v", name, code)
+		}
+		defer f.Release()
+		_, code = f.Read(make([]byte, 16), 0)
+		return code
+	}
+	if code := read("denied"); code != fuse.EACCES {
+		t.Errorf("Reading a file we cannot open: got %v, want %v", code, fuse.EACCES)
+	}
+	if code := read("broken"); code != fuse.EIO {
+		t.Errorf("Reading a file we cannot read: got %v, want %v", code, fuse.EIO)
+	}
+	// Overlayed, then removed from the wrapped file system
+	bufferFs.Chmod("vanished", 0600, context)
+	os.Remove(filepath.Join(orig, "vanished"))
+	if code := read("vanished"); code != fuse.EIO {
+		t.Errorf("Reading a vanished file: got %v, want %v", code, fuse.EIO)
+	}
+
+	// A directory we cannot list is neither shown nor overlayed
+	if code := bufferFs.Mkdir("dir/sub", 0755, context); code != fuse.EACCES {
+		t.Errorf("Mkdir in a directory we cannot list: got %v, want %v", code, fuse.EACCES)
+	}
+	if code := bufferFs.Chmod("dir", 0700, context); code != fuse.EACCES {
+		t.Errorf("Chmod of a directory we cannot list: got %v, want %v", code, fuse.EACCES)
+	}
+	if o := overlayed(bufferFs, "dir"); o != nil {
+		t.Errorf("Directory overlayed without its entries: %v", o)
+	}
+}
+
+func TestCommitFailure(t *testing.T) {
+	orig, err := ioutil.TempDir("", "ploufs-commit")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(orig)
+	for _, name := range []string{"broken", "source"} {
+		if err := ioutil.WriteFile(filepath.Join(orig, name), []byte("hello world"), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	wrapped := &failingFS{
+		FileSystem: pathfs.NewLoopbackFileSystem(orig),
+		open:       map[string]fuse.Status{"broken": fuse.EIO},
+	}
+	bufferFs := NewBufferFS(wrapped).(*BufferFS)
+	context := ownContext()
+
+	f, code := bufferFs.Open("broken", syscall.O_WRONLY, context)
+	if code != fuse.OK {
+		t.Fatalf("Open failed: %v", code)
+	}
+	f.Write([]byte("there"), 6)
+	f.Release()
+	if code := bufferFs.Rename("source", "target", context); code != fuse.OK {
+		t.Fatalf("Rename failed: %v", code)
+	}
+	if code := bufferFs.Commit(); code != fuse.EIO {
+		t.Fatalf("Commit: got %v, want %v", code, fuse.EIO)
+	}
+
+	if _, err := os.Lstat(filepath.Join(orig, "source")); err != nil {
+		t.Errorf("Staged source not moved back: %v", err)
+	}
+	if staged, _ := filepath.Glob(filepath.Join(orig, stagingPrefix+"*")); len(staged) != 0 {
+		t.Errorf("Staged sources left: %v", staged)
+	}
+	// The buffered changes still show
+	f, code = bufferFs.Open("target", syscall.O_RDONLY, context)
+	if code != fuse.OK {
+		t.Fatalf("Open failed: %v", code)
+	}
+	defer f.Release()
+	buf := make([]byte, 16)
+	res, code := f.Read(buf, 0)
+	if code != fuse.OK {
+		t.Fatalf("Read failed: %v", code)
+	}
+	data, _ := res.Bytes(buf)
+	CompareSlices(t, data, []byte("hello world"))
+}
+
+// Returns a BufferFS wrapping a directory of n files, overlayed or not
+func largeDirBufferFS(b *testing.B, n int, overlayed bool) (bufferFs *BufferFS, cleanup func()) {
+	orig, err := ioutil.TempDir("", "ploufs-largedir")
+	if err != nil {
+		b.Fatalf("TempDir failed: %v", err)
+	}
+	dir := filepath.Join(orig, "dir")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		b.Fatalf("Mkdir failed: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d", i)), nil, 0644); err != nil {
+			b.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	bufferFs = NewBufferFS(pathfs.NewLoopbackFileSystem(orig)).(*BufferFS)
+	if overlayed {
+		if code := bufferFs.Chmod("dir", 0700, ownContext()); code != fuse.OK {
+			b.Fatalf("Chmod failed: %v", code)
+		}
+	}
+	return bufferFs, func() { os.RemoveAll(orig) }
+}
+
+// Stats of the files of a large directory, like find does. Their cost
+// should not depend on the size of the directory.
+func BenchmarkLargeDirGetAttr(b *testing.B) {
+	for _, n := range []int{100, 10000} {
+		for _, overlayed := range []bool{false, true} {
+			b.Run(fmt.Sprintf("entries=%d/overlayed=%v", n, overlayed), func(b *testing.B) {
+				bufferFs, cleanup := largeDirBufferFS(b, n, overlayed)
+				defer cleanup()
+				context := ownContext()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					name := fmt.Sprintf("dir/file%d", rand.Intn(n))
+					if _, code := bufferFs.GetAttr(name, context); code != fuse.OK {
+						b.Fatalf("GetAttr failed: %v", code)
+					}
+				}
+			})
+		}
+	}
+}
+
+// Creations and removals of files in a large overlayed directory
+func BenchmarkLargeDirCreate(b *testing.B) {
+	for _, n := range []int{100, 10000} {
+		b.Run(fmt.Sprintf("entries=%d", n), func(b *testing.B) {
+			bufferFs, cleanup := largeDirBufferFS(b, n, true)
+			defer cleanup()
+			context := ownContext()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				name := fmt.Sprintf("dir/new%d", i)
+				f, code := bufferFs.Create(name, syscall.O_WRONLY, 0644, context)
+				if code != fuse.OK {
+					b.Fatalf("Create failed: %v", code)
+				}
+				f.Release()
+				if code := bufferFs.Unlink(name, context); code != fuse.OK {
+					b.Fatalf("Unlink failed: %v", code)
+				}
+			}
+		})
+	}
+}
+
+func TestOverlayDirEntries(t *testing.T) {
+	attr := NewOverlayAttrFromScratch(fuse.S_IFDIR|0755, 0, 0, time.Now())
+	d := NewOverlayDir(attr, NoSource, []fuse.DirEntry{
+		{Name: "a", Mode: fuse.S_IFREG},
+		{Name: "b", Mode: fuse.S_IFDIR},
+	})
+	seen, _ := d.Entries(nil)
+	before := append([]fuse.DirEntry(nil), seen...)
+
+	if code := d.AddEntry(fuse.S_IFLNK, "c", time.Now()); code != fuse.OK {
+		t.Fatalf("AddEntry failed: %v", code)
+	}
+	if code := d.AddEntry(fuse.S_IFREG, "b", time.Now()); code != fuse.Status(syscall.EEXIST) {
+		t.Errorf("Adding an existing entry: got %v, want EEXIST", code)
+	}
+	d.RemoveEntry("a", time.Now())
+	if mode, code := d.Lookup("c"); code != fuse.OK || mode != fuse.S_IFLNK {
+		t.Errorf("Lookup of c: got %o, %v", mode, code)
+	}
+	if _, code := d.Lookup("a"); code != fuse.ENOENT {
+		t.Errorf("Lookup of a removed entry: got %v, want ENOENT", code)
+	}
+	// What was listed before is left untouched
+	if !reflect.DeepEqual(seen, before) {
+		t.Errorf("Listed entries modified: %v, want %v", seen, before)
+	}
+	entries, _ := d.Entries(nil)
+	if len(entries) != 2 {
+		t.Errorf("Got entries %v, want b and c", entries)
+	}
+}
+
+func TestRenameOverlayedDirectory(t *testing.T) {
+	orig, err := ioutil.TempDir("", "ploufs-rename")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(orig)
+	if err := os.MkdirAll(filepath.Join(orig, "dir", "sub"), 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	for _, name := range []string{"dir/file", "dir/sub/file"} {
+		if err := ioutil.WriteFile(filepath.Join(orig, name), []byte(name), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	bufferFs := NewBufferFS(pathfs.NewLoopbackFileSystem(orig)).(*BufferFS)
+	context := ownContext()
+
+	if code := bufferFs.Chmod("dir/sub/file", 0600, context); code != fuse.OK {
+		t.Fatalf("Chmod failed: %v", code)
+	}
+	if code := bufferFs.Rename("dir", "moved", context); code != fuse.OK {
+		t.Fatalf("Rename failed: %v", code)
+	}
+	// Only the renamed directory, its parent and what was already
+	// overlayed are
+	if names := overlayedNames(bufferFs); !reflect.DeepEqual(names, []string{"", "moved", "moved/sub/file"}) {
+		t.Errorf("Overlayed paths after the rename: %v", names)
+	}
+	if _, code := bufferFs.GetAttr("dir/file", context); code != fuse.ENOENT {
+		t.Errorf("GetAttr of the old path: got %v, want ENOENT", code)
+	}
+	for _, name := range []string{"file", "sub/file"} {
+		a, code := bufferFs.GetAttr(path.Join("moved", name), context)
+		if code != fuse.OK {
+			t.Fatalf("GetAttr(%q) failed: %v", name, code)
+		}
+		if a.Size != uint64(len("dir/"+name)) {
+			t.Errorf("Size of %q: got %v", name, a.Size)
+		}
+	}
+	if a, _ := bufferFs.GetAttr("moved/sub/file", context); a.Mode&07777 != 0600 {
+		t.Errorf("Mode of the overlayed child: got %o, want 600", a.Mode&07777)
+	}
+
+	changes, code := bufferFs.Changes()
+	if code != fuse.OK {
+		t.Fatalf("Changes failed: %v", code)
+	}
+	expected := []Change{
+		{Kind: Renamed, Path: "moved", From: "dir"},
+		{Kind: AttrChanged, Path: "moved/sub/file"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Got changes %v, want %v", changes, expected)
+	}
+	// Listing the changes does not overlay anything
+	if names := overlayedNames(bufferFs); !reflect.DeepEqual(names, []string{"", "moved", "moved/sub/file"}) {
+		t.Errorf("Overlayed paths after Changes: %v", names)
+	}
+}
+
+func TestOverlayTree(t *testing.T) {
+	tree := NewOverlayTree()
+	attr := NewOverlayAttrFromScratch(fuse.S_IFDIR|0755, 0, 0, time.Now())
+	a := NewOverlayDir(attr, "a", nil)
+	file := NewOverlaySymlink(attr, "target")
+	tree.Set("a", a)
+	tree.Set("a/b/c", file)
+	if tree.Len() != 2 || tree.Get("a/b") != nil || tree.Get("a/b/c") != file {
+		t.Fatalf("Unexpected tree: %v", tree.Names())
+	}
+	if source := tree.Source("a/b/c"); source != "a/b/c" {
+		t.Errorf("Source of a/b/c: got %q", source)
+	}
+
+	tree.Move("a", "x/y")
+	if tree.Get("a") != nil || tree.Get("x/y") != a || tree.Get("x/y/b/c") != file {
+		t.Errorf("Unexpected tree after a move: %v", tree.Names())
+	}
+	if source := tree.Source("x/y/b/d"); source != "a/b/d" {
+		t.Errorf("Source below a moved directory: got %q, want %q", source, "a/b/d")
+	}
+	tree.Set("z", NewOverlayDir(attr, NoSource, nil))
+	if source := tree.Source("z/w"); source != NoSource {
+		t.Errorf("Source below a created directory: got %q", source)
+	}
+
+	// Moving over a path replaces what is below it
+	tree.Move("x/y/b/c", "z")
+	if tree.Len() != 2 || tree.Get("z") != file {
+		t.Errorf("Unexpected tree after a replacement: %v", tree.Names())
+	}
+	tree.Delete("x")
+	if names := tree.Names(); !reflect.DeepEqual(names, []string{"z"}) {
+		t.Errorf("Unexpected tree after a deletion: %v", names)
+	}
+}
+
+// Meant to be run with -race: the default go-fuse server calls us from
+// several goroutines
+func TestConcurrentOperations(t *testing.T) {
+	orig, err := ioutil.TempDir("", "ploufs-concurrent")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(orig)
+	bufferFs := NewBufferFS(pathfs.NewLoopbackFileSystem(orig)).(*BufferFS)
+
+	const workers = 8
+	const files = 50
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		context := ownContext()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			bufferFs.OpenDir("", context)
+			bufferFs.GetAttr("w0/f0", context)
+		}
+	}()
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			bufferFs.Checkpoint("cp")
+			bufferFs.Changes()
+		}
+	}()
+
+	var writers sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		writers.Add(1)
+		go func(i int) {
+			defer writers.Done()
+			context := ownContext()
+			dir := fmt.Sprintf("w%d", i)
+			if code := bufferFs.Mkdir(dir, 0755, context); code != fuse.OK {
+				t.Errorf("Mkdir(%q) failed: %v", dir, code)
+				return
+			}
+			for j := 0; j < files; j++ {
+				tmp := fmt.Sprintf("tmp-%d-%d", i, j)
+				f, code := bufferFs.Create(tmp, syscall.O_WRONLY, 0644, context)
+				if code != fuse.OK {
+					t.Errorf("Create(%q) failed: %v", tmp, code)
+					return
+				}
+				f.Write([]byte(tmp), 0)
+				f.Release()
+				name := path.Join(dir, fmt.Sprintf("f%d", j))
+				if code := bufferFs.Rename(tmp, name, context); code != fuse.OK {
+					t.Errorf("Rename(%q, %q) failed: %v", tmp, name, code)
+					return
+				}
+			}
+		}(i)
+	}
+	writers.Wait()
+	close(done)
+	readers.Wait()
+
+	context := ownContext()
+	for i := 0; i < workers; i++ {
+		dir := fmt.Sprintf("w%d", i)
+		entries, code := bufferFs.OpenDir(dir, context)
+		if code != fuse.OK || len(entries) != files {
+			t.Fatalf("OpenDir(%q): got %d entries, %v", dir, len(entries), code)
+		}
+		for j := 0; j < files; j++ {
+			name := path.Join(dir, fmt.Sprintf("f%d", j))
+			a, code := bufferFs.GetAttr(name, context)
+			if code != fuse.OK || a.Size != uint64(len(fmt.Sprintf("tmp-%d-%d", i, j))) {
+				t.Errorf("GetAttr(%q): got %v, %v", name, a, code)
+			}
+		}
+	}
+	if entries, _ := bufferFs.OpenDir("", context); len(entries) != workers {
+		t.Errorf("The root has %d entries, want %d", len(entries), workers)
+	}
+}
+
+func TestHardLinks(t *testing.T) {
+	orig, err := ioutil.TempDir("", "ploufs-links")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(orig)
+	if err := ioutil.WriteFile(filepath.Join(orig, "a"), []byte("old"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := os.Link(filepath.Join(orig, "a"), filepath.Join(orig, "b")); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+	bufferFs := NewBufferFS(pathfs.NewLoopbackFileSystem(orig)).(*BufferFS)
+	context := ownContext()
+
+	// What we write through a name shows through the other
+	f, code := bufferFs.Open("a", syscall.O_WRONLY, context)
+	if code != fuse.OK {
+		t.Fatalf("Open failed: %v", code)
+	}
+	f.Write([]byte("new!"), 0)
+	f.Release()
+	f, code = bufferFs.Open("b", syscall.O_RDONLY, context)
+	if code != fuse.OK {
+		t.Fatalf("Open failed: %v", code)
+	}
+	buf := make([]byte, 16)
+	r, code := f.Read(buf, 0)
+	f.Release()
+	if code != fuse.OK {
+		t.Fatalf("Read failed: %v", code)
+	}
+	if b, _ := r.Bytes(buf); string(b) != "new!" {
+		t.Errorf("Read through the other name: got %q", b)
+	}
+
+	nlink := func(name string) uint32 {
+		a, code := bufferFs.GetAttr(name, context)
+		if code != fuse.OK {
+			t.Fatalf("GetAttr(%q) failed: %v", name, code)
+		}
+		return a.Nlink
+	}
+	if code := bufferFs.Link("a", "c", context); code != fuse.OK {
+		t.Fatalf("Link failed: %v", code)
+	}
+	if code := bufferFs.Link("a", "b", context); code != fuse.ToStatus(syscall.EEXIST) {
+		t.Errorf("Link over an existing path: got %v, want EEXIST", code)
+	}
+	if n := nlink("c"); n != 3 {
+		t.Errorf("Links after Link: got %d, want 3", n)
+	}
+	if code := bufferFs.Unlink("b", context); code != fuse.OK {
+		t.Fatalf("Unlink failed: %v", code)
+	}
+	if n := nlink("a"); n != 2 {
+		t.Errorf("Links after Unlink: got %d, want 2", n)
+	}
+
+	changes, code := bufferFs.Changes()
+	if code != fuse.OK {
+		t.Fatalf("Changes failed: %v", code)
+	}
+	expected := []Change{
+		{Kind: Modified, Path: "a"},
+		{Kind: Deleted, Path: "b"},
+		{Kind: Created, Path: "c"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Got changes %v, want %v", changes, expected)
+	}
+
+	state := &bytes.Buffer{}
+	if err := bufferFs.SaveState(state); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	loaded := NewBufferFS(pathfs.NewLoopbackFileSystem(orig)).(*BufferFS)
+	if err := loaded.LoadState(state); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	if overlayed(loaded, "a") != overlayed(loaded, "c") {
+		t.Errorf("The names of the file do not share it after LoadState")
+	}
+
+	if code := bufferFs.Commit(); code != fuse.OK {
+		t.Fatalf("Commit failed: %v", code)
+	}
+	var a, c syscall.Stat_t
+	if err := syscall.Lstat(filepath.Join(orig, "a"), &a); err != nil {
+		t.Fatalf("Lstat failed: %v", err)
+	}
+	if err := syscall.Lstat(filepath.Join(orig, "c"), &c); err != nil {
+		t.Fatalf("Lstat failed: %v", err)
+	}
+	if a.Ino != c.Ino || a.Nlink != 2 {
+		t.Errorf("Committed links: inodes %d and %d, %d links", a.Ino, c.Ino, a.Nlink)
+	}
+	if _, err := os.Lstat(filepath.Join(orig, "b")); !os.IsNotExist(err) {
+		t.Errorf("The unlinked name is still there: %v", err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(orig, "c"))
+	if err != nil || string(content) != "new!" {
+		t.Errorf("Committed content: got %q, %v", content, err)
+	}
+}
+
+// Discarding some names of a file leaves it to the others
+func TestDiscardLinks(t *testing.T) {
+	orig, err := ioutil.TempDir("", "ploufs-links")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(orig)
+	if err := os.Mkdir(filepath.Join(orig, "dir"), 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(orig, "a"), []byte("old"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := os.Link(filepath.Join(orig, "a"), filepath.Join(orig, "dir", "b")); err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+	bufferFs := NewBufferFS(pathfs.NewLoopbackFileSystem(orig)).(*BufferFS)
+	context := ownContext()
+
+	f, code := bufferFs.Open("a", syscall.O_WRONLY, context)
+	if code != fuse.OK {
+		t.Fatalf("Open failed: %v", code)
+	}
+	f.Write([]byte("new!"), 0)
+	f.Release()
+	nlink := func(name string) uint32 {
+		a, code := bufferFs.GetAttr(name, context)
+		if code != fuse.OK {
+			t.Fatalf("GetAttr(%q) failed: %v", name, code)
+		}
+		return a.Nlink
+	}
+	read := func(name string) string {
+		f, code := bufferFs.Open(name, syscall.O_RDONLY, context)
+		if code != fuse.OK {
+			t.Fatalf("Open(%q) failed: %v", name, code)
+		}
+		defer f.Release()
+		buf := make([]byte, 16)
+		r, code := f.Read(buf, 0)
+		if code != fuse.OK {
+			t.Fatalf("Read failed: %v", code)
+		}
+		b, _ := r.Bytes(buf)
+		return string(b)
+	}
+
+	// A name created by Link goes away
+	if code := bufferFs.Link("a", "c", context); code != fuse.OK {
+		t.Fatalf("Link failed: %v", code)
+	}
+	if code := bufferFs.DiscardPath("c"); code != fuse.OK {
+		t.Fatalf("DiscardPath failed: %v", code)
+	}
+	if n := nlink("a"); n != 2 {
+		t.Errorf("Links after discarding a new name: got %d, want 2", n)
+	}
+	// A name of the wrapped file system comes back, and shows the overlay
+	if code := bufferFs.Unlink("dir/b", context); code != fuse.OK {
+		t.Fatalf("Unlink failed: %v", code)
+	}
+	if n := nlink("a"); n != 1 {
+		t.Errorf("Links after Unlink: got %d, want 1", n)
+	}
+	if code := bufferFs.DiscardPath("dir"); code != fuse.OK {
+		t.Fatalf("DiscardPath failed: %v", code)
+	}
+	if n := nlink("a"); n != 2 {
+		t.Errorf("Links after discarding the unlink: got %d, want 2", n)
+	}
+	if got := read("dir/b"); got != "new!" {
+		t.Errorf("Read through the restored name: got %q", got)
+	}
+	// Discarding all the overlayed names discards the file
+	for _, name := range []string{"dir", "a"} {
+		if code := bufferFs.DiscardPath(name); code != fuse.OK {
+			t.Fatalf("DiscardPath(%q) failed: %v", name, code)
+		}
+	}
+	if got := read("dir/b"); got != "old" {
+		t.Errorf("Read after discarding the file: got %q", got)
+	}
+}
+
+func TestXAttrs(t *testing.T) {
+	orig, err := ioutil.TempDir("", "ploufs-xattrs")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(orig)
+	file := filepath.Join(orig, "f")
+	if err := ioutil.WriteFile(file, []byte("content"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := syscall.Setxattr(file, "user.a", []byte("1"), 0); err != nil {
+		t.Skipf("No extended attributes in %s: %v", orig, err)
+	}
+	bufferFs := NewBufferFS(pathfs.NewLoopbackFileSystem(orig)).(*BufferFS)
+	context := ownContext()
+
+	if data, code := bufferFs.GetXAttr("f", "user.a", context); code != fuse.OK || string(data) != "1" {
+		t.Errorf("GetXAttr of the wrapped file: got %q, %v", data, code)
+	}
+	if code := bufferFs.SetXAttr("f", "user.b", []byte("2"), 0, context); code != fuse.OK {
+		t.Fatalf("SetXAttr failed: %v", code)
+	}
+	if code := bufferFs.SetXAttr("f", "user.b", []byte("3"), xattrCreate, context); code != fuse.ToStatus(syscall.EEXIST) {
+		t.Errorf("SetXAttr of an existing attribute with XATTR_CREATE: got %v", code)
+	}
+	if code := bufferFs.RemoveXAttr("f", "user.a", context); code != fuse.OK {
+		t.Fatalf("RemoveXAttr failed: %v", code)
+	}
+	if _, err := syscall.Getxattr(file, "user.b", make([]byte, 16)); err != syscall.ENODATA {
+		t.Errorf("The wrapped file was modified: %v", err)
+	}
+
+	// They follow the file
+	if code := bufferFs.Rename("f", "g", context); code != fuse.OK {
+		t.Fatalf("Rename failed: %v", code)
+	}
+	names, code := bufferFs.ListXAttr("g", context)
+	if code != fuse.OK || !reflect.DeepEqual(names, []string{"user.b"}) {
+		t.Errorf("ListXAttr after the rename: got %v, %v", names, code)
+	}
+
+	if code := bufferFs.Commit(); code != fuse.OK {
+		t.Fatalf("Commit failed: %v", code)
+	}
+	buf := make([]byte, 16)
+	n, err := syscall.Getxattr(filepath.Join(orig, "g"), "user.b", buf)
+	if err != nil {
+		t.Fatalf("Getxattr of the committed attribute failed: %v", err)
+	}
+	if string(buf[:n]) != "2" {
+		t.Errorf("Committed attribute: got %q", buf[:n])
+	}
+	if _, err := syscall.Getxattr(filepath.Join(orig, "g"), "user.a", buf); err != syscall.ENODATA {
+		t.Errorf("The removed attribute was committed: %v", err)
+	}
+}
+
+func TestSpecialFiles(t *testing.T) {
+	orig, err := ioutil.TempDir("", "ploufs-special")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(orig)
+	if err := syscall.Mkfifo(filepath.Join(orig, "old"), 0644); err != nil {
+		t.Skipf("Cannot create a FIFO in %s: %v", orig, err)
+	}
+	bufferFs := NewBufferFS(pathfs.NewLoopbackFileSystem(orig)).(*BufferFS)
+	context := ownContext()
+
+	if code := bufferFs.Mknod("fifo", syscall.S_IFIFO|0640, 0, context); code != fuse.OK {
+		t.Fatalf("Mknod failed: %v", code)
+	}
+	attr, code := bufferFs.GetAttr("fifo", context)
+	if code != fuse.OK || attr.Mode != syscall.S_IFIFO|0640 {
+		t.Fatalf("GetAttr of the FIFO: got %v, %v", attr, code)
+	}
+	if code := bufferFs.Mknod("dir", syscall.S_IFDIR|0755, 0, context); code != fuse.EINVAL {
+		t.Errorf("Mknod of a directory: got %v", code)
+	}
+	if _, err := os.Lstat(filepath.Join(orig, "fifo")); !os.IsNotExist(err) {
+		t.Errorf("The FIFO was created in the wrapped file system: %v", err)
+	}
+
+	// The wrapped ones can be renamed and chmoded
+	if code := bufferFs.Rename("old", "new", context); code != fuse.OK {
+		t.Fatalf("Rename failed: %v", code)
+	}
+	if code := bufferFs.Chmod("new", 0600, context); code != fuse.OK {
+		t.Fatalf("Chmod failed: %v", code)
+	}
+
+	if code := bufferFs.Commit(); code != fuse.OK {
+		t.Fatalf("Commit failed: %v", code)
+	}
+	for name, mode := range map[string]os.FileMode{"fifo": 0640, "new": 0600} {
+		fi, err := os.Lstat(filepath.Join(orig, name))
+		if err != nil {
+			t.Errorf("Lstat of the committed %s failed: %v", name, err)
+			continue
+		}
+		if fi.Mode() != os.ModeNamedPipe|mode {
+			t.Errorf("Committed %s: got mode %v", name, fi.Mode())
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(orig, "old")); !os.IsNotExist(err) {
+		t.Errorf("The renamed FIFO is still there: %v", err)
+	}
+}
+
+func TestCollapseWrappedContent(t *testing.T) {
+	orig, err := ioutil.TempDir("", "ploufs-collapse")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(orig)
+	data := make([]byte, 3*fallocBlockSize)
+	for i := range data {
+		data[i] = byte(1 + i/fallocBlockSize)
+	}
+	if err := ioutil.WriteFile(filepath.Join(orig, "f"), data, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	bufferFs := NewBufferFS(pathfs.NewLoopbackFileSystem(orig)).(*BufferFS)
+	context := ownContext()
+
+	// The content of the wrapped file moves along with the buffered one
+	f, code := bufferFs.Open("f", syscall.O_RDWR, context)
+	if code != fuse.OK {
+		t.Fatalf("Open failed: %v", code)
+	}
+	defer f.Release()
+	f.Write([]byte("new"), 2*fallocBlockSize)
+	if code := f.Allocate(0, fallocBlockSize, fallocCollapseRange); code != fuse.OK {
+		t.Fatalf("Allocate failed: %v", code)
+	}
+	expected := append([]byte{}, data[fallocBlockSize:]...)
+	copy(expected[fallocBlockSize:], "new")
+
+	buf := make([]byte, len(data))
+	r, code := f.Read(buf, 0)
+	if code != fuse.OK {
+		t.Fatalf("Read failed: %v", code)
+	}
+	content, _ := r.Bytes(buf)
+	if !bytes.Equal(content, expected) {
+		t.Errorf("Content after the collapse differs from the expected one")
+	}
+}
+
+func TestOpenFlags(t *testing.T) {
+	orig, err := ioutil.TempDir("", "ploufs-flags")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(orig)
+	if err := ioutil.WriteFile(filepath.Join(orig, "f"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	bufferFs := NewBufferFS(pathfs.NewLoopbackFileSystem(orig)).(*BufferFS)
+	context := ownContext()
+
+	if _, code := bufferFs.Create("f", syscall.O_WRONLY|syscall.O_EXCL, 0644, context); code != fuse.ToStatus(syscall.EEXIST) {
+		t.Errorf("Create of an existing file with O_EXCL: got %v", code)
+	}
+
+	f, code := bufferFs.Open("f", syscall.O_RDONLY, context)
+	if code != fuse.OK {
+		t.Fatalf("Open failed: %v", code)
+	}
+	if _, code := f.Write([]byte("x"), 0); code != fuse.Status(syscall.EBADF) {
+		t.Errorf("Write on a read-only handle: got %v", code)
+	}
+	f.Release()
+
+	// The offset of appending writes does not matter
+	f, code = bufferFs.Open("f", syscall.O_WRONLY|syscall.O_APPEND, context)
+	if code != fuse.OK {
+		t.Fatalf("Open failed: %v", code)
+	}
+	f.Write([]byte(" world"), 0)
+	f.Release()
+	f, code = bufferFs.Open("f", syscall.O_RDONLY, context)
+	if code != fuse.OK {
+		t.Fatalf("Open failed: %v", code)
+	}
+	buf := make([]byte, 16)
+	r, code := f.Read(buf, 0)
+	f.Release()
+	if code != fuse.OK {
+		t.Fatalf("Read failed: %v", code)
+	}
+	if content, _ := r.Bytes(buf); string(content) != "hello world" {
+		t.Errorf("Content after the appending write: got %q", content)
+	}
+
+	f, code = bufferFs.Open("f", syscall.O_WRONLY|syscall.O_TRUNC, context)
+	if code != fuse.OK {
+		t.Fatalf("Open failed: %v", code)
+	}
+	f.Release()
+	if attr, _ := bufferFs.GetAttr("f", context); attr.Size != 0 {
+		t.Errorf("Size after O_TRUNC: got %v", attr.Size)
+	}
+
+	// Without O_EXCL, creating opens the existing file
+	f, code = bufferFs.Create("f", syscall.O_WRONLY, 0600, context)
+	if code != fuse.OK {
+		t.Fatalf("Create of an existing file failed: %v", code)
+	}
+	f.Release()
+}
+
+func TestPermissions(t *testing.T) {
+	user := &caller{uid: 1000, gid: 1000, groups: []uint32{1000, 27}, loaded: true}
+	root := &caller{uid: 0, gid: 0, loaded: true}
+	tests := []struct {
+		c       *caller
+		mode    uint32
+		uid     uint32
+		gid     uint32
+		request uint32
+		want    bool
+	}{
+		{user, 0640, 1000, 1000, accessRead | accessWrite, true},
+		// All the requested bits are needed
+		{user, 0440, 1000, 1000, accessRead | accessWrite, false},
+		// The owner bits count for the owner, even if the group ones
+		// would give more
+		{user, 0070, 1000, 1000, accessRead, false},
+		// Supplementary groups
+		{user, 0040, 0, 27, accessRead, true},
+		{user, 0004, 0, 27, accessRead, false},
+		{user, 0004, 0, 0, accessRead, true},
+		// Root reads and writes anything, but only executes what
+		// somebody may execute
+		{root, 0000, 1000, 1000, accessRead | accessWrite, true},
+		{root, 0644, 1000, 1000, accessExecute, false},
+		{root, 0610, 1000, 1000, accessExecute, true},
+	}
+	for _, tt := range tests {
+		attr := &fuse.Attr{Mode: fuse.S_IFREG | tt.mode}
+		attr.Owner.Uid, attr.Owner.Gid = tt.uid, tt.gid
+		if got := tt.c.permitted(attr, tt.request); got != tt.want {
+			t.Errorf("%+v asking %o on %o %v:%v: got %v, want %v",
+				*tt.c, tt.request, tt.mode, tt.uid, tt.gid, got, tt.want)
+		}
+	}
+
+	// Root may search any directory
+	attr := &fuse.Attr{Mode: fuse.S_IFDIR}
+	if !root.permitted(attr, accessExecute) {
+		t.Errorf("Root may not search a directory without permissions")
+	}
+
+	groups, err := os.Getgroups()
+	if err != nil {
+		t.Fatalf("Getgroups failed: %v", err)
+	}
+	got := supplementaryGroups(uint32(os.Getpid()))
+	if len(got) != len(groups) {
+		t.Errorf("Supplementary groups: got %v, want %v", got, groups)
+	}
+}
+
+func TestOwnership(t *testing.T) {
+	orig, err := ioutil.TempDir("", "ploufs-ownership")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(orig)
+	// Everybody may create files at the root
+	if err := os.Chmod(orig, 0777); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	bufferFs := NewBufferFS(pathfs.NewLoopbackFileSystem(orig)).(*BufferFS)
+	root := &fuse.Context{}
+	alice := &fuse.Context{Owner: fuse.Owner{Uid: 1000, Gid: 1000}}
+	bob := &fuse.Context{Owner: fuse.Owner{Uid: 1001, Gid: 1001}}
+	mode := func(name string) uint32 {
+		attr, code := bufferFs.GetAttr(name, root)
+		if code != fuse.OK {
+			t.Fatalf("GetAttr(%s) failed: %v", name, code)
+		}
+		return attr.Mode
+	}
+
+	f, code := bufferFs.Create("prog", syscall.O_WRONLY, 0755, alice)
+	if code != fuse.OK {
+		t.Fatalf("Create failed: %v", code)
+	}
+	f.Release()
+	if code := bufferFs.Chmod("prog", 04755, bob); code != fuse.EPERM {
+		t.Errorf("Chmod by somebody else than the owner: got %v", code)
+	}
+	if code := bufferFs.Chown("prog", 1001, keepOwner, alice); code != fuse.EPERM {
+		t.Errorf("Chown to another user: got %v", code)
+	}
+	if code := bufferFs.Chown("prog", 1000, keepOwner, bob); code != fuse.EPERM {
+		t.Errorf("Chown to the current owner by somebody else: got %v", code)
+	}
+	if code := bufferFs.Chown("prog", keepOwner, 1000, bob); code != fuse.EPERM {
+		t.Errorf("Chown to the current group by somebody else: got %v", code)
+	}
+	if code := bufferFs.Chown("prog", 1000, 1000, alice); code != fuse.OK {
+		t.Errorf("Chown to the current owner and group by the owner: got %v", code)
+	}
+	if code := bufferFs.Chmod("prog", 04755, alice); code != fuse.OK {
+		t.Fatalf("Chmod failed: %v", code)
+	}
+	if code := bufferFs.Chmod("prog", 0755, alice); code != fuse.OK || mode("prog")&07777 != 0755 {
+		t.Errorf("Chmod could not drop the setuid bit: %v, %o", code, mode("prog"))
+	}
+
+	// A write by somebody else drops the setuid bit
+	bufferFs.Chmod("prog", 04777, alice)
+	f, code = bufferFs.Open("prog", syscall.O_WRONLY, bob)
+	if code != fuse.OK {
+		t.Fatalf("Open failed: %v", code)
+	}
+	f.Write([]byte("#!/bin/sh"), 0)
+	f.Release()
+	if mode("prog")&syscall.S_ISUID != 0 {
+		t.Errorf("The setuid bit survived a write by somebody else")
+	}
+	// So do a truncate and an open(O_TRUNC)
+	for _, truncate := range []func() fuse.Status{
+		func() fuse.Status {
+			return bufferFs.Truncate("prog", 0, bob)
+		},
+		func() fuse.Status {
+			f, code := bufferFs.Open("prog", syscall.O_WRONLY|syscall.O_TRUNC, bob)
+			if code == fuse.OK {
+				f.Release()
+			}
+			return code
+		},
+	} {
+		bufferFs.Chmod("prog", 06777, alice)
+		if code := truncate(); code != fuse.OK {
+			t.Fatalf("Truncate failed: %v", code)
+		}
+		if m := mode("prog"); m&(syscall.S_ISUID|syscall.S_ISGID) != 0 {
+			t.Errorf("The setuid and setgid bits survived a truncate by somebody else: %o", m)
+		}
+	}
+
+	// In a sticky directory, only the owners remove
+	if code := bufferFs.Mkdir("tmp", 01777, root); code != fuse.OK {
+		t.Fatalf("Mkdir failed: %v", code)
+	}
+	f, code = bufferFs.Create("tmp/alice", syscall.O_WRONLY, 0644, alice)
+	if code != fuse.OK {
+		t.Fatalf("Create failed: %v", code)
+	}
+	f.Release()
+	if code := bufferFs.Unlink("tmp/alice", bob); code != fuse.EPERM {
+		t.Errorf("Unlink in a sticky directory by somebody else: got %v", code)
+	}
+	if code := bufferFs.Rename("prog", "tmp/alice", bob); code != fuse.EPERM {
+		t.Errorf("Rename over a file of somebody else in a sticky directory: got %v", code)
+	}
+	if code := bufferFs.Unlink("tmp/alice", alice); code != fuse.OK {
+		t.Errorf("Unlink in a sticky directory by the owner: got %v", code)
+	}
+
+	// New paths of a setgid directory get its group
+	if code := bufferFs.Mkdir("shared", 02777, root); code != fuse.OK {
+		t.Fatalf("Mkdir failed: %v", code)
+	}
+	if code := bufferFs.Chown("shared", keepOwner, 50, root); code != fuse.OK {
+		t.Fatalf("Chown failed: %v", code)
+	}
+	if code := bufferFs.Mkdir("shared/sub", 0755, alice); code != fuse.OK {
+		t.Fatalf("Mkdir failed: %v", code)
+	}
+	attr, _ := bufferFs.GetAttr("shared/sub", root)
+	if attr.Owner.Gid != 50 || attr.Mode&syscall.S_ISGID == 0 {
+		t.Errorf("Directory created in a setgid directory: gid %v, mode %o", attr.Owner.Gid, attr.Mode)
+	}
+}
+
+func TestPermissionChecks(t *testing.T) {
+	orig, err := ioutil.TempDir("", "ploufs-permissions")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(orig)
+	if err := os.Chmod(orig, 0755); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	for _, d := range []struct {
+		name string
+		mode os.FileMode
+	}{{"locked", 0755}, {"closed", 0700}} {
+		if err := os.Mkdir(filepath.Join(orig, d.name), d.mode); err != nil {
+			t.Fatalf("Mkdir failed: %v", err)
+		}
+	}
+	for _, f := range []struct {
+		name string
+		mode os.FileMode
+	}{{"private", 0600}, {"readonly", 0644}, {"locked/file", 0666}, {"closed/file", 0666}} {
+		if err := ioutil.WriteFile(filepath.Join(orig, f.name), []byte("data"), f.mode); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		if err := os.Chmod(filepath.Join(orig, f.name), f.mode); err != nil {
+			t.Fatalf("Chmod failed: %v", err)
+		}
+	}
+	if err := os.Symlink("file", filepath.Join(orig, "closed/link")); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	bufferFs := NewBufferFS(pathfs.NewLoopbackFileSystem(orig)).(*BufferFS)
+	// Somebody who owns nothing, and is in none of the groups
+	foreign := &fuse.Context{Owner: fuse.Owner{Uid: 54321, Gid: 54321}}
+	now := time.Now()
+	past := now.Add(-time.Hour)
+
+	open := func(name string, flags uint32) fuse.Status {
+		f, code := bufferFs.Open(name, flags, foreign)
+		if code == fuse.OK {
+			f.Release()
+		}
+		return code
+	}
+	create := func(name string, flags uint32) fuse.Status {
+		f, code := bufferFs.Create(name, flags, 0644, foreign)
+		if code == fuse.OK {
+			f.Release()
+		}
+		return code
+	}
+	getAttr := func(name string) fuse.Status {
+		_, code := bufferFs.GetAttr(name, foreign)
+		return code
+	}
+	openDir := func(name string) fuse.Status {
+		_, code := bufferFs.OpenDir(name, foreign)
+		return code
+	}
+	readlink := func(name string) fuse.Status {
+		_, code := bufferFs.Readlink(name, foreign)
+		return code
+	}
+	getXAttr := func(name string, attr string) fuse.Status {
+		_, code := bufferFs.GetXAttr(name, attr, foreign)
+		return code
+	}
+	tests := []struct {
+		op   string
+		code fuse.Status
+		want fuse.Status
+	}{
+		{"read a private file", open("private", syscall.O_RDONLY), fuse.EACCES},
+		{"write a read only file", open("readonly", syscall.O_WRONLY), fuse.EACCES},
+		{"read and write a read only file", open("readonly", syscall.O_RDWR), fuse.EACCES},
+		{"truncate on open", open("readonly", syscall.O_RDONLY|syscall.O_TRUNC), fuse.EACCES},
+		{"read below an unsearchable directory", open("closed/file", syscall.O_RDONLY), fuse.EACCES},
+		{"create over a read only file", create("readonly", syscall.O_WRONLY), fuse.EACCES},
+		{"create in a read only directory", create("new", syscall.O_WRONLY), fuse.EACCES},
+		{"truncate", bufferFs.Truncate("readonly", 0, foreign), fuse.EACCES},
+		{"mkdir", bufferFs.Mkdir("dir", 0755, foreign), fuse.EACCES},
+		{"mknod", bufferFs.Mknod("fifo", syscall.S_IFIFO|0644, 0, foreign), fuse.EACCES},
+		{"symlink", bufferFs.Symlink("readonly", "link", foreign), fuse.EACCES},
+		{"link", bufferFs.Link("readonly", "hard", foreign), fuse.EACCES},
+		{"unlink", bufferFs.Unlink("locked/file", foreign), fuse.EACCES},
+		{"rmdir", bufferFs.Rmdir("locked", foreign), fuse.EACCES},
+		{"rename in a read only directory", bufferFs.Rename("locked/file", "locked/moved", foreign), fuse.EACCES},
+		{"rename below an unsearchable directory", bufferFs.Rename("closed/file", "moved", foreign), fuse.EACCES},
+		{"access a private file", bufferFs.Access("private", accessRead, foreign), fuse.EACCES},
+		{"lookup below an unsearchable directory", getAttr("closed/file"), fuse.EACCES},
+		{"list an unreadable directory", openDir("closed"), fuse.EACCES},
+		{"readlink below an unsearchable directory", readlink("closed/link"), fuse.EACCES},
+		{"chmod below an unsearchable directory", bufferFs.Chmod("closed/file", 0777, foreign), fuse.EACCES},
+		{"touch a read only file", bufferFs.Utimens("readonly", &now, &now, foreign), fuse.EACCES},
+		{"set the times of the file of somebody else", bufferFs.Utimens("locked/file", &past, &past, foreign), fuse.EPERM},
+		{"set a user attribute of a read only file", bufferFs.SetXAttr("readonly", "user.x", []byte("x"), 0, foreign), fuse.EACCES},
+		{"remove a user attribute of a read only file", bufferFs.RemoveXAttr("readonly", "user.x", foreign), fuse.EACCES},
+		{"set a trusted attribute", bufferFs.SetXAttr("locked/file", "trusted.x", []byte("x"), 0, foreign), fuse.EPERM},
+		{"read a trusted attribute", getXAttr("readonly", "trusted.x"), fuse.ENODATA},
+		{"read a user attribute of a private file", getXAttr("private", "user.x"), fuse.EACCES},
+	}
+	for _, tt := range tests {
+		if tt.code != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.op, tt.code, tt.want)
+		}
+	}
+	// The refused operations change nothing
+	if n := len(overlayedNames(bufferFs)); n != 0 {
+		t.Errorf("Overlayed %v paths after refused operations: %v", n, overlayedNames(bufferFs))
+	}
+
+	// Others may read what they are allowed to, the owner may change
+	if code := open("readonly", syscall.O_RDONLY); code != fuse.OK {
+		t.Errorf("Reading the file of somebody else failed: %v", code)
+	}
+	owner := ownContext()
+	if code := bufferFs.Mkdir("locked/dir", 0755, owner); code != fuse.OK {
+		t.Errorf("Mkdir by the owner failed: %v", code)
+	}
+	if code := bufferFs.Rename("locked/file", "locked/moved", owner); code != fuse.OK {
+		t.Errorf("Rename by the owner failed: %v", code)
+	}
+	// The ones who may write a file may set its times to now
+	if code := bufferFs.Utimens("locked/moved", &now, &now, foreign); code != fuse.OK {
+		t.Errorf("Touching a writable file failed: %v", code)
+	}
+}
+
+// The journal replays the operations with the groups of their caller
+func TestJournalGroups(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Setting the groups needs root")
+	}
+	orig, err := ioutil.TempDir("", "ploufs-groups")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(orig)
+	dir := filepath.Join(orig, "journal")
+	shared := filepath.Join(orig, "shared")
+	if err := os.Mkdir(shared, 0770); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	if err := os.Chown(shared, 0, 4242); err != nil {
+		t.Fatalf("Chown failed: %v", err)
+	}
+	for name, mode := range map[string]os.FileMode{orig: 0755, shared: 0770} {
+		if err := os.Chmod(name, mode); err != nil {
+			t.Fatalf("Chmod failed: %v", err)
+		}
+	}
+
+	// Only a supplementary group of the caller may write the directory
+	groups, err := syscall.Getgroups()
+	if err != nil {
+		t.Fatalf("Getgroups failed: %v", err)
+	}
+	if err := syscall.Setgroups([]int{4242}); err != nil {
+		t.Skipf("Setgroups failed: %v", err)
+	}
+	journalFs, err := NewJournalFS(NewBufferFS(pathfs.NewLoopbackFileSystem(orig)).(*BufferFS), dir)
+	if err != nil {
+		syscall.Setgroups(groups)
+		t.Fatalf("NewJournalFS failed: %v", err)
+	}
+	member := &fuse.Context{Owner: fuse.Owner{Uid: 54321, Gid: 54321}, Pid: uint32(os.Getpid())}
+	code := journalFs.Mkdir("shared/dir", 0755, member)
+	syscall.Setgroups(groups)
+	journalFs.Close()
+	if code != fuse.OK {
+		t.Fatalf("Mkdir by a member of the group failed: %v", code)
+	}
+
+	replayed := NewBufferFS(pathfs.NewLoopbackFileSystem(orig)).(*BufferFS)
+	journalFs, err = NewJournalFS(replayed, dir)
+	if err != nil {
+		t.Fatalf("NewJournalFS failed: %v", err)
+	}
+	journalFs.Close()
+	if _, code := replayed.GetAttr("shared/dir", ownContext()); code != fuse.OK {
+		t.Errorf("Directory not restored by the replay: %v", code)
+	}
+}
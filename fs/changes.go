@@ -0,0 +1,236 @@
+// copyright 2016 Christophe-Marie Duquesne
+
+package fs
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+type ChangeKind int
+
+const (
+	// The path does not exist in the wrapped file system
+	Created ChangeKind = iota
+	// The content of the file changed
+	Modified
+	// The path was removed
+	Deleted
+	// The file comes from another path of the wrapped file system
+	Renamed
+	// The target of the symlink changed
+	Retargeted
+	// Only the mode, the owner, the modification time or the extended
+	// attributes changed
+	AttrChanged
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Created:
+		return "A"
+	case Modified:
+		return "M"
+	case Deleted:
+		return "D"
+	case Renamed:
+		return "R"
+	case Retargeted:
+		return "L"
+	case AttrChanged:
+		return "T"
+	}
+	return "?"
+}
+
+// A pending change, as compared to the wrapped file system
+type Change struct {
+	Kind ChangeKind
+	Path string
+	// For renames, the path in the wrapped file system
+	From string
+}
+
+func (c Change) String() string {
+	if c.Kind == Renamed {
+		return fmt.Sprintf("%v %v -> %v", c.Kind, c.From, c.Path)
+	}
+	return fmt.Sprintf("%v %v", c.Kind, c.Path)
+}
+
+// Whether the attributes of a path differ in a way worth reporting. The
+// access time is ignored, since reading a file changes it.
+func attrChanged(a *fuse.Attr, b *fuse.Attr) bool {
+	return a.Mode != b.Mode || a.Owner != b.Owner ||
+		a.Mtime != b.Mtime || a.Mtimensec != b.Mtimensec
+}
+
+// The times of a directory change along with its entries, which are reported
+// on their own
+func dirAttrChanged(a *fuse.Attr, b *fuse.Attr) bool {
+	return a.Mode != b.Mode || a.Owner != b.Owner
+}
+
+// Changes lists the pending changes, sorted by path. Overlayed paths which
+// do not differ from the wrapped file system are not reported. A renamed
+// directory is reported once: what it holds moved along with it, and the
+// changes below it are relative to its source.
+func (fs *BufferFS) Changes() (changes []Change, code fuse.Status) {
+	defer fs.RLocked()()
+	return fs.changes()
+}
+
+// The file system must be locked, for reading at least
+func (fs *BufferFS) changes() (changes []Change, code fuse.Status) {
+	context := ownContext()
+	names := fs.Overlayed.Names()
+	primary := fs.primaryNames(names)
+	changes = make([]Change, 0, len(names))
+
+	// Paths of the wrapped file system that were renamed are not deleted
+	sources := make(map[string]bool)
+	for _, name := range names {
+		switch p := fs.Overlayed.Get(name).(type) {
+		case *OverlayFile:
+			sources[p.source] = true
+		case *OverlayDir:
+			sources[p.source] = true
+		}
+	}
+
+	for _, name := range names {
+		// Ignore the leftovers of paths which do not exist anymore
+		if _, status := fs.getAttr(name, context); status != fuse.OK {
+			continue
+		}
+		o := fs.Overlayed.Get(name)
+		attr := &fuse.Attr{}
+		o.GetAttr(attr)
+		origin := fs.origin(name)
+		existing, status := &fuse.Attr{}, fuse.ENOENT
+		if origin != NoSource {
+			existing, status = fs.Wrapped.GetAttr(origin, context)
+		}
+		sameType := status == fuse.OK &&
+			existing.Mode&syscall.S_IFMT == attr.Mode&syscall.S_IFMT
+
+		switch p := o.(type) {
+		case *OverlayDir:
+			from := origin
+			if p.source != NoSource && p.source != origin {
+				changes = append(changes, Change{Kind: Renamed, Path: name, From: p.source})
+				from = p.source
+			} else if !sameType {
+				changes = append(changes, Change{Kind: Created, Path: name})
+				break
+			} else if dirAttrChanged(attr, existing) || xattrsChanged(origin, o, fs.Wrapped, context) {
+				changes = append(changes, Change{Kind: AttrChanged, Path: name})
+			}
+			deleted, status := p.deletedEntries(from, fs.Wrapped, context)
+			if status != fuse.OK {
+				return nil, status
+			}
+			for _, base := range deleted {
+				if !sources[path.Join(from, base)] {
+					changes = append(changes, Change{Kind: Deleted, Path: path.Join(name, base)})
+				}
+			}
+		case *OverlayFile:
+			p.lock.Lock()
+			source, modified := p.source, p.slices.Len() > 0
+			p.lock.Unlock()
+			// The other names of a file are new, unless they are links
+			// to it in the wrapped file system
+			if primary[p] != name {
+				source = NoSource
+				if sameType && existing.Ino == attr.Ino {
+					source = origin
+				}
+			}
+			switch {
+			case source == NoSource || source == origin && !sameType:
+				changes = append(changes, Change{Kind: Created, Path: name})
+			case source == origin:
+				if modified || attr.Size != existing.Size {
+					changes = append(changes, Change{Kind: Modified, Path: name})
+				} else if attrChanged(attr, existing) || xattrsChanged(origin, o, fs.Wrapped, context) {
+					changes = append(changes, Change{Kind: AttrChanged, Path: name})
+				}
+			default:
+				changes = append(changes, Change{Kind: Renamed, Path: name, From: source})
+				if modified {
+					changes = append(changes, Change{Kind: Modified, Path: name})
+				}
+			}
+		case *OverlaySpecial:
+			if !sameType || attr.Rdev != existing.Rdev {
+				changes = append(changes, Change{Kind: Created, Path: name})
+			} else if attrChanged(attr, existing) || xattrsChanged(origin, o, fs.Wrapped, context) {
+				changes = append(changes, Change{Kind: AttrChanged, Path: name})
+			}
+		case *OverlaySymlink:
+			if !sameType {
+				changes = append(changes, Change{Kind: Created, Path: name})
+				break
+			}
+			target, status := fs.Wrapped.Readlink(origin, context)
+			if status != fuse.OK {
+				return nil, status
+			}
+			if target != p.target {
+				changes = append(changes, Change{Kind: Retargeted, Path: name})
+			} else if attrChanged(attr, existing) {
+				changes = append(changes, Change{Kind: AttrChanged, Path: name})
+			}
+		}
+	}
+
+	sort.Stable(byPath(changes))
+	return changes, fuse.OK
+}
+
+// The path of the wrapped file system at the place of a path: below a
+// renamed directory, the path below its source
+func (fs *BufferFS) origin(name string) string {
+	if name == "" {
+		return ""
+	}
+	dir, base := pathSplit(name)
+	source := fs.Overlayed.Source(dir)
+	if source == NoSource {
+		return NoSource
+	}
+	return path.Join(source, base)
+}
+
+// Returns the entries of the wrapped directory that the overlay does not
+// list anymore (or lists with another type)
+func (d *OverlayDir) deletedEntries(source string, wrapped pathfs.FileSystem, context *fuse.Context) (deleted []string, code fuse.Status) {
+	existing, code := wrapped.OpenDir(source, context)
+	if code != fuse.OK {
+		return nil, code
+	}
+	entries, _ := d.Entries(context)
+	kept := make(map[string]uint32, len(entries))
+	for _, e := range entries {
+		kept[e.Name] = e.Mode & syscall.S_IFMT
+	}
+	for _, e := range existing {
+		mode, ok := kept[e.Name]
+		if !ok || mode != e.Mode&syscall.S_IFMT {
+			deleted = append(deleted, e.Name)
+		}
+	}
+	return deleted, fuse.OK
+}
+
+type byPath []Change
+
+func (c byPath) Len() int           { return len(c) }
+func (c byPath) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c byPath) Less(i, j int) bool { return c[i].Path < c[j].Path }
@@ -0,0 +1,199 @@
+// copyright 2016 Christophe-Marie Duquesne
+
+package fs
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// The state of an overlayed path when a checkpoint was taken
+type checkpointedPath struct {
+	// What was overlayed at this path
+	live OverlayPath
+	// A frozen copy of its state
+	frozen OverlayPath
+}
+
+// A checkpoint holds references on the overlays it keeps
+type checkpoint map[string]checkpointedPath
+
+func (cp checkpoint) release() {
+	for _, p := range cp {
+		releaseOverlay(p.live)
+		releaseOverlay(p.frozen)
+	}
+}
+
+// Drops all the checkpoints. The file system must be locked.
+func (fs *BufferFS) dropCheckpoints() {
+	for _, cp := range fs.checkpoints {
+		cp.release()
+	}
+	fs.checkpoints = nil
+}
+
+// Copies the state of an overlayed path. The slices of the files and the
+// entries of the directories are not copied: the overlay never modifies the
+// slices, and copies the entries it shares before modifying them.
+func freeze(o OverlayPath) OverlayPath {
+	attr := &fuse.Attr{}
+	o.GetAttr(attr)
+	frozenAttr := NewOverlayAttrFromExisting(attr)
+	copyXAttrs(frozenAttr, o)
+	switch p := o.(type) {
+	case *OverlayFile:
+		defer p.Locked()()
+		f := NewOverlayFile(frozenAttr, p.source).(*OverlayFile)
+		f.setSlices(p.slices)
+		return f
+	case *OverlayDir:
+		defer p.Locked()()
+		p.shared = true
+		return NewOverlayDir(frozenAttr, p.source, p.entries)
+	case *OverlaySymlink:
+		return NewOverlaySymlink(frozenAttr, p.target)
+	case *OverlaySpecial:
+		return NewOverlaySpecial(frozenAttr)
+	}
+	return nil
+}
+
+// Gives back to an overlayed path the state it had when it was frozen. The
+// file handles opened on the path see the restored state. The frozen copy
+// is left untouched, so that it can be thawed again.
+func thaw(o OverlayPath, frozen OverlayPath) {
+	attr := &fuse.Attr{}
+	frozen.GetAttr(attr)
+	thawedAttr := NewOverlayAttrFromExisting(attr)
+	copyXAttrs(thawedAttr, frozen)
+	switch p := o.(type) {
+	case *OverlayFile:
+		f := frozen.(*OverlayFile)
+		defer p.Locked()()
+		p.OverlayAttr = thawedAttr
+		p.setSource(f.source)
+		p.setSlices(f.slices)
+	case *OverlayDir:
+		p.OverlayAttr = thawedAttr
+		d := frozen.(*OverlayDir)
+		p.source = d.source
+		p.setEntries(d.entries)
+	case *OverlaySymlink:
+		p.OverlayAttr = thawedAttr
+		p.target = frozen.(*OverlaySymlink).target
+	case *OverlaySpecial:
+		p.OverlayAttr = thawedAttr
+	}
+}
+
+// Checkpoint records the current state of the overlay under the given name,
+// replacing any previous checkpoint with this name. The data written so
+// far is not copied, so checkpoints are cheap.
+func (fs *BufferFS) Checkpoint(name string) (code fuse.Status) {
+	defer fs.Locked()()
+	fs.addCheckpoint(name, fs.Overlayed)
+	return fuse.OK
+}
+
+// Records the state of the paths of a tree as a checkpoint. The file system
+// must be locked.
+func (fs *BufferFS) addCheckpoint(name string, overlayed *OverlayTree) {
+	cp := make(checkpoint, overlayed.Len())
+	overlayed.Walk(func(n string, o OverlayPath) {
+		if frozen := freeze(o); frozen != nil {
+			retainOverlay(o)
+			retainOverlay(frozen)
+			cp[n] = checkpointedPath{live: o, frozen: frozen}
+		}
+	})
+	if fs.checkpoints == nil {
+		fs.checkpoints = make(map[string]checkpoint)
+	}
+	if previous, ok := fs.checkpoints[name]; ok {
+		previous.release()
+	}
+	fs.checkpoints[name] = cp
+}
+
+// Writes the state that the checkpoint gives back, as SaveState would have
+// when it was taken
+func (fs *BufferFS) saveCheckpoint(name string, w io.Writer) error {
+	defer fs.Locked()()
+
+	cp, ok := fs.checkpoints[name]
+	if !ok {
+		return fmt.Errorf("no checkpoint %q", name)
+	}
+	overlayed := NewOverlayTree()
+	defer overlayed.Clear()
+	// The names of a file share its frozen copy, so that they are saved
+	// as links
+	frozen := make(map[OverlayPath]OverlayPath, len(cp))
+	for n, p := range cp {
+		if f, ok := frozen[p.live]; ok {
+			overlayed.Set(n, f)
+			continue
+		}
+		frozen[p.live] = p.frozen
+		overlayed.Set(n, p.frozen)
+	}
+	return encodeState(w, overlayed)
+}
+
+// Records the state written by saveCheckpoint as a checkpoint, replacing
+// any previous checkpoint with this name. The overlay is left untouched.
+func (fs *BufferFS) loadCheckpoint(name string, r io.Reader) error {
+	overlayed, err := decodeState(r)
+	if err != nil {
+		return err
+	}
+	defer overlayed.Clear()
+	defer fs.Locked()()
+	fs.addCheckpoint(name, overlayed)
+	return nil
+}
+
+// RollbackTo gives back to the overlay the state it had when the checkpoint
+// was taken. The checkpoint is kept, so that we can roll back to it again.
+func (fs *BufferFS) RollbackTo(name string) (code fuse.Status) {
+	stale, code := fs.rollbackTo(name)
+	fs.invalidate(stale...)
+	return code
+}
+
+func (fs *BufferFS) rollbackTo(name string) (stale []string, code fuse.Status) {
+	defer fs.Locked()()
+
+	cp, ok := fs.checkpoints[name]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	stale = fs.Overlayed.Names()
+	released := fs.Overlayed
+	fs.Overlayed = NewOverlayTree()
+	for n, p := range cp {
+		thaw(p.live, p.frozen)
+		fs.Overlayed.Set(n, p.live)
+		stale = append(stale, n)
+	}
+	// Only now that the new tree references what it keeps
+	released.Clear()
+	fs.indexLinks()
+	return stale, fuse.OK
+}
+
+// Checkpoints returns the names of the checkpoints, sorted
+func (fs *BufferFS) Checkpoints() []string {
+	defer fs.Locked()()
+
+	names := make([]string, 0, len(fs.checkpoints))
+	for name := range fs.checkpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
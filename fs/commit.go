@@ -0,0 +1,419 @@
+// copyright 2016 Christophe-Marie Duquesne
+
+package fs
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+const (
+	stagingPrefix = ".ploufs-commit-"
+)
+
+// Context used for the operations that ploufs performs on its own behalf
+// (i.e. not on behalf of a fuse caller)
+func ownContext() *fuse.Context {
+	return &fuse.Context{
+		Owner: fuse.Owner{
+			Uid: uint32(os.Getuid()),
+			Gid: uint32(os.Getgid()),
+		},
+	}
+}
+
+// Overlays what shows below the renamed directories. Renaming a directory
+// does not overlay its children: they show what is below its source. The
+// commit, which goes through all the overlayed paths, needs them as renamed
+// paths.
+func (fs *BufferFS) materialize(req *request) (code fuse.Status) {
+	for _, name := range fs.Overlayed.Names() {
+		d, ok := fs.Overlayed.Get(name).(*OverlayDir)
+		if ok && d.source != NoSource && d.source != name {
+			code = fs.materializeDir(name, d, req)
+			if code != fuse.OK {
+				return code
+			}
+		}
+	}
+	return fuse.OK
+}
+
+func (fs *BufferFS) materializeDir(name string, d *OverlayDir, req *request) (code fuse.Status) {
+	entries, code := d.Entries(req.Context)
+	if code != fuse.OK {
+		return code
+	}
+	for _, e := range entries {
+		child := path.Join(name, e.Name)
+		o := fs.Overlayed.Get(child)
+		if o == nil {
+			attr, code := fs.getAttr(child, req.Context)
+			if code != fuse.OK {
+				return code
+			}
+			o, code = fs.overlayExisting(child, attr, req)
+			if code != fuse.OK {
+				return code
+			}
+		}
+		if c, ok := o.(*OverlayDir); ok && c.source != NoSource && c.source != child {
+			code = fs.materializeDir(child, c, req)
+			if code != fuse.OK {
+				return code
+			}
+		}
+	}
+	return fuse.OK
+}
+
+// A file whose source was moved out of the way during the commit, to be
+// moved to name
+type stagedSource struct {
+	f      *OverlayFile
+	name   string
+	source string
+}
+
+// Commit applies all the buffered changes to the wrapped file system, then
+// drops them from the overlay, along with the checkpoints. In case of error,
+// the commit stops and the wrapped file system may be partially modified:
+// the sources moved out of the way are moved back when possible, and the
+// others are logged.
+func (fs *BufferFS) Commit() (code fuse.Status) {
+	defer fs.Locked()()
+
+	req := newRequest(ownContext())
+	context := req.Context
+	code = fs.materialize(req)
+	if code != fuse.OK {
+		return code
+	}
+	names := fs.Overlayed.Names()
+	primary := fs.primaryNames(names)
+
+	// The files which lost all the names we overlay may still have names
+	// that we do not: they are written in place, before the name we know
+	// is removed
+	for _, f := range fs.links {
+		if _, ok := primary[f]; ok || f.Nlink() == 0 {
+			continue
+		}
+		code = f.commitContent(f.source, fs.Wrapped, context)
+		if code == fuse.OK {
+			code = commitAttr(f.source, f, fs.Wrapped, context)
+		}
+		if code != fuse.OK {
+			return code
+		}
+	}
+
+	// Files that were renamed get their content from another path of the
+	// wrapped file system. This path may be removed or replaced by the
+	// commit, so we first move these sources out of the way.
+	staged := make(map[string]stagedSource)
+	defer func() {
+		if code != fuse.OK {
+			fs.unstage(staged, context)
+		}
+	}()
+	for _, name := range names {
+		f, ok := fs.Overlayed.Get(name).(*OverlayFile)
+		if !ok || primary[f] != name || f.source == NoSource || f.source == name {
+			continue
+		}
+		staging := ""
+		for i := len(staged); staging == ""; i++ {
+			staging = fmt.Sprintf("%s%d", stagingPrefix, i)
+			if _, status := fs.Wrapped.GetAttr(staging, context); status != fuse.ENOENT {
+				staging = ""
+			}
+		}
+		code = fs.Wrapped.Rename(f.source, staging, context)
+		if code != fuse.OK {
+			return code
+		}
+		staged[staging] = stagedSource{f: f, name: name, source: f.source}
+		f.lock.Lock()
+		f.setSource(staging)
+		f.lock.Unlock()
+	}
+
+	// Remove from the wrapped file system all the entries that are not
+	// listed anymore, or that changed type
+	for _, name := range names {
+		d, ok := fs.Overlayed.Get(name).(*OverlayDir)
+		if !ok {
+			continue
+		}
+		code = d.commitRemovals(name, staged, fs.Wrapped, context)
+		if code != fuse.OK {
+			return code
+		}
+	}
+
+	// Create directories, write files, symlinks and special files (parents
+	// first)
+	for _, name := range names {
+		switch p := fs.Overlayed.Get(name).(type) {
+		case *OverlayDir:
+			code = p.commitContent(name, fs.Wrapped, context)
+		case *OverlayFile:
+			if primary[p] == name {
+				code = p.commitContent(name, fs.Wrapped, context)
+			}
+		case *OverlaySymlink:
+			code = p.commitContent(name, fs.Wrapped, context)
+		case *OverlaySpecial:
+			code = p.commitContent(name, fs.Wrapped, context)
+		}
+		if code != fuse.OK {
+			return code
+		}
+	}
+
+	// The other names of the files, once they all exist
+	for _, name := range names {
+		f, ok := fs.Overlayed.Get(name).(*OverlayFile)
+		if ok && primary[f] != name {
+			code = commitLink(primary[f], name, fs.Wrapped, context)
+			if code != fuse.OK {
+				return code
+			}
+		}
+	}
+
+	// Apply the attributes (children first, so that the times of the
+	// directories are not modified afterwards)
+	for i := len(names) - 1; i >= 0; i-- {
+		name := names[i]
+		code = commitAttr(name, fs.Overlayed.Get(name), fs.Wrapped, context)
+		if code != fuse.OK {
+			return code
+		}
+	}
+
+	// Everything is now in the wrapped file system. File handles may still
+	// point to the committed files: make them read from their new source.
+	for f, name := range primary {
+		f.rebase(name)
+	}
+	fs.Overlayed.Clear()
+	fs.dropLinks()
+	// The checkpoints were relative to the previous content of the wrapped
+	// file system
+	fs.dropCheckpoints()
+	return fuse.OK
+}
+
+// Removes a path from the wrapped file system, recursively
+func removeAll(name string, wrapped pathfs.FileSystem, context *fuse.Context) (code fuse.Status) {
+	a, code := wrapped.GetAttr(name, context)
+	if code != fuse.OK {
+		return code
+	}
+	if !a.IsDir() {
+		return wrapped.Unlink(name, context)
+	}
+	entries, code := wrapped.OpenDir(name, context)
+	if code != fuse.OK {
+		return code
+	}
+	for _, e := range entries {
+		code = removeAll(path.Join(name, e.Name), wrapped, context)
+		if code != fuse.OK {
+			return code
+		}
+	}
+	return wrapped.Rmdir(name, context)
+}
+
+// Moves the sources staged by a failed commit back to their place, unless
+// something else took it. The files the commit already moved keep their new
+// name as source.
+func (fs *BufferFS) unstage(staged map[string]stagedSource, context *fuse.Context) {
+	for staging, s := range staged {
+		if _, code := fs.Wrapped.GetAttr(staging, context); code != fuse.OK {
+			s.f.lock.Lock()
+			s.f.setSource(s.name)
+			s.f.lock.Unlock()
+			continue
+		}
+		code := fuse.Status(syscall.EEXIST)
+		if _, status := fs.Wrapped.GetAttr(s.source, context); status == fuse.ENOENT {
+			code = fs.Wrapped.Rename(staging, s.source, context)
+		}
+		if code != fuse.OK {
+			log.Printf("Could not move %s back to %s: %v", staging, s.source, code)
+			continue
+		}
+		s.f.lock.Lock()
+		s.f.setSource(s.source)
+		s.f.lock.Unlock()
+	}
+}
+
+// Removes the entries that the overlayed directory does not list anymore,
+// except the sources that the commit staged
+func (d *OverlayDir) commitRemovals(name string, staged map[string]stagedSource, wrapped pathfs.FileSystem, context *fuse.Context) (code fuse.Status) {
+	a, code := wrapped.GetAttr(name, context)
+	if code != fuse.OK || !a.IsDir() {
+		// Nothing to remove from a directory that does not exist
+		return fuse.OK
+	}
+	deleted, code := d.deletedEntries(name, wrapped, context)
+	if code != fuse.OK {
+		return code
+	}
+	for _, base := range deleted {
+		n := path.Join(name, base)
+		if _, ok := staged[n]; ok {
+			// Moved into place later
+			continue
+		}
+		code = removeAll(n, wrapped, context)
+		if code != fuse.OK {
+			return code
+		}
+	}
+	return fuse.OK
+}
+
+func (d *OverlayDir) commitContent(name string, wrapped pathfs.FileSystem, context *fuse.Context) (code fuse.Status) {
+	a, code := wrapped.GetAttr(name, context)
+	if code == fuse.OK && a.IsDir() {
+		return fuse.OK
+	}
+	// The permissions are set later on, but we need to be able to
+	// populate the directory in the meantime
+	return wrapped.Mkdir(name, 0700, context)
+}
+
+func (f *OverlayFile) commitContent(name string, wrapped pathfs.FileSystem, context *fuse.Context) (code fuse.Status) {
+	defer f.Locked()()
+
+	if f.source != NoSource && f.source != name {
+		code = wrapped.Rename(f.source, name, context)
+		if code != fuse.OK {
+			return code
+		}
+	}
+	var file nodefs.File
+	if f.source == NoSource {
+		file, code = wrapped.Create(name, syscall.O_WRONLY|syscall.O_TRUNC, 0600, context)
+	} else {
+		file, code = wrapped.Open(name, syscall.O_WRONLY, context)
+	}
+	if code != fuse.OK {
+		return code
+	}
+	defer file.Release()
+
+	code = file.Truncate(f.Size())
+	if code != fuse.OK {
+		return code
+	}
+	for _, s := range f.slices.Slices() {
+		if s.IsHole() {
+			code = commitHole(file, s)
+		} else {
+			_, code = file.Write(s.data, s.offset)
+		}
+		if code != fuse.OK {
+			return code
+		}
+	}
+	return file.Flush()
+}
+
+// Zeroes a hole in the wrapped file. We punch it when the wrapped file system
+// supports it, so that it stays sparse.
+func commitHole(file nodefs.File, s *FileSlice) (code fuse.Status) {
+	code = file.Allocate(uint64(s.Beg()), uint64(s.hole), fallocPunchHole|fallocKeepSize)
+	if code == fuse.OK {
+		return code
+	}
+	zeros := make([]byte, copyBufferSize)
+	for off := s.Beg(); off < s.End(); off += int64(len(zeros)) {
+		if n := s.End() - off; n < int64(len(zeros)) {
+			zeros = zeros[:n]
+		}
+		if _, code = file.Write(zeros, off); code != fuse.OK {
+			return code
+		}
+	}
+	return fuse.OK
+}
+
+func (s *OverlaySymlink) commitContent(name string, wrapped pathfs.FileSystem, context *fuse.Context) (code fuse.Status) {
+	target, code := wrapped.Readlink(name, context)
+	if code == fuse.OK && target == s.target {
+		return fuse.OK
+	}
+	if _, code = wrapped.GetAttr(name, context); code == fuse.OK {
+		code = removeAll(name, wrapped, context)
+		if code != fuse.OK {
+			return code
+		}
+	}
+	return wrapped.Symlink(s.target, name, context)
+}
+
+func (s *OverlaySpecial) commitContent(name string, wrapped pathfs.FileSystem, context *fuse.Context) (code fuse.Status) {
+	attr := fuse.Attr{}
+	s.GetAttr(&attr)
+	existing, code := wrapped.GetAttr(name, context)
+	if code == fuse.OK {
+		if existing.Mode&syscall.S_IFMT == attr.Mode&syscall.S_IFMT && existing.Rdev == attr.Rdev {
+			return fuse.OK
+		}
+		code = removeAll(name, wrapped, context)
+		if code != fuse.OK {
+			return code
+		}
+	}
+	// The permissions are set later on
+	return wrapped.Mknod(name, attr.Mode&syscall.S_IFMT|0600, attr.Rdev, context)
+}
+
+func commitAttr(name string, o OverlayPath, wrapped pathfs.FileSystem, context *fuse.Context) (code fuse.Status) {
+	attr := fuse.Attr{}
+	o.GetAttr(&attr)
+	existing, code := wrapped.GetAttr(name, context)
+	if code != fuse.OK {
+		return code
+	}
+	// The wrapped file system follows symlinks for chmod and chown
+	if !attr.IsSymlink() {
+		// Before the mode, which may not let us write them
+		code = commitXAttrs(name, o, wrapped, context)
+		if code != fuse.OK {
+			return code
+		}
+		// Before the mode: changing the owner drops the setuid and
+		// setgid bits
+		chowned := existing.Owner != attr.Owner
+		if chowned {
+			code = wrapped.Chown(name, attr.Owner.Uid, attr.Owner.Gid, context)
+			if code != fuse.OK {
+				return code
+			}
+		}
+		if chowned || existing.Mode&07777 != attr.Mode&07777 {
+			code = wrapped.Chmod(name, attr.Mode&07777, context)
+			if code != fuse.OK {
+				return code
+			}
+		}
+	}
+	atime := attr.AccessTime()
+	mtime := attr.ModTime()
+	return wrapped.Utimens(name, &atime, &mtime, context)
+}
@@ -0,0 +1,373 @@
+// copyright 2016 Christophe-Marie Duquesne
+
+package fs
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// A mounted BufferFS answers commands on a unix socket. A request is a list
+// of NUL terminated arguments, followed by an empty argument. The response
+// is a sequence of chunks "+<size>\n<data>", terminated by either ".\n" on
+// success or "-<message>\n" on failure.
+
+// What the commands act on: a BufferFS, or a file system wrapping it (such
+// as a JournalFS)
+type Controllable interface {
+	Changes() ([]Change, fuse.Status)
+	WritePatch(w io.Writer) error
+	ExportUpper(dir string) error
+	WriteLayer(w io.Writer) error
+	SaveState(w io.Writer) error
+	LoadState(r io.Reader) error
+	Checkpoint(name string) fuse.Status
+	RollbackTo(name string) fuse.Status
+	Checkpoints() []string
+	Discard()
+	DiscardPath(name string) fuse.Status
+	Commit() fuse.Status
+}
+
+type controlCommand func(fs Controllable, args []string, w io.Writer) error
+
+var controlCommands = map[string]controlCommand{
+	"diff":       controlDiff,
+	"patch":      controlPatch,
+	"upper":      controlUpper,
+	"export":     controlExport,
+	"save":       controlSave,
+	"load":       controlLoad,
+	"checkpoint": controlCheckpoint,
+	"rollback":   controlRollback,
+	"discard":    controlDiscard,
+	"commit":     controlCommit,
+}
+
+// The directory of the control sockets of the user, which only the user may
+// enter
+func controlDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "ploufs")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("ploufs-%d", os.Getuid()))
+}
+
+// ControlSocket returns the path of the socket controlling the BufferFS
+// that the user mounted on mountpoint
+func ControlSocket(mountpoint string) string {
+	abs, _ := filepath.Abs(mountpoint)
+	sum := sha1.Sum([]byte(abs))
+	return filepath.Join(controlDir(), fmt.Sprintf("%x.sock", sum[:8]))
+}
+
+// ListenControl creates the control socket of the mountpoint, replacing the
+// one of a previous mount. Only the user may connect to it.
+func ListenControl(mountpoint string) (net.Listener, error) {
+	dir := controlDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	// The directory may have been created by somebody else
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return nil, err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok || int(st.Uid) != os.Getuid() || info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%s is not a private directory", dir)
+	}
+	socket := ControlSocket(mountpoint)
+	os.Remove(socket)
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func statusError(code fuse.Status) error {
+	if code == fuse.OK {
+		return nil
+	}
+	return syscall.Errno(code)
+}
+
+func controlDiff(fs Controllable, args []string, w io.Writer) error {
+	if len(args) != 0 {
+		return errors.New("diff takes no argument")
+	}
+	changes, code := fs.Changes()
+	if code != fuse.OK {
+		return statusError(code)
+	}
+	for _, c := range changes {
+		if _, err := fmt.Fprintln(w, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func controlPatch(fs Controllable, args []string, w io.Writer) error {
+	if len(args) != 0 {
+		return errors.New("patch takes no argument")
+	}
+	return fs.WritePatch(w)
+}
+
+func controlUpper(fs Controllable, args []string, w io.Writer) error {
+	if len(args) != 1 || !filepath.IsAbs(args[0]) {
+		return errors.New("upper takes an absolute path as argument")
+	}
+	return fs.ExportUpper(args[0])
+}
+
+func controlExport(fs Controllable, args []string, w io.Writer) error {
+	format := "oci-layer"
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "--format=") {
+			return fmt.Errorf("unknown argument '%s'", arg)
+		}
+		format = strings.TrimPrefix(arg, "--format=")
+	}
+	switch format {
+	case "oci-layer":
+		return fs.WriteLayer(w)
+	}
+	return fmt.Errorf("unknown format '%s'", format)
+}
+
+func controlSave(fs Controllable, args []string, w io.Writer) error {
+	if len(args) != 1 || !filepath.IsAbs(args[0]) {
+		return errors.New("save takes an absolute path as argument")
+	}
+	// Do not leave a truncated state in place of a previous one
+	tmp := args[0] + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = fs.SaveState(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, args[0])
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func controlLoad(fs Controllable, args []string, w io.Writer) error {
+	if len(args) != 1 || !filepath.IsAbs(args[0]) {
+		return errors.New("load takes an absolute path as argument")
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fs.LoadState(f)
+}
+
+func controlCheckpoint(fs Controllable, args []string, w io.Writer) error {
+	switch len(args) {
+	case 0:
+		for _, name := range fs.Checkpoints() {
+			if _, err := fmt.Fprintln(w, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	case 1:
+		return statusError(fs.Checkpoint(args[0]))
+	}
+	return errors.New("checkpoint takes at most one argument")
+}
+
+func controlRollback(fs Controllable, args []string, w io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("rollback takes a checkpoint as argument")
+	}
+	code := fs.RollbackTo(args[0])
+	if code == fuse.ENOENT {
+		return fmt.Errorf("no checkpoint '%s'", args[0])
+	}
+	return statusError(code)
+}
+
+// The path is relative to the root of the mount
+func controlDiscard(fs Controllable, args []string, w io.Writer) error {
+	switch len(args) {
+	case 0:
+		fs.Discard()
+		return nil
+	case 1:
+		name := filepath.Clean(args[0])
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("'%s' is not in the mount", args[0])
+		}
+		if name == "." {
+			name = ""
+		}
+		return statusError(fs.DiscardPath(name))
+	}
+	return errors.New("discard takes at most one path as argument")
+}
+
+func controlCommit(fs Controllable, args []string, w io.Writer) error {
+	if len(args) != 0 {
+		return errors.New("commit takes no argument")
+	}
+	return statusError(fs.Commit())
+}
+
+// Writes data as chunks of the response
+type chunkWriter struct {
+	w io.Writer
+}
+
+func (c *chunkWriter) Write(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if _, err = fmt.Fprintf(c.w, "+%d\n", len(p)); err != nil {
+		return 0, err
+	}
+	return c.w.Write(p)
+}
+
+// ServeControl answers the commands received on the listener, until it is
+// closed
+func ServeControl(fs Controllable, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go handleControl(fs, conn)
+	}
+}
+
+func handleControl(fs Controllable, conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	args := make([]string, 0)
+	for {
+		arg, err := r.ReadString(0)
+		if err != nil {
+			return
+		}
+		arg = arg[:len(arg)-1]
+		if arg == "" {
+			break
+		}
+		args = append(args, arg)
+	}
+
+	w := bufio.NewWriter(conn)
+	defer w.Flush()
+
+	var err error
+	if !peerAllowed(conn) {
+		err = errors.New("permission denied")
+	} else if len(args) == 0 {
+		err = errors.New("no command")
+	} else if command, ok := controlCommands[args[0]]; !ok {
+		err = fmt.Errorf("unknown command '%s'", args[0])
+	} else {
+		err = command(fs, args[1:], &chunkWriter{w: w})
+	}
+
+	if err != nil {
+		// The message must hold on a single line
+		msg := strings.Replace(err.Error(), "\n", " ", -1)
+		fmt.Fprintf(w, "-%s\n", msg)
+		return
+	}
+	fmt.Fprintf(w, ".\n")
+}
+
+// Whether the process at the other end of the connection runs as the user who
+// mounted the file system, or as root
+func peerAllowed(conn net.Conn) bool {
+	u, ok := conn.(*net.UnixConn)
+	if !ok {
+		return false
+	}
+	raw, err := u.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var cred *syscall.Ucred
+	cerr := raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if cerr != nil || err != nil {
+		return false
+	}
+	return int(cred.Uid) == os.Getuid() || cred.Uid == 0
+}
+
+// Control sends a command to the BufferFS mounted on mountpoint, and copies
+// its output to w
+func Control(mountpoint string, args []string, w io.Writer) error {
+	conn, err := net.Dial("unix", ControlSocket(mountpoint))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, arg := range args {
+		if _, err := io.WriteString(conn, arg+"\x00"); err != nil {
+			return err
+		}
+	}
+	if _, err := io.WriteString(conn, "\x00"); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(conn)
+	for {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		header = header[:len(header)-1]
+		switch {
+		case header == ".":
+			return nil
+		case strings.HasPrefix(header, "-"):
+			return errors.New(header[1:])
+		case strings.HasPrefix(header, "+"):
+			size, err := strconv.ParseInt(header[1:], 10, 64)
+			if err != nil {
+				return err
+			}
+			if _, err := io.CopyN(w, r, size); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("malformed response '%s'", header)
+		}
+	}
+}
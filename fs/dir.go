@@ -1,11 +1,17 @@
 package fs
 
-import "github.com/hanwen/go-fuse/fuse"
+import (
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
 
 type Dir interface {
 	Entries(*fuse.Context) (stream []fuse.DirEntry, code fuse.Status)
-	AddEntry(mode uint32, name string) (code fuse.Status)
-	RemoveEntry(name string) (code fuse.Status)
+	Lookup(name string) (mode uint32, code fuse.Status)
+	// The times of the directory become the one of the operation
+	AddEntry(mode uint32, name string, now time.Time) (code fuse.Status)
+	RemoveEntry(name string, now time.Time) (code fuse.Status)
 }
 
 // Default implementation that fails
@@ -19,10 +25,14 @@ func (d *DefaultDir) Entries(context *fuse.Context) (stream []fuse.DirEntry, cod
 	return nil, fuse.ENOTDIR
 }
 
-func (d *DefaultDir) AddEntry(mode uint32, name string) (code fuse.Status) {
+func (d *DefaultDir) Lookup(name string) (mode uint32, code fuse.Status) {
+	return 0, fuse.ENOTDIR
+}
+
+func (d *DefaultDir) AddEntry(mode uint32, name string, now time.Time) (code fuse.Status) {
 	return fuse.ENOTDIR
 }
 
-func (d *DefaultDir) RemoveEntry(name string) (code fuse.Status) {
+func (d *DefaultDir) RemoveEntry(name string, now time.Time) (code fuse.Status) {
 	return fuse.ENOTDIR
 }
@@ -0,0 +1,210 @@
+// copyright 2016 Christophe-Marie Duquesne
+
+package fs
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Discard throws away all the buffered changes, so that the mount shows
+// the wrapped file system again.
+func (fs *BufferFS) Discard() {
+	fs.invalidate(fs.discard()...)
+}
+
+// Drops the overlay, and returns the paths that the kernel must forget
+func (fs *BufferFS) discard() (stale []string) {
+	defer fs.Locked()()
+
+	dropped := make(map[*OverlayFile]bool)
+	fs.Overlayed.Walk(func(n string, o OverlayPath) {
+		if f, ok := o.(*OverlayFile); ok {
+			dropped[f] = true
+		}
+	})
+	stale = fs.Overlayed.Names()
+	fs.Overlayed.Clear()
+	fs.dropLinks()
+	for f := range dropped {
+		fs.revert(f)
+	}
+	return stale
+}
+
+// DiscardPath throws away the buffered changes of a path and of everything
+// below it, so that the mount shows this path as the wrapped file system
+// does.
+func (fs *BufferFS) DiscardPath(name string) (code fuse.Status) {
+	stale, code := fs.discardPath(name, time.Now())
+	fs.invalidate(stale...)
+	return code
+}
+
+// The parent of the path, if overlayed, is changed at the given time
+func (fs *BufferFS) discardPath(name string, now time.Time) (stale []string, code fuse.Status) {
+	if name == "" {
+		return fs.discard(), fuse.OK
+	}
+
+	defer fs.Locked()()
+
+	// The files overlayed below the path, and those which keep a name
+	// elsewhere
+	prefix := name + "/"
+	dropped := make(map[*OverlayFile]bool)
+	kept := make(map[*OverlayFile]bool)
+	fs.Overlayed.Walk(func(n string, o OverlayPath) {
+		f, ok := o.(*OverlayFile)
+		switch {
+		case n == name || strings.HasPrefix(n, prefix):
+			if ok {
+				dropped[f] = true
+			}
+			if n != name {
+				stale = append(stale, n)
+			}
+		case ok:
+			kept[f] = true
+		}
+	})
+	// The names below the path may stop or start showing a file with
+	// other names: what they show is compared once the path is discarded
+	names := fs.discardedNames(name)
+	before := make([]*OverlayFile, len(names))
+	for i, n := range names {
+		before[i] = fs.shownFile(n)
+	}
+
+	fs.Overlayed.Delete(name)
+	// The other names of the discarded files show the wrapped file system
+	for ino, f := range fs.links {
+		if dropped[f] && !kept[f] {
+			delete(fs.links, ino)
+			f.release()
+		}
+	}
+
+	// If the parent is overlayed, it must list the path as the wrapped
+	// file system does (below the source of the parent, if it was renamed)
+	dir, base := pathSplit(name)
+	parent := fs.Overlayed.Get(dir)
+	if parent != nil {
+		parent.RemoveEntry(base, now)
+		source := fs.Overlayed.Source(name)
+		if source != NoSource {
+			a, status := fs.Wrapped.GetAttr(source, ownContext())
+			if status == fuse.OK {
+				parent.AddEntry(a.Mode, base, now)
+			}
+		}
+	}
+
+	for i, n := range names {
+		if after := fs.shownFile(n); after != before[i] {
+			if kept[before[i]] {
+				before[i].addNlink(-1)
+			}
+			if kept[after] {
+				after.addNlink(1)
+			}
+		}
+	}
+	for f := range dropped {
+		if !kept[f] {
+			fs.revert(f)
+		}
+	}
+	return append(stale, name), fuse.OK
+}
+
+// Returns the names below a path which may show a file with other names:
+// the overlayed ones, and those of the wrapped file system that the
+// overlayed directories do not list. The file system must be locked.
+func (fs *BufferFS) discardedNames(name string) []string {
+	names := []string{name}
+	prefix := name + "/"
+	fs.Overlayed.Walk(func(n string, o OverlayPath) {
+		if n != name && !strings.HasPrefix(n, prefix) {
+			return
+		}
+		if n != name {
+			names = append(names, n)
+		}
+		d, ok := o.(*OverlayDir)
+		if !ok || d.source == NoSource || len(fs.links) == 0 {
+			return
+		}
+		entries, code := fs.Wrapped.OpenDir(d.source, ownContext())
+		if code != fuse.OK {
+			return
+		}
+		for _, e := range entries {
+			if _, code := d.Lookup(e.Name); code != fuse.OK && !isDirMode(e.Mode) {
+				names = append(names, path.Join(n, e.Name))
+			}
+		}
+	})
+	return names
+}
+
+// Returns the file that a name shows if it may have other names, or nil.
+// The file system must be locked.
+func (fs *BufferFS) shownFile(name string) *OverlayFile {
+	o, source, code := fs.Overlayed.Lookup(name)
+	if code != fuse.OK {
+		return nil
+	}
+	if o != nil {
+		f, _ := o.(*OverlayFile)
+		return f
+	}
+	if source == NoSource {
+		return nil
+	}
+	a, code := fs.Wrapped.GetAttr(source, ownContext())
+	if code != fuse.OK {
+		return nil
+	}
+	return fs.linkedOverlay(a)
+}
+
+// Gives back to a discarded file the state of its source, so that the
+// handles still open on it read what the wrapped file system has. The
+// files without a source are left as they are, like unlinked files. The
+// file system must be locked.
+func (fs *BufferFS) revert(f *OverlayFile) {
+	if f.source == NoSource {
+		return
+	}
+	a, code := fs.Wrapped.GetAttr(f.source, ownContext())
+	if code != fuse.OK || !a.IsRegular() {
+		return
+	}
+	attr := NewOverlayAttrFromExisting(a)
+	if copyWrappedXAttrs(attr, f.source, fs.Wrapped, ownContext()) != fuse.OK {
+		return
+	}
+	defer f.Locked()()
+	f.OverlayAttr = attr
+	f.setSource(f.source)
+	f.setSlices(extents{})
+}
+
+// Tells the kernel to forget what it knows about the paths. The lock must
+// not be held: the kernel may wait for an operation that waits for it.
+func (fs *BufferFS) invalidate(names ...string) {
+	if fs.nodeFs == nil {
+		return
+	}
+	for _, name := range names {
+		fs.nodeFs.Notify(name)
+		if name != "" {
+			dir, base := pathSplit(name)
+			fs.nodeFs.EntryNotify(dir, base)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// copyright 2016 Christophe-Marie Duquesne
+
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Writes the values of the binary formats of ploufs (the journal, the
+// state files). Integers are varints, byte strings are prefixed by their
+// length. The first error is kept, and stops all the writes.
+type binaryWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (b *binaryWriter) write(p []byte) {
+	if b.err == nil {
+		_, b.err = b.w.Write(p)
+	}
+}
+
+func (b *binaryWriter) putUint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func (b *binaryWriter) putBytes(v []byte) {
+	b.putUint(uint64(len(v)))
+	b.write(v)
+}
+
+func (b *binaryWriter) putString(v string) {
+	b.putBytes([]byte(v))
+}
+
+func (b *binaryWriter) putTime(t *time.Time) {
+	if t == nil {
+		b.write([]byte{0})
+		return
+	}
+	b.write([]byte{1})
+	b.putUint(uint64(t.UnixNano()))
+}
+
+func (b *binaryWriter) putAttr(a *fuse.Attr) {
+	for _, v := range []uint64{a.Ino, a.Size, a.Blocks, a.Atime, a.Mtime, a.Ctime} {
+		b.putUint(v)
+	}
+	for _, v := range []uint32{a.Atimensec, a.Mtimensec, a.Ctimensec, a.Mode,
+		a.Nlink, a.Uid, a.Gid, a.Rdev, a.Blksize} {
+		b.putUint(uint64(v))
+	}
+}
+
+func (b *binaryWriter) putXAttrs(a XAttrs) {
+	names := a.ListXAttr()
+	b.putUint(uint64(len(names)))
+	for _, name := range names {
+		data, _ := a.GetXAttr(name)
+		b.putString(name)
+		b.putBytes(data)
+	}
+}
+
+// Byte strings longer than this are read as they come
+const readChunkSize = 1 << 16
+
+// Reads the values written by a binaryWriter. The first error is kept, and
+// the values read afterwards are empty.
+type binaryReader struct {
+	r   byteReader
+	err error
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func newBinaryReader(r io.Reader) *binaryReader {
+	if br, ok := r.(byteReader); ok {
+		return &binaryReader{r: br}
+	}
+	return &binaryReader{r: bufio.NewReader(r)}
+}
+
+func (b *binaryReader) getByte() byte {
+	if b.err != nil {
+		return 0
+	}
+	v, err := b.r.ReadByte()
+	b.err = err
+	return v
+}
+
+func (b *binaryReader) getUint() uint64 {
+	if b.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(b.r)
+	b.err = err
+	return v
+}
+
+// Byte strings longer than max are considered corrupted
+func (b *binaryReader) getBytes(max uint64) []byte {
+	n := b.getUint()
+	if b.err != nil {
+		return nil
+	}
+	if n > max {
+		b.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	// A corrupted length must not allocate more than what is read
+	if n > readChunkSize {
+		buf := &bytes.Buffer{}
+		_, b.err = io.CopyN(buf, b.r, int64(n))
+		if b.err == io.EOF {
+			b.err = io.ErrUnexpectedEOF
+		}
+		return buf.Bytes()
+	}
+	v := make([]byte, n)
+	_, b.err = io.ReadFull(b.r, v)
+	return v
+}
+
+func (b *binaryReader) getString(max uint64) string {
+	return string(b.getBytes(max))
+}
+
+func (b *binaryReader) getTime() *time.Time {
+	if b.getByte() == 0 {
+		return nil
+	}
+	t := time.Unix(0, int64(b.getUint()))
+	return &t
+}
+
+func (b *binaryReader) getAttr() *fuse.Attr {
+	a := &fuse.Attr{}
+	for _, v := range []*uint64{&a.Ino, &a.Size, &a.Blocks, &a.Atime, &a.Mtime, &a.Ctime} {
+		*v = b.getUint()
+	}
+	for _, v := range []*uint32{&a.Atimensec, &a.Mtimensec, &a.Ctimensec, &a.Mode,
+		&a.Nlink, &a.Uid, &a.Gid, &a.Rdev, &a.Blksize} {
+		*v = uint32(b.getUint())
+	}
+	return a
+}
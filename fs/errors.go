@@ -0,0 +1,23 @@
+// copyright 2016 Christophe-Marie Duquesne
+
+package fs
+
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Maps the failures of the wrapped file system met while copying the content
+// of a path which exists for the caller: the source of a file, the entries of
+// a directory or the target of a symlink. The caller gets the status as is
+// (EACCES, EIO, ENOSPC...), except when it would say that the path does not
+// exist: it vanished from the wrapped file system behind our back, which is
+// an I/O error for the caller.
+func contentStatus(code fuse.Status) fuse.Status {
+	switch code {
+	case fuse.ENOENT, fuse.Status(syscall.ENOTDIR), fuse.Status(syscall.ESTALE):
+		return fuse.EIO
+	}
+	return code
+}
@@ -0,0 +1,298 @@
+// copyright 2016 Christophe-Marie Duquesne
+
+package fs
+
+import (
+	"math"
+	"math/rand"
+	"sync/atomic"
+)
+
+// The slices of a file, ordered by offset and non overlapping, in a treap.
+// Trees are never modified: the operations return new trees, which share
+// most of their nodes with the previous ones. Keeping the slices of a file
+// (e.g. for a checkpoint) is therefore free.
+//
+// The nodes are reference counted, so that the data of the slices is given
+// back as soon as no tree uses it. The holders of a tree retain it. The
+// operations consume the trees which nobody retains: the nodes of those are
+// either reused by the result, or freed.
+type extents struct {
+	root *extentNode
+}
+
+type extentNode struct {
+	slice       *FileSlice
+	priority    uint32
+	left, right *extentNode
+	// Totals of the subtree
+	count int
+	data  int64
+	holes int64
+	// References from the parent nodes and from the holders of the tree
+	refs int32
+}
+
+func newExtentNode(s *FileSlice, priority uint32, left, right *extentNode) *extentNode {
+	n := &extentNode{
+		slice:    s,
+		priority: priority,
+		left:     left,
+		right:    right,
+		count:    left.len() + right.len() + 1,
+		data:     left.dataBytes() + right.dataBytes(),
+		holes:    left.holeBytes() + right.holeBytes(),
+	}
+	left.retain()
+	right.retain()
+	s.buf.retain()
+	if s.IsHole() {
+		n.holes += s.hole
+	} else {
+		n.data += int64(len(s.data))
+	}
+	return n
+}
+
+func (n *extentNode) retain() {
+	if n != nil {
+		atomic.AddInt32(&n.refs, 1)
+	}
+}
+
+func (n *extentNode) release() {
+	if n != nil && atomic.AddInt32(&n.refs, -1) == 0 {
+		n.free()
+	}
+}
+
+// Frees the node if nothing references it: it was a temporary result of the
+// operations
+func (n *extentNode) drop() {
+	if n != nil && atomic.LoadInt32(&n.refs) == 0 {
+		n.free()
+	}
+}
+
+func (n *extentNode) free() {
+	n.left.release()
+	n.right.release()
+	n.slice.buf.release()
+}
+
+func (n *extentNode) len() int {
+	if n == nil {
+		return 0
+	}
+	return n.count
+}
+
+func (n *extentNode) dataBytes() int64 {
+	if n == nil {
+		return 0
+	}
+	return n.data
+}
+
+func (n *extentNode) holeBytes() int64 {
+	if n == nil {
+		return 0
+	}
+	return n.holes
+}
+
+func (n *extentNode) last() *FileSlice {
+	if n == nil {
+		return nil
+	}
+	for n.right != nil {
+		n = n.right
+	}
+	return n.slice
+}
+
+// Splits the slices between those starting before off, and the others
+func splitExtents(n *extentNode, off int64) (*extentNode, *extentNode) {
+	if n == nil {
+		return nil, nil
+	}
+	if n.slice.Beg() < off {
+		l, r := splitExtents(n.right, off)
+		l = newExtentNode(n.slice, n.priority, n.left, l)
+		n.drop()
+		return l, r
+	}
+	l, r := splitExtents(n.left, off)
+	r = newExtentNode(n.slice, n.priority, r, n.right)
+	n.drop()
+	return l, r
+}
+
+// Joins two trees, the slices of l being before those of r
+func joinExtents(l, r *extentNode) *extentNode {
+	if l == nil {
+		return r
+	}
+	if r == nil {
+		return l
+	}
+	var n *extentNode
+	if l.priority > r.priority {
+		n = newExtentNode(l.slice, l.priority, l.left, joinExtents(l.right, r))
+		l.drop()
+	} else {
+		n = newExtentNode(r.slice, r.priority, joinExtents(l, r.left), r.right)
+		r.drop()
+	}
+	return n
+}
+
+func singleExtent(s *FileSlice) *extentNode {
+	return newExtentNode(s, rand.Uint32(), nil, nil)
+}
+
+// Retains the nodes of the tree, for as long as it is held
+func (t extents) retain() {
+	t.root.retain()
+}
+
+// Releases the nodes of a tree that is not held anymore
+func (t extents) release() {
+	t.root.release()
+}
+
+// Len returns the number of slices
+func (t extents) Len() int {
+	return t.root.len()
+}
+
+// Bytes of data and of holes in the slices
+func (t extents) Sizes() (data int64, holes int64) {
+	return t.root.dataBytes(), t.root.holeBytes()
+}
+
+// Write returns the extents where s replaces what was in its range
+func (t extents) Write(s *FileSlice) extents {
+	if s.End() == s.Beg() {
+		return t
+	}
+	l, r := splitExtents(t.root, s.Beg())
+	m, r := splitExtents(r, s.End())
+
+	// The slices starting in the range of s disappear, but the last one may
+	// go past it. So may the slice just before s.
+	var tail *FileSlice
+	if last := m.last(); last != nil && last.End() > s.End() {
+		tail = last.From(s.End())
+	}
+	if last := l.last(); last != nil && last.End() > s.Beg() {
+		if last.End() > s.End() {
+			tail = last.From(s.End())
+		}
+		var cut *extentNode
+		l, cut = splitExtents(l, last.Beg())
+		l = joinExtents(l, singleExtent(last.Truncated(s.Beg())))
+		cut.drop()
+	}
+
+	res := joinExtents(l, singleExtent(s))
+	if tail != nil {
+		res = joinExtents(res, singleExtent(tail))
+	}
+	// Only now that the pieces of the slices we cut are in nodes of their
+	// own can the replaced ones go
+	m.drop()
+	return extents{joinExtents(res, r)}
+}
+
+// Truncate returns the extents without anything past off
+func (t extents) Truncate(off int64) extents {
+	l, cut := splitExtents(t.root, off)
+	cut.drop()
+	if last := l.last(); last != nil && last.End() > off {
+		l, cut = splitExtents(l, last.Beg())
+		l = joinExtents(l, singleExtent(last.Truncated(off)))
+		cut.drop()
+	}
+	return extents{l}
+}
+
+// From returns the extents without anything before off
+func (t extents) From(off int64) extents {
+	l, r := splitExtents(t.root, off)
+	if last := l.last(); last != nil && last.End() > off {
+		r = joinExtents(singleExtent(last.From(off)), r)
+	}
+	l.drop()
+	return extents{r}
+}
+
+// Collapse returns the extents without [off, off+length[, what follows
+// moving back to off
+func (t extents) Collapse(off int64, length int64) extents {
+	// t is used twice
+	t.retain()
+	defer t.release()
+	from := t.From(off + length).root
+	tail := from.shifted(-length)
+	from.drop()
+	return extents{joinExtents(t.Truncate(off).root, tail)}
+}
+
+// Insert returns the extents with a hole of the given length at off, what
+// follows moving forward to make room for it
+func (t extents) Insert(off int64, length int64) extents {
+	// t is used twice
+	t.retain()
+	defer t.release()
+	from := t.From(off).root
+	tail := from.shifted(length)
+	from.drop()
+	hole := singleExtent(&FileSlice{offset: off, hole: length})
+	return extents{joinExtents(joinExtents(t.Truncate(off).root, hole), tail)}
+}
+
+// Copies the subtree, with the slices moved by delta. The shape of the tree
+// is kept, since the order of the slices does not change.
+func (n *extentNode) shifted(delta int64) *extentNode {
+	if n == nil {
+		return nil
+	}
+	s := *n.slice
+	s.offset += delta
+	return newExtentNode(&s, n.priority, n.left.shifted(delta), n.right.shifted(delta))
+}
+
+// Visit calls fn on the slices overlapping [beg, end[, in order, until fn
+// returns false
+func (t extents) Visit(beg int64, end int64, fn func(s *FileSlice) bool) {
+	t.root.visit(beg, end, fn)
+}
+
+// Slices returns all the slices, in order
+func (t extents) Slices() []*FileSlice {
+	slices := make([]*FileSlice, 0, t.Len())
+	t.root.visit(math.MinInt64, math.MaxInt64, func(s *FileSlice) bool {
+		slices = append(slices, s)
+		return true
+	})
+	return slices
+}
+
+func (n *extentNode) visit(beg int64, end int64, fn func(s *FileSlice) bool) bool {
+	if n == nil {
+		return true
+	}
+	// The slices on the left end before this one starts, those on the
+	// right start after it ends
+	if n.slice.Beg() > beg && !n.left.visit(beg, end, fn) {
+		return false
+	}
+	if n.slice.Beg() < end && n.slice.End() > beg && !fn(n.slice) {
+		return false
+	}
+	if n.slice.End() < end {
+		return n.right.visit(beg, end, fn)
+	}
+	return true
+}
@@ -16,11 +16,11 @@ type File interface {
 	Release()
 	Fsync(flags int) (code fuse.Status)
 	Truncate(size uint64) fuse.Status
-	Allocate(off uint64, size uint64, mode uint32) (code fuse.Status)
 
 	// For usage by file handle
 	Read(dest []byte, off int64, ctx *fuse.Context, fs pathfs.FileSystem) (fuse.ReadResult, fuse.Status)
 	Write(data []byte, off int64, ctx *fuse.Context, fs pathfs.FileSystem) (written uint32, code fuse.Status)
+	Allocate(off uint64, size uint64, mode uint32, ctx *fuse.Context, fs pathfs.FileSystem) (code fuse.Status)
 }
 
 type DefaultFile struct {
@@ -40,3 +40,7 @@ func (f *DefaultFile) Read(dest []byte, off int64, ctx *fuse.Context, fs pathfs.
 func (f *DefaultFile) Write(data []byte, off int64, ctx *fuse.Context, fs pathfs.FileSystem) (written uint32, code fuse.Status) {
 	return 0, fuse.ENOSYS
 }
+
+func (f *DefaultFile) Allocate(off uint64, size uint64, mode uint32, ctx *fuse.Context, fs pathfs.FileSystem) (code fuse.Status) {
+	return fuse.ENOSYS
+}
@@ -11,6 +11,29 @@ import (
 type FileSlice struct {
 	offset int64
 	data   []byte
+	// The memory of data, given back when no extent references it anymore
+	buf *sliceBuffer
+	// The length of a hole: a range that reads as zeros, without data
+	hole int64
+}
+
+// Allocates a zero filled slice from the scratch space. Unless it goes into
+// extents, it must be dropped.
+func newFileSlice(offset int64, size int) (*FileSlice, fuse.Status) {
+	buf, code := scratch.alloc(size)
+	if code != fuse.OK {
+		return nil, code
+	}
+	return &FileSlice{
+		offset: offset,
+		data:   buf.data,
+		buf:    buf,
+	}, fuse.OK
+}
+
+// Gives back the data of a slice that never went into extents
+func (s *FileSlice) drop() {
+	s.buf.drop()
 }
 
 // So that FileSlice satisfies the fuse.ReadResult interface
@@ -33,6 +56,15 @@ func (s *FileSlice) Truncated(off int64) *FileSlice {
 			offset: s.offset,
 			data:   nil,
 		}
+	} else if s.IsHole() {
+		n := off - s.Beg()
+		if n > s.hole {
+			n = s.hole
+		}
+		return &FileSlice{
+			offset: s.offset,
+			hole:   n,
+		}
 	} else {
 		n := int(off - s.Beg())
 		if n > s.Size() {
@@ -41,19 +73,48 @@ func (s *FileSlice) Truncated(off int64) *FileSlice {
 		return &FileSlice{
 			offset: s.offset,
 			data:   s.data[:n],
+			buf:    s.buf,
 		}
 	}
 }
 
+// Returns the end of the FileSlice, from the given absolute offset
+func (s *FileSlice) From(off int64) *FileSlice {
+	if off <= s.Beg() {
+		return s
+	}
+	if off > s.End() {
+		off = s.End()
+	}
+	if s.IsHole() {
+		return &FileSlice{
+			offset: off,
+			hole:   s.End() - off,
+		}
+	}
+	return &FileSlice{
+		offset: off,
+		data:   s.data[off-s.Beg():],
+		buf:    s.buf,
+	}
+}
+
+func (s *FileSlice) IsHole() bool {
+	return s.hole > 0
+}
+
 func (s *FileSlice) Beg() int64 {
 	return s.offset
 }
 
 func (s *FileSlice) End() int64 {
-	return s.offset + int64(len(s.data))
+	return s.offset + int64(len(s.data)) + s.hole
 }
 
 func (s *FileSlice) String() string {
+	if s.IsHole() {
+		return fmt.Sprintf("FileSlice{%v, (hole=%v)}", s.offset, s.hole)
+	}
 	data := fmt.Sprintf("%v", s.data)
 	threshold := 10
 	if len(s.data) > threshold {
@@ -81,51 +142,21 @@ func (s *FileSlice) Overlaps(other *FileSlice) (res bool) {
 
 }
 
-func (s *FileSlice) MergedIn(other *FileSlice) *FileSlice {
+func (s *FileSlice) Write(other *FileSlice) {
 	// We assume the slices overlap
-
-	min := func(a, b int64) int64 {
-		if a < b {
-			return a
+	diff := other.Beg() - s.Beg()
+	if other.IsHole() {
+		beg, end := diff, diff+other.hole
+		if beg < 0 {
+			beg = 0
 		}
-		return b
-	}
-	max := func(a, b int64) int64 {
-		if a > b {
-			return a
+		if end > int64(len(s.data)) {
+			end = int64(len(s.data))
 		}
-		return b
-	}
-	abs := func(a int64) int64 {
-		if a >= 0 {
-			return a
+		for i := beg; i < end; i++ {
+			s.data[i] = 0
 		}
-		return -a
-	}
-
-	offset := min(s.offset, other.offset)
-	l := max(s.End(), other.End()) - min(s.Beg(), other.Beg())
-	data := make([]byte, int(l))
-
-	sliceOffset := abs(other.Beg() - s.Beg())
-	if s.Beg() < other.Beg() {
-		copy(data, s.data)
-		copy(data[sliceOffset:], other.data)
-	} else {
-		copy(data[sliceOffset:], s.data)
-		copy(data, other.data)
-	}
-
-	return &FileSlice{
-		data:   data,
-		offset: offset,
-	}
-}
-
-func (s *FileSlice) Write(other *FileSlice) {
-	// We assume the slices overlap
-	diff := other.Beg() - s.Beg()
-	if diff >= 0 {
+	} else if diff >= 0 {
 		// other starts after s
 		copy(s.data[diff:], other.data)
 	} else {
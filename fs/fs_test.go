@@ -40,6 +40,7 @@ type testCase struct {
 	origSubdir  string
 	tester      *testing.T
 	state       *fuse.Server
+	bufferFs    *BufferFS
 	pathFs      *pathfs.PathNodeFs
 	connector   *nodefs.FileSystemConnector
 }
@@ -73,6 +74,7 @@ func NewTestCase(t *testing.T) *testCase {
 	var pfs pathfs.FileSystem
 	pfs = pathfs.NewLoopbackFileSystem(tc.orig)
 	pfs = NewBufferFS(pfs)
+	tc.bufferFs = pfs.(*BufferFS)
 
 	tc.pathFs = pathfs.NewPathNodeFs(pfs, &pathfs.PathNodeFsOptions{
 		ClientInodes: true})
@@ -85,8 +87,7 @@ func NewTestCase(t *testing.T) *testCase {
 		})
 	tc.state, err = fuse.NewServer(
 		fuse.NewRawFileSystem(tc.connector.RawFS()), tc.mnt, &fuse.MountOptions{
-			SingleThreaded: true,
-			Debug:          VerboseTest(),
+			Debug: VerboseTest(),
 		})
 	if err != nil {
 		t.Fatal("NewServer:", err)
@@ -112,6 +113,25 @@ func (tc *testCase) rootNode() *nodefs.Inode {
 	return tc.pathFs.Root().Inode()
 }
 
+// Answers the control commands sent to the mount, until stop is called
+func (tc *testCase) serveControl() (stop func()) {
+	l, err := ListenControl(tc.mnt)
+	if err != nil {
+		tc.tester.Fatalf("ListenControl failed: %v", err)
+	}
+	go ServeControl(tc.bufferFs, l)
+	return func() { l.Close() }
+}
+
+// Sends a control command to the mount, and returns its output
+func (tc *testCase) control(args ...string) string {
+	out := &bytes.Buffer{}
+	if err := Control(tc.mnt, args, out); err != nil {
+		tc.tester.Fatalf("Control(%v) failed: %v", args, err)
+	}
+	return out.String()
+}
+
 ////////////////
 // Tests.
 
@@ -236,54 +256,54 @@ func TestMkdirRmdir(t *testing.T) {
 	}
 }
 
-//func TestLinkCreate(t *testing.T) {
-//	tc := NewTestCase(t)
-//	defer tc.Cleanup()
-//
-//	content := randomData(125)
-//	tc.WriteFile(tc.origFile, content, 0700)
-//
-//	tc.Mkdir(tc.origSubdir, 0777)
-//
-//	// Link.
-//	mountSubfile := filepath.Join(tc.mountSubdir, "subfile")
-//	err := os.Link(tc.mountFile, mountSubfile)
-//	if err != nil {
-//		t.Fatalf("Link failed: %v", err)
-//	}
-//
-//	var subStat, stat syscall.Stat_t
-//	err = syscall.Lstat(mountSubfile, &subStat)
-//	if err != nil {
-//		t.Fatalf("Lstat failed: %v", err)
-//	}
-//	err = syscall.Lstat(tc.mountFile, &stat)
-//	if err != nil {
-//		t.Fatalf("Lstat failed: %v", err)
-//	}
-//
-//	if stat.Nlink != 2 {
-//		t.Errorf("Expect 2 links: %v", stat)
-//	}
-//	if stat.Ino != subStat.Ino {
-//		t.Errorf("Link succeeded, but inode numbers different: %v %v", stat.Ino, subStat.Ino)
-//	}
-//	readback, err := ioutil.ReadFile(mountSubfile)
-//	if err != nil {
-//		t.Fatalf("ReadFile failed: %v", err)
-//	}
-//	CompareSlices(t, readback, content)
-//
-//	err = os.Remove(tc.mountFile)
-//	if err != nil {
-//		t.Fatalf("Remove failed: %v", err)
-//	}
-//
-//	_, err = ioutil.ReadFile(mountSubfile)
-//	if err != nil {
-//		t.Fatalf("ReadFile failed: %v", err)
-//	}
-//}
+func TestLinkCreate(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	content := randomData(125)
+	tc.WriteFile(tc.origFile, content, 0700)
+
+	tc.Mkdir(tc.origSubdir, 0777)
+
+	// Link.
+	mountSubfile := filepath.Join(tc.mountSubdir, "subfile")
+	err := os.Link(tc.mountFile, mountSubfile)
+	if err != nil {
+		t.Fatalf("Link failed: %v", err)
+	}
+
+	var subStat, stat syscall.Stat_t
+	err = syscall.Lstat(mountSubfile, &subStat)
+	if err != nil {
+		t.Fatalf("Lstat failed: %v", err)
+	}
+	err = syscall.Lstat(tc.mountFile, &stat)
+	if err != nil {
+		t.Fatalf("Lstat failed: %v", err)
+	}
+
+	if stat.Nlink != 2 {
+		t.Errorf("Expect 2 links: %v", stat)
+	}
+	if stat.Ino != subStat.Ino {
+		t.Errorf("Link succeeded, but inode numbers different: %v %v", stat.Ino, subStat.Ino)
+	}
+	readback, err := ioutil.ReadFile(mountSubfile)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	CompareSlices(t, readback, content)
+
+	err = os.Remove(tc.mountFile)
+	if err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+
+	_, err = ioutil.ReadFile(mountSubfile)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+}
 
 func randomData(size int) []byte {
 	return bytes.Repeat([]byte{'x'}, size)
@@ -458,6 +478,35 @@ func TestAccess(t *testing.T) {
 	}
 }
 
+// As TestAccess, for a caller who is not root, whoever runs the tests
+func TestAccessContext(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Cleanup()
+
+	if err := os.Chmod(tc.orig, 0755); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	tc.WriteFile(tc.origFile, []byte{1, 2, 3}, 0700)
+	if err := os.Chmod(tc.origFile, 0); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	context := &fuse.Context{Owner: fuse.Owner{Uid: 54321, Gid: 54321}}
+	name := filepath.Base(tc.mountFile)
+
+	if code := tc.bufferFs.Access(name, accessWrite, context); code != fuse.EACCES {
+		t.Errorf("Expected EACCES for non-writable, got %v", code)
+	}
+	if err := os.Chmod(tc.origFile, 0222); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	if code := tc.bufferFs.Access(name, accessWrite, context); code != fuse.OK {
+		t.Errorf("Expected no error code for writable, got %v", code)
+	}
+	if code := tc.bufferFs.Access(name, accessRead, context); code != fuse.EACCES {
+		t.Errorf("Expected EACCES for non-readable, got %v", code)
+	}
+}
+
 // We don't support mknod
 //func TestMknod(t *testing.T) {
 //	tc := NewTestCase(t)
@@ -0,0 +1,864 @@
+// copyright 2016 Christophe-Marie Duquesne
+
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+const (
+	journalName = "journal"
+	// The states loaded in the journal are kept in files named after it
+	statePrefix  = "state-"
+	journalMagic = "ploufsj\x01"
+	// Length and checksum of the entry
+	entryHeaderSize = 8
+)
+
+type journalOp byte
+
+const (
+	opChmod journalOp = iota + 1
+	opChown
+	opTruncate
+	opUnlink
+	opRmdir
+	opSymlink
+	opMkdir
+	opCreate
+	opRename
+	opUtimens
+	opDiscardPath
+	// The data is a state, which replaces all the buffered changes
+	opLoadState
+	// Operations on file handles, applied to the file overlayed at the path
+	opWrite
+	opFileTruncate
+	opFileChmod
+	opFileChown
+	opFileUtimens
+	opFileAllocate
+	// Checkpoints are part of the state to restore
+	opCheckpoint
+	opRollback
+	// Other is a state, which becomes the checkpoint
+	opLoadCheckpoint
+	opLink
+	opSetXAttr
+	opRemoveXAttr
+	// The device number is in the flags
+	opMknod
+)
+
+// A mutating operation, as recorded in the journal. The fields that are
+// not relevant for the operation are left empty.
+type journalEntry struct {
+	op    journalOp
+	time  time.Time
+	owner fuse.Owner
+	name  string
+	// The new path of renames and links, the target of symlinks, the
+	// name of extended attributes
+	other string
+	mode  uint32
+	flags uint32
+	uid   uint32
+	gid   uint32
+	off   uint64
+	size  uint64
+	atime *time.Time
+	mtime *time.Time
+	data  []byte
+	// The supplementary groups of the caller, which the permission checks
+	// need when the operation is replayed
+	groups []uint32
+}
+
+// The request of the recorded operation, whose caller has the groups it had
+func (e *journalEntry) request() *request {
+	return &request{
+		Context: &fuse.Context{Owner: e.owner},
+		caller: &caller{
+			uid:    e.owner.Uid,
+			gid:    e.owner.Gid,
+			groups: e.groups,
+			loaded: true,
+		},
+		time: e.time,
+	}
+}
+
+func (e *journalEntry) MarshalBinary() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	b := &binaryWriter{w: buf}
+	b.write([]byte{byte(e.op)})
+	b.putTime(&e.time)
+	b.putUint(uint64(e.owner.Uid))
+	b.putUint(uint64(e.owner.Gid))
+	b.putString(e.name)
+	b.putString(e.other)
+	b.putUint(uint64(e.mode))
+	b.putUint(uint64(e.flags))
+	b.putUint(uint64(e.uid))
+	b.putUint(uint64(e.gid))
+	b.putUint(e.off)
+	b.putUint(e.size)
+	b.putTime(e.atime)
+	b.putTime(e.mtime)
+	b.putBytes(e.data)
+	b.putUint(uint64(len(e.groups)))
+	for _, g := range e.groups {
+		b.putUint(uint64(g))
+	}
+	return buf.Bytes(), b.err
+}
+
+func (e *journalEntry) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	b := newBinaryReader(r)
+	max := uint64(len(data))
+	e.op = journalOp(b.getByte())
+	if t := b.getTime(); t != nil {
+		e.time = *t
+	}
+	e.owner.Uid = uint32(b.getUint())
+	e.owner.Gid = uint32(b.getUint())
+	e.name = b.getString(max)
+	e.other = b.getString(max)
+	e.mode = uint32(b.getUint())
+	e.flags = uint32(b.getUint())
+	e.uid = uint32(b.getUint())
+	e.gid = uint32(b.getUint())
+	e.off = b.getUint()
+	e.size = b.getUint()
+	e.atime = b.getTime()
+	e.mtime = b.getTime()
+	e.data = b.getBytes(max)
+	// The first journals did not record the groups
+	if r.Len() > 0 {
+		n := b.getUint()
+		if n > max {
+			return io.ErrUnexpectedEOF
+		}
+		for i := uint64(0); i < n && b.err == nil; i++ {
+			e.groups = append(e.groups, uint32(b.getUint()))
+		}
+	}
+	return b.err
+}
+
+// JournalFS records the mutating operations of a BufferFS in a journal
+// before applying them, so that the buffered changes survive a crash or a
+// restart of ploufs. The operations are replayed when the journal is
+// opened: the wrapped file system must not have changed in the meantime.
+// The journal is emptied when the changes are committed or discarded.
+//
+// The entries are written to the page cache, which survives a crash of
+// ploufs but not of the machine. With Sync, each entry reaches the disk
+// before its operation is applied; otherwise the journal is only synced when
+// a file is, as fsync(2) asks.
+type JournalFS struct {
+	*BufferFS
+	// Whether each entry is synced to disk before its operation is applied
+	Sync bool
+	dir  string
+	file *os.File
+	lock sync.Mutex
+}
+
+// NewJournalFS replays the journal found in dir (if any) on fs, then records
+// the next operations in it
+func NewJournalFS(fs *BufferFS, dir string) (*JournalFS, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	file, err := openJournal(filepath.Join(dir, journalName))
+	if err != nil {
+		return nil, err
+	}
+	j := &JournalFS{
+		BufferFS: fs,
+		dir:      dir,
+		file:     file,
+	}
+	if err := j.replay(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+func openJournal(name string) (*os.File, error) {
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	// Two mounts sharing a journal would corrupt it
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("journal %s is in use: %v", filepath.Dir(name), err)
+	}
+	return file, nil
+}
+
+// Close closes the journal. Its content is kept for the next mount.
+func (fs *JournalFS) Close() error {
+	return fs.file.Close()
+}
+
+func (fs *JournalFS) replay() error {
+	info, err := fs.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		_, err := fs.file.Write([]byte(journalMagic))
+		return err
+	}
+
+	r := bufio.NewReader(fs.file)
+	magic := make([]byte, len(journalMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != journalMagic {
+		return fmt.Errorf("%s is not a ploufs journal", fs.file.Name())
+	}
+
+	offset := int64(len(journalMagic))
+	header := make([]byte, entryHeaderSize)
+	for {
+		_, err := io.ReadFull(r, header)
+		if err == io.EOF {
+			break
+		}
+		var data []byte
+		if err == nil {
+			data = make([]byte, binary.BigEndian.Uint32(header))
+			_, err = io.ReadFull(r, data)
+		}
+		end := offset + int64(entryHeaderSize+len(data))
+		if err == nil && crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+			err = errors.New("checksum mismatch")
+			if end < info.Size() {
+				return fmt.Errorf("journal corrupted at offset %d: %v", offset, err)
+			}
+		}
+		if err != nil {
+			// The last entry was not completely written: the operation
+			// never happened
+			log.Printf("Dropping a partial journal entry at offset %d: %v", offset, err)
+			return fs.file.Truncate(offset)
+		}
+		e := &journalEntry{}
+		if err := e.UnmarshalBinary(data); err != nil {
+			return fmt.Errorf("journal corrupted at offset %d: %v", offset, err)
+		}
+		fs.apply(e)
+		offset = end
+	}
+	return nil
+}
+
+// Applies an entry to the BufferFS, as its request did. Failures are not
+// reported: the operation failed the same way when it was recorded.
+func (fs *JournalFS) apply(e *journalEntry) {
+	req := e.request()
+	switch e.op {
+	case opChmod:
+		fs.BufferFS.chmod(e.name, e.mode, req)
+	case opChown:
+		fs.BufferFS.chown(e.name, e.uid, e.gid, req)
+	case opTruncate:
+		fs.BufferFS.truncate(e.name, e.size, req)
+	case opUnlink:
+		fs.BufferFS.unlink(e.name, req)
+	case opRmdir:
+		fs.BufferFS.rmdir(e.name, req)
+	case opSymlink:
+		fs.BufferFS.symlink(e.other, e.name, req)
+	case opMkdir:
+		fs.BufferFS.mkdir(e.name, e.mode, req)
+	case opMknod:
+		fs.BufferFS.mknod(e.name, e.mode, e.flags, req)
+	case opCreate:
+		if f, code := fs.BufferFS.create(e.name, e.flags, e.mode, req); code == fuse.OK {
+			f.Release()
+		}
+	case opRename:
+		fs.BufferFS.rename(e.name, e.other, req)
+	case opLink:
+		fs.BufferFS.link(e.name, e.other, req)
+	case opSetXAttr:
+		fs.BufferFS.setXAttr(e.name, e.other, e.data, int(e.flags), req)
+	case opRemoveXAttr:
+		fs.BufferFS.removeXAttr(e.name, e.other, req)
+	case opUtimens:
+		fs.BufferFS.utimens(e.name, e.atime, e.mtime, req)
+	case opDiscardPath:
+		fs.BufferFS.discardPath(e.name, e.time)
+	case opLoadState:
+		r, err := fs.openState(e)
+		if err == nil {
+			err = fs.BufferFS.LoadState(r)
+			r.Close()
+		}
+		if err != nil {
+			log.Printf("Could not load the journaled state: %v", err)
+		}
+	case opCheckpoint:
+		fs.BufferFS.Checkpoint(e.name)
+	case opLoadCheckpoint:
+		r, err := os.Open(filepath.Join(fs.dir, filepath.Base(e.other)))
+		if err == nil {
+			err = fs.BufferFS.loadCheckpoint(e.name, r)
+			r.Close()
+		}
+		if err != nil {
+			log.Printf("Could not load the journaled checkpoint: %v", err)
+		}
+	case opRollback:
+		fs.BufferFS.RollbackTo(e.name)
+	}
+
+	if e.op < opWrite || e.op > opFileAllocate {
+		return
+	}
+	// Opening a file overlays it, but is not recorded
+	unlock := fs.BufferFS.Locked()
+	o, code := fs.OverlayFile(e.name, 0, req)
+	unlock()
+	if code != fuse.OK {
+		return
+	}
+	// Through a handle, which applies the rules it did when recorded
+	h := NewOverlayFH(o, syscall.O_RDWR|e.flags&syscall.O_APPEND, req.Context, fs.Wrapped)
+	h.caller = req.caller
+	defer h.Release()
+	switch e.op {
+	case opWrite:
+		h.Write(e.data, int64(e.off))
+	case opFileTruncate:
+		h.truncate(e.size, req.time)
+	case opFileChmod:
+		h.Chmod(e.mode)
+	case opFileChown:
+		h.Chown(e.uid, e.gid)
+	case opFileUtimens:
+		h.utimens(e.atime, e.mtime, req.time)
+	case opFileAllocate:
+		h.allocate(e.off, e.size, e.mode, req.time)
+	}
+}
+
+// Records the entry, then runs the operation of the request
+func (fs *JournalFS) record(e *journalEntry, req *request, op func() fuse.Status) fuse.Status {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.recordLocked(e, req, op)
+}
+
+func (fs *JournalFS) recordLocked(e *journalEntry, req *request, op func() fuse.Status) fuse.Status {
+	e.time = req.time
+	if req.caller != nil {
+		e.owner = req.Owner
+		e.groups = req.caller.supplementary()
+	}
+	// A single write, so that a crash of the process leaves either the
+	// whole entry or nothing in the page cache
+	if _, err := fs.file.Write(e.framed()); err != nil {
+		log.Printf("Could not write to the journal: %v", err)
+		return fuse.EIO
+	}
+	if fs.Sync {
+		if err := fs.file.Sync(); err != nil {
+			log.Printf("Could not sync the journal: %v", err)
+			return fuse.EIO
+		}
+	}
+	return op()
+}
+
+// The request of the operations that ploufs makes on its own
+func ownRequest() *request {
+	return &request{time: time.Now()}
+}
+
+// The entry, preceded by its length and its checksum
+func (e *journalEntry) framed() []byte {
+	data, _ := e.MarshalBinary()
+	buf := make([]byte, entryHeaderSize+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(data))
+	copy(buf[entryHeaderSize:], data)
+	return buf
+}
+
+// LoadState replaces the buffered changes by the ones of the state. The
+// journal is rewritten to start from this state, which is copied next to it
+// as it is read.
+func (fs *JournalFS) LoadState(r io.Reader) error {
+	file, err := ioutil.TempFile(fs.dir, statePrefix)
+	if err != nil {
+		return err
+	}
+	overlayed, err := decodeState(io.TeeReader(r, file))
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		if overlayed != nil {
+			overlayed.Clear()
+		}
+		os.Remove(file.Name())
+		return err
+	}
+
+	fs.lock.Lock()
+	stale := fs.BufferFS.replace(overlayed)
+	name := filepath.Base(file.Name())
+	e := &journalEntry{op: opLoadState, time: time.Now(), name: name}
+	err = fs.rewrite(e)
+	if err == nil {
+		fs.removeStates(name)
+	}
+	fs.lock.Unlock()
+
+	fs.invalidate(stale...)
+	return err
+}
+
+// Opens the state of an entry
+func (fs *JournalFS) openState(e *journalEntry) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(fs.dir, filepath.Base(e.name)))
+}
+
+// Removes the states that the journal does not use anymore
+func (fs *JournalFS) removeStates(keep ...string) {
+	names, _ := filepath.Glob(filepath.Join(fs.dir, statePrefix+"*"))
+	for _, name := range names {
+		kept := false
+		for _, k := range keep {
+			kept = kept || filepath.Base(name) == k
+		}
+		if !kept {
+			os.Remove(name)
+		}
+	}
+}
+
+// Writes a state next to the journal, and returns its name
+func (fs *JournalFS) writeState(save func(w io.Writer) error) (string, error) {
+	file, err := ioutil.TempFile(fs.dir, statePrefix)
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(file)
+	err = save(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return filepath.Base(file.Name()), nil
+}
+
+// Rewrites the journal as the states of the overlay and of the checkpoints,
+// in place of the operations which led to them. The caller holds the lock.
+func (fs *JournalFS) compact() error {
+	var entries []*journalEntry
+	var states []string
+	name, err := fs.writeState(fs.BufferFS.SaveState)
+	if err == nil {
+		states = append(states, name)
+		entries = append(entries, &journalEntry{op: opLoadState, time: time.Now(), name: name})
+	}
+	for _, checkpoint := range fs.BufferFS.Checkpoints() {
+		if err != nil {
+			break
+		}
+		checkpoint := checkpoint
+		name, err = fs.writeState(func(w io.Writer) error {
+			return fs.BufferFS.saveCheckpoint(checkpoint, w)
+		})
+		if err == nil {
+			states = append(states, name)
+			entries = append(entries, &journalEntry{op: opLoadCheckpoint, time: time.Now(), name: checkpoint, other: name})
+		}
+	}
+	if err == nil {
+		err = fs.rewrite(entries...)
+	}
+	if err != nil {
+		for _, name := range states {
+			os.Remove(filepath.Join(fs.dir, name))
+		}
+		return err
+	}
+	fs.removeStates(states...)
+	return nil
+}
+
+// Atomically replaces the journal by one holding the given entries
+func (fs *JournalFS) rewrite(entries ...*journalEntry) error {
+	name := filepath.Join(fs.dir, journalName)
+	tmp := name + ".tmp"
+	os.Remove(tmp)
+	file, err := openJournal(tmp)
+	if err != nil {
+		return err
+	}
+	content := []byte(journalMagic)
+	for _, e := range entries {
+		content = append(content, e.framed()...)
+	}
+	if _, err = file.Write(content); err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	fs.file.Close()
+	fs.file = file
+	return nil
+}
+
+// Empties the journal, once the changes are not buffered anymore
+func (fs *JournalFS) reset() {
+	if err := fs.file.Truncate(int64(len(journalMagic))); err != nil {
+		log.Printf("Could not reset the journal: %v", err)
+	}
+	fs.removeStates()
+}
+
+func (fs *JournalFS) Chmod(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	req := newRequest(context)
+	e := &journalEntry{op: opChmod, name: name, mode: mode}
+	return fs.record(e, req, func() fuse.Status {
+		return fs.BufferFS.chmod(name, mode, req)
+	})
+}
+
+func (fs *JournalFS) Chown(name string, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
+	req := newRequest(context)
+	e := &journalEntry{op: opChown, name: name, uid: uid, gid: gid}
+	return fs.record(e, req, func() fuse.Status {
+		return fs.BufferFS.chown(name, uid, gid, req)
+	})
+}
+
+func (fs *JournalFS) Truncate(name string, size uint64, context *fuse.Context) (code fuse.Status) {
+	req := newRequest(context)
+	e := &journalEntry{op: opTruncate, name: name, size: size}
+	return fs.record(e, req, func() fuse.Status {
+		return fs.BufferFS.truncate(name, size, req)
+	})
+}
+
+func (fs *JournalFS) Unlink(name string, context *fuse.Context) (code fuse.Status) {
+	req := newRequest(context)
+	e := &journalEntry{op: opUnlink, name: name}
+	return fs.record(e, req, func() fuse.Status {
+		return fs.BufferFS.unlink(name, req)
+	})
+}
+
+func (fs *JournalFS) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
+	req := newRequest(context)
+	e := &journalEntry{op: opRmdir, name: name}
+	return fs.record(e, req, func() fuse.Status {
+		return fs.BufferFS.rmdir(name, req)
+	})
+}
+
+func (fs *JournalFS) Symlink(target string, name string, context *fuse.Context) (code fuse.Status) {
+	req := newRequest(context)
+	e := &journalEntry{op: opSymlink, name: name, other: target}
+	return fs.record(e, req, func() fuse.Status {
+		return fs.BufferFS.symlink(target, name, req)
+	})
+}
+
+func (fs *JournalFS) Mkdir(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	req := newRequest(context)
+	e := &journalEntry{op: opMkdir, name: name, mode: mode}
+	return fs.record(e, req, func() fuse.Status {
+		return fs.BufferFS.mkdir(name, mode, req)
+	})
+}
+
+func (fs *JournalFS) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) (code fuse.Status) {
+	req := newRequest(context)
+	e := &journalEntry{op: opMknod, name: name, mode: mode, flags: dev}
+	return fs.record(e, req, func() fuse.Status {
+		return fs.BufferFS.mknod(name, mode, dev, req)
+	})
+}
+
+func (fs *JournalFS) Create(name string, flags uint32, mode uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
+	req := newRequest(context)
+	e := &journalEntry{op: opCreate, name: name, flags: flags, mode: mode}
+	code = fs.record(e, req, func() (code fuse.Status) {
+		file, code = fs.BufferFS.create(name, flags, mode, req)
+		return code
+	})
+	if code != fuse.OK {
+		return nil, code
+	}
+	return fs.journaled(file, flags, context), fuse.OK
+}
+
+func (fs *JournalFS) Open(name string, flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
+	// Opening a file overlays it: the file handles look for it while we
+	// hold the lock
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	req := newRequest(context)
+	open := func() (code fuse.Status) {
+		file, code = fs.BufferFS.open(name, flags, req)
+		return code
+	}
+	// Opening is not recorded, unless it truncates the file
+	if flags&syscall.O_TRUNC != 0 {
+		e := &journalEntry{op: opTruncate, name: name}
+		code = fs.recordLocked(e, req, open)
+	} else {
+		code = open()
+	}
+	if code != fuse.OK {
+		return nil, code
+	}
+	return fs.journaled(file, flags, context), fuse.OK
+}
+
+func (fs *JournalFS) Rename(oldPath string, newPath string, context *fuse.Context) (code fuse.Status) {
+	req := newRequest(context)
+	e := &journalEntry{op: opRename, name: oldPath, other: newPath}
+	return fs.record(e, req, func() fuse.Status {
+		return fs.BufferFS.rename(oldPath, newPath, req)
+	})
+}
+
+func (fs *JournalFS) Link(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
+	req := newRequest(context)
+	e := &journalEntry{op: opLink, name: oldName, other: newName}
+	return fs.record(e, req, func() fuse.Status {
+		return fs.BufferFS.link(oldName, newName, req)
+	})
+}
+
+func (fs *JournalFS) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	req := newRequest(context)
+	e := &journalEntry{op: opSetXAttr, name: name, other: attr, data: data, flags: uint32(flags)}
+	return fs.record(e, req, func() fuse.Status {
+		return fs.BufferFS.setXAttr(name, attr, data, flags, req)
+	})
+}
+
+func (fs *JournalFS) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	req := newRequest(context)
+	e := &journalEntry{op: opRemoveXAttr, name: name, other: attr}
+	return fs.record(e, req, func() fuse.Status {
+		return fs.BufferFS.removeXAttr(name, attr, req)
+	})
+}
+
+func (fs *JournalFS) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) (code fuse.Status) {
+	req := newRequest(context)
+	e := &journalEntry{op: opUtimens, name: name, atime: atime, mtime: mtime}
+	return fs.record(e, req, func() fuse.Status {
+		return fs.BufferFS.utimens(name, atime, mtime, req)
+	})
+}
+
+// Commit applies the buffered changes to the wrapped file system, then
+// empties the journal
+func (fs *JournalFS) Commit() (code fuse.Status) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	code = fs.BufferFS.Commit()
+	if code == fuse.OK {
+		fs.reset()
+	}
+	return code
+}
+
+// Discard throws away the buffered changes, and empties the journal
+func (fs *JournalFS) Discard() {
+	fs.lock.Lock()
+	fs.reset()
+	stale := fs.BufferFS.discard()
+	fs.lock.Unlock()
+
+	fs.invalidate(stale...)
+}
+
+func (fs *JournalFS) DiscardPath(name string) (code fuse.Status) {
+	req := ownRequest()
+	e := &journalEntry{op: opDiscardPath, name: name}
+	var stale []string
+	code = fs.record(e, req, func() (code fuse.Status) {
+		stale, code = fs.BufferFS.discardPath(name, req.time)
+		return code
+	})
+	fs.invalidate(stale...)
+	return code
+}
+
+// Checkpoint also compacts the journal: replaying it does not need the
+// operations before
+func (fs *JournalFS) Checkpoint(name string) (code fuse.Status) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	e := &journalEntry{op: opCheckpoint, name: name}
+	code = fs.recordLocked(e, ownRequest(), func() fuse.Status {
+		return fs.BufferFS.Checkpoint(name)
+	})
+	if code == fuse.OK {
+		if err := fs.compact(); err != nil {
+			log.Printf("Could not compact the journal: %v", err)
+		}
+	}
+	return code
+}
+
+func (fs *JournalFS) RollbackTo(name string) (code fuse.Status) {
+	e := &journalEntry{op: opRollback, name: name}
+	var stale []string
+	code = fs.record(e, ownRequest(), func() (code fuse.Status) {
+		stale, code = fs.BufferFS.rollbackTo(name)
+		return code
+	})
+	fs.invalidate(stale...)
+	return code
+}
+
+// A file handle that records its mutating operations in the journal
+type journalFH struct {
+	nodefs.File
+	fh      *OverlayFH
+	fs      *JournalFS
+	flags   uint32
+	context *fuse.Context
+}
+
+func (fs *JournalFS) journaled(file nodefs.File, flags uint32, context *fuse.Context) nodefs.File {
+	return &journalFH{
+		File:    file,
+		fh:      file.(*OverlayFH),
+		fs:      fs,
+		flags:   flags,
+		context: context,
+	}
+}
+
+// Records the entry, filling in the current path of the file. The
+// operations on files which are not reachable anymore do not need to be
+// recorded.
+func (h *journalFH) record(e *journalEntry, op func() fuse.Status) fuse.Status {
+	h.fs.lock.Lock()
+	defer h.fs.lock.Unlock()
+
+	req := &request{Context: h.context, caller: h.fh.caller, time: time.Now()}
+	e.time = req.time
+	unlock := h.fs.BufferFS.RLocked()
+	name, found := h.fs.Overlayed.Path(h.fh.OverlayPath)
+	unlock()
+	if !found {
+		return op()
+	}
+	e.name = name
+	return h.fs.recordLocked(e, req, op)
+}
+
+func (h *journalFH) Write(data []byte, off int64) (written uint32, code fuse.Status) {
+	// The write fails on read-only handles, but would not when replayed
+	if h.flags&syscall.O_ACCMODE == syscall.O_RDONLY {
+		return h.File.Write(data, off)
+	}
+	e := &journalEntry{op: opWrite, off: uint64(off), flags: h.flags & syscall.O_APPEND, data: data}
+	code = h.record(e, func() (code fuse.Status) {
+		written, code = h.File.Write(data, off)
+		return code
+	})
+	return written, code
+}
+
+func (h *journalFH) Truncate(size uint64) fuse.Status {
+	e := &journalEntry{op: opFileTruncate, size: size}
+	return h.record(e, func() fuse.Status {
+		return h.fh.truncate(size, e.time)
+	})
+}
+
+func (h *journalFH) Chmod(mode uint32) fuse.Status {
+	e := &journalEntry{op: opFileChmod, mode: mode}
+	return h.record(e, func() fuse.Status {
+		return h.File.Chmod(mode)
+	})
+}
+
+func (h *journalFH) Chown(uid uint32, gid uint32) fuse.Status {
+	e := &journalEntry{op: opFileChown, uid: uid, gid: gid}
+	return h.record(e, func() fuse.Status {
+		return h.File.Chown(uid, gid)
+	})
+}
+
+func (h *journalFH) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
+	e := &journalEntry{op: opFileUtimens, atime: atime, mtime: mtime}
+	return h.record(e, func() fuse.Status {
+		return h.fh.utimens(atime, mtime, e.time)
+	})
+}
+
+func (h *journalFH) Allocate(off uint64, size uint64, mode uint32) fuse.Status {
+	if h.flags&syscall.O_ACCMODE == syscall.O_RDONLY {
+		return h.File.Allocate(off, size, mode)
+	}
+	e := &journalEntry{op: opFileAllocate, off: off, size: size, mode: mode}
+	return h.record(e, func() fuse.Status {
+		return h.fh.allocate(off, size, mode, e.time)
+	})
+}
+
+// Fsync makes the journal durable: the data written so far survives a
+// crash of the machine
+func (h *journalFH) Fsync(flags int) fuse.Status {
+	if err := h.fs.file.Sync(); err != nil {
+		return fuse.EIO
+	}
+	return h.File.Fsync(flags)
+}
@@ -0,0 +1,145 @@
+// copyright 2016 Christophe-Marie Duquesne
+
+package fs
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// WriteLayer writes the pending changes as an OCI image layer: an
+// uncompressed tar where changed paths are stored in full, and removed paths
+// are represented by .wh. whiteouts.
+func (fs *BufferFS) WriteLayer(w io.Writer) error {
+	changes, code := fs.Changes()
+	if code != fuse.OK {
+		return statusError(code)
+	}
+
+	defer fs.Locked()()
+	context := ownContext()
+
+	layer, err := fs.upperLayer(changes, context)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(w)
+	tw := tar.NewWriter(out)
+	// The first name written of each file with several names
+	links := make(map[OverlayPath]string)
+	for _, name := range layer.names {
+		attr, code := fs.getAttr(name, context)
+		if code != fuse.OK {
+			return statusError(code)
+		}
+		// The root of the layer is implicit
+		if name != "" {
+			if err := fs.writeLayerEntry(tw, name, attr, links, context); err != nil {
+				return err
+			}
+		}
+		whiteouts := make([]string, 0)
+		if layer.opaque[name] {
+			whiteouts = append(whiteouts, opaqueWhiteout)
+		}
+		for _, base := range layer.whiteouts[name] {
+			whiteouts = append(whiteouts, whiteoutPrefix+base)
+		}
+		for _, whiteout := range whiteouts {
+			err := tw.WriteHeader(&tar.Header{
+				Name:     path.Join(name, whiteout),
+				Typeflag: tar.TypeReg,
+				Uid:      int(attr.Owner.Uid),
+				Gid:      int(attr.Owner.Gid),
+				ModTime:  attr.ModTime(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// Splits a device number, as encoded by the Linux kernel
+func deviceNumbers(rdev uint32) (major int64, minor int64) {
+	major = int64((rdev >> 8) & 0xfff)
+	minor = int64((rdev & 0xff) | ((rdev >> 12) & 0xfff00))
+	return major, minor
+}
+
+func (fs *BufferFS) writeLayerEntry(tw *tar.Writer, name string, attr *fuse.Attr, links map[OverlayPath]string, context *fuse.Context) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    int64(attr.Mode & 07777),
+		Uid:     int(attr.Owner.Uid),
+		Gid:     int(attr.Owner.Gid),
+		ModTime: attr.ModTime(),
+	}
+	// The other names of a file link to the first one
+	if f := fs.linkedName(name, attr); f != nil {
+		if first, ok := links[f]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			return tw.WriteHeader(hdr)
+		}
+		links[f] = name
+	}
+	switch {
+	case attr.IsDir():
+		hdr.Name += "/"
+		hdr.Typeflag = tar.TypeDir
+	case attr.IsSymlink():
+		target, code := fs.readlink(name, context)
+		if code != fuse.OK {
+			return statusError(code)
+		}
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = target
+	case attr.IsRegular():
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = int64(attr.Size)
+	case attr.Mode&syscall.S_IFMT == syscall.S_IFIFO:
+		hdr.Typeflag = tar.TypeFifo
+	case attr.Mode&syscall.S_IFMT == syscall.S_IFCHR:
+		hdr.Typeflag = tar.TypeChar
+		hdr.Devmajor, hdr.Devminor = deviceNumbers(attr.Rdev)
+	case attr.Mode&syscall.S_IFMT == syscall.S_IFBLK:
+		hdr.Typeflag = tar.TypeBlock
+		hdr.Devmajor, hdr.Devminor = deviceNumbers(attr.Rdev)
+	case attr.Mode&syscall.S_IFMT == syscall.S_IFSOCK:
+		// A tar cannot hold sockets: like tar, we leave them out
+		return nil
+	default:
+		return fmt.Errorf("%s: unsupported file type %o", name, attr.Mode&syscall.S_IFMT)
+	}
+	if !attr.IsSymlink() {
+		xattrs, code := fs.xattrs(name, context)
+		if code != fuse.OK {
+			return statusError(code)
+		}
+		for n, data := range xattrs {
+			if hdr.Xattrs == nil {
+				hdr.Xattrs = make(map[string]string)
+			}
+			hdr.Xattrs[n] = string(data)
+		}
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if attr.IsRegular() {
+		return fs.copyFile(tw, name, attr.Size, context)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+// copyright 2016 Christophe-Marie Duquesne
+
+package fs
+
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// The names of a file share its overlay. Those we overlay are in the tree,
+// those of the wrapped file system are recognized by their inode: once one
+// of them is overlayed, the others show the same overlay.
+
+// Returns the overlay that the name of a wrapped file shows if another of
+// its names was overlayed, or nil
+func (fs *BufferFS) linkedOverlay(a *fuse.Attr) *OverlayFile {
+	if !a.IsRegular() || a.Nlink < 2 || a.Ino == 0 {
+		return nil
+	}
+	return fs.links[a.Ino]
+}
+
+// Registers the overlay of a wrapped file, so that its other names show it.
+// The index holds a reference on the overlay.
+func (fs *BufferFS) addLinks(f *OverlayFile, a *fuse.Attr) {
+	if !a.IsRegular() || a.Nlink < 2 || a.Ino == 0 {
+		return
+	}
+	if previous := fs.links[a.Ino]; previous != f {
+		f.retain()
+		if previous != nil {
+			previous.release()
+		}
+		fs.links[a.Ino] = f
+	}
+}
+
+// Forgets the overlays of the wrapped files with several names
+func (fs *BufferFS) dropLinks() {
+	for _, f := range fs.links {
+		f.release()
+	}
+	fs.links = make(map[uint64]*OverlayFile)
+}
+
+// Rebuilds the index of the wrapped files with several names from what is
+// overlayed. The overlays that were only reachable by the names of the
+// wrapped file system are forgotten.
+func (fs *BufferFS) indexLinks() {
+	previous := fs.links
+	fs.links = make(map[uint64]*OverlayFile)
+	fs.Overlayed.Walk(func(name string, o OverlayPath) {
+		if f, ok := o.(*OverlayFile); ok && f.source != NoSource {
+			a := &fuse.Attr{}
+			f.GetAttr(a)
+			fs.addLinks(f, a)
+		}
+	})
+	for _, f := range previous {
+		f.release()
+	}
+}
+
+// Returns the overlay of the file at a path if it has other names, or nil.
+// Unlike linkedFile, it does not overlay anything.
+func (fs *BufferFS) linkedName(name string, a *fuse.Attr) OverlayPath {
+	if !a.IsRegular() || a.Nlink < 2 {
+		return nil
+	}
+	if o := fs.Overlayed.Get(name); o != nil {
+		return o
+	}
+	if f := fs.linkedOverlay(a); f != nil {
+		return f
+	}
+	return nil
+}
+
+// Returns the file at a path if it may have other names (overlaying it if
+// the wrapped file system has them), or nil
+func (fs *BufferFS) linkedFile(name string, req *request) (f *OverlayFile, code fuse.Status) {
+	o := fs.Overlayed.Get(name)
+	if o == nil {
+		a, code := fs.getAttr(name, req.Context)
+		if code != fuse.OK || !a.IsRegular() || a.Nlink < 2 {
+			return nil, fuse.OK
+		}
+		o, code = fs.OverlayFile(name, 0, req)
+		if code != fuse.OK {
+			return nil, code
+		}
+	}
+	f, _ = o.(*OverlayFile)
+	return f, fuse.OK
+}
+
+// Adds delta to the number of names of the file
+func (f *OverlayFile) addNlink(delta int) {
+	defer f.Locked()()
+	if n := int(f.Nlink()) + delta; n >= 0 {
+		f.SetNlink(uint32(n))
+	}
+}
+
+func (fs *BufferFS) Link(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
+	return fs.link(oldName, newName, newRequest(context))
+}
+
+func (fs *BufferFS) link(oldName string, newName string, req *request) (code fuse.Status) {
+	defer fs.Locked()()
+
+	if code := fs.checkSearch(oldName, req); code != fuse.OK {
+		return code
+	}
+	attr, code := fs.getAttr(oldName, req.Context)
+	if code != fuse.OK {
+		return code
+	}
+	if attr.IsDir() {
+		return fuse.EPERM
+	}
+	if !attr.IsRegular() {
+		// We cannot share the overlay of the other types of files
+		return fuse.ENOSYS
+	}
+	if code := fs.checkAdd(newName, req); code != fuse.OK {
+		return code
+	}
+	if _, code := fs.getAttr(newName, req.Context); code != fuse.ENOENT {
+		if code == fuse.OK {
+			code = fuse.ToStatus(syscall.EEXIST)
+		}
+		return code
+	}
+
+	dir, base := pathSplit(newName)
+	parent, code := fs.OverlayDir(dir, 0, req)
+	if code != fuse.OK {
+		return code
+	}
+	o, code := fs.OverlayFile(oldName, 0, req)
+	if code != fuse.OK {
+		return code
+	}
+	o.(*OverlayFile).addNlink(1)
+	fs.Overlayed.Set(newName, o)
+	parent.AddEntry(attr.Mode, base, req.time)
+	return fuse.OK
+}
+
+// Returns the name under which each overlayed file is committed: its source
+// if it kept this name, or else the first of its names. Its other names are
+// links to it.
+func (fs *BufferFS) primaryNames(names []string) map[*OverlayFile]string {
+	primary := make(map[*OverlayFile]string)
+	for _, name := range names {
+		f, ok := fs.Overlayed.Get(name).(*OverlayFile)
+		if !ok {
+			continue
+		}
+		if _, seen := primary[f]; !seen || name == f.source {
+			primary[f] = name
+		}
+	}
+	return primary
+}
+
+// Makes name a link to the committed file first, unless it already is one
+func commitLink(first string, name string, wrapped pathfs.FileSystem, context *fuse.Context) (code fuse.Status) {
+	target, code := wrapped.GetAttr(first, context)
+	if code != fuse.OK {
+		return code
+	}
+	existing, code := wrapped.GetAttr(name, context)
+	if code == fuse.OK {
+		if existing.Ino == target.Ino {
+			return fuse.OK
+		}
+		code = removeAll(name, wrapped, context)
+		if code != fuse.OK {
+			return code
+		}
+	}
+	return wrapped.Link(first, name, context)
+}
@@ -877,3 +877,331 @@ func TestUtime(t *testing.T) {
 	}
 	TestAllImplem(t, f)
 }
+
+//-----------
+// Fallocate
+//-----------
+
+// Calls fallocate on the file. The native file system may not support all
+// the modes, and the fuse module of the kernel does not forward the collapse
+// and insert ranges; they return EOPNOTSUPP and we skip them
+// (TestCollapseWrappedContent calls BufferFS directly).
+func fallocate(fs FSImplem, t *T, name string, mode uint32, off int64, size int64) (skip bool, err error) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("[%v] Open(%s): %v\n", fs, name, err)
+	}
+	defer f.Close()
+	err = syscall.Fallocate(int(f.Fd()), mode, off, size)
+	return err == syscall.EOPNOTSUPP, err
+}
+
+// Checks the content of the file, after fallocate
+func checkFallocated(fs FSImplem, t *T, name string, expected []byte) {
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatalf("[%v] ReadFile(%s): %v\n", fs, name, err)
+	}
+	if err := t.CompareSlices(expected, content); err != nil {
+		t.Fatalf("[%v] After fallocate(%s): %v\n", fs, name, err)
+	}
+}
+
+func TestFallocateExtend(t *testing.T) {
+	f := func(fs FSImplem, t *T) {
+		name := fs.Root() + "/file"
+		data := []byte("some data")
+		t.WriteFile(name, data, 0700)
+
+		skip, err := fallocate(fs, t, name, 0, 4, 100)
+		if skip {
+			return
+		}
+		if err != nil {
+			t.Fatalf(
+				"[%v] Fallocate(%s): expected no error, got %v\n",
+				fs, name, err)
+		}
+
+		// man 2 fallocate
+		// If the size of the file is less than offset+len, then the file
+		// is increased to this size; otherwise the file size is left
+		// unchanged.
+		expected := make([]byte, 104)
+		copy(expected, data)
+		checkFallocated(fs, t, name, expected)
+	}
+	TestAllImplem(t, f)
+}
+
+func TestFallocateKeepSize(t *testing.T) {
+	f := func(fs FSImplem, t *T) {
+		name := fs.Root() + "/file"
+		data := []byte("some data")
+		t.WriteFile(name, data, 0700)
+
+		skip, err := fallocate(fs, t, name, fallocKeepSize, 4, 100)
+		if skip {
+			return
+		}
+		if err != nil {
+			t.Fatalf(
+				"[%v] Fallocate(%s): expected no error, got %v\n",
+				fs, name, err)
+		}
+
+		// man 2 fallocate
+		// If the FALLOC_FL_KEEP_SIZE flag is specified in mode, [...] the
+		// file size will not be changed
+		checkFallocated(fs, t, name, data)
+	}
+	TestAllImplem(t, f)
+}
+
+func TestFallocatePunchHole(t *testing.T) {
+	f := func(fs FSImplem, t *T) {
+		name := fs.Root() + "/file"
+		t.WriteFile(name, []byte("some data"), 0700)
+
+		skip, err := fallocate(fs, t, name, fallocPunchHole|fallocKeepSize, 2, 100)
+		if skip {
+			return
+		}
+		if err != nil {
+			t.Fatalf(
+				"[%v] Fallocate(%s): expected no error, got %v\n",
+				fs, name, err)
+		}
+
+		// man 2 fallocate
+		// Within the specified range, partial filesystem blocks are
+		// zeroed, and whole filesystem blocks are removed from the file.
+		checkFallocated(fs, t, name, []byte("so\x00\x00\x00\x00\x00\x00\x00"))
+	}
+	TestAllImplem(t, f)
+}
+
+func TestFallocatePunchHoleEOPNOTSUPP(t *testing.T) {
+	f := func(fs FSImplem, t *T) {
+		name := fs.Root() + "/file"
+		t.WriteFile(name, []byte("some data"), 0700)
+
+		// man 2 fallocate
+		// The FALLOC_FL_PUNCH_HOLE flag must be ORed with
+		// FALLOC_FL_KEEP_SIZE in mode
+		_, err := fallocate(fs, t, name, fallocPunchHole, 2, 2)
+		expect := syscall.EOPNOTSUPP
+		if err != expect {
+			t.Fatalf(
+				"[%v] Fallocate(%s): expected '%v', got '%v'\n",
+				fs, name, expect, err)
+		}
+	}
+	TestAllImplem(t, f)
+}
+
+func TestFallocateZeroRange(t *testing.T) {
+	f := func(fs FSImplem, t *T) {
+		name := fs.Root() + "/file"
+		t.WriteFile(name, []byte("some data"), 0700)
+
+		skip, err := fallocate(fs, t, name, fallocZeroRange, 5, 7)
+		if skip {
+			return
+		}
+		if err != nil {
+			t.Fatalf(
+				"[%v] Fallocate(%s): expected no error, got %v\n",
+				fs, name, err)
+		}
+
+		// man 2 fallocate
+		// Zeroing is done within the filesystem preferably by converting
+		// the range into unwritten extents. [...] If FALLOC_FL_KEEP_SIZE
+		// is not set, the file size grows.
+		checkFallocated(fs, t, name, []byte("some \x00\x00\x00\x00\x00\x00\x00"))
+	}
+	TestAllImplem(t, f)
+}
+
+func TestFallocateCollapseRange(t *testing.T) {
+	f := func(fs FSImplem, t *T) {
+		name := fs.Root() + "/file"
+		data := make([]byte, 3*fallocBlockSize)
+		for i := range data {
+			data[i] = byte(i / fallocBlockSize)
+		}
+		t.WriteFile(name, data, 0700)
+
+		skip, err := fallocate(fs, t, name, fallocCollapseRange, fallocBlockSize, fallocBlockSize)
+		if skip {
+			return
+		}
+		if err != nil {
+			t.Fatalf(
+				"[%v] Fallocate(%s): expected no error, got %v\n",
+				fs, name, err)
+		}
+
+		// man 2 fallocate
+		// The contents of the file starting at the location offset+len
+		// will be appended at the location offset, and the file will be
+		// len bytes smaller.
+		expected := append(data[:fallocBlockSize:fallocBlockSize], data[2*fallocBlockSize:]...)
+		checkFallocated(fs, t, name, expected)
+	}
+	TestAllImplem(t, f)
+}
+
+func TestFallocateCollapseRangeEINVAL(t *testing.T) {
+	f := func(fs FSImplem, t *T) {
+		name := fs.Root() + "/file"
+		t.WriteFile(name, make([]byte, 2*fallocBlockSize), 0700)
+
+		// man 2 fallocate
+		// If the region specified by offset plus len reaches or passes
+		// the end of file, an error is returned
+		skip, err := fallocate(fs, t, name, fallocCollapseRange, fallocBlockSize, fallocBlockSize)
+		if skip {
+			return
+		}
+		expect := syscall.EINVAL
+		if err != expect {
+			t.Fatalf(
+				"[%v] Fallocate(%s): expected '%v', got '%v'\n",
+				fs, name, expect, err)
+		}
+	}
+	TestAllImplem(t, f)
+}
+
+func TestFallocateInsertRange(t *testing.T) {
+	f := func(fs FSImplem, t *T) {
+		name := fs.Root() + "/file"
+		data := make([]byte, 2*fallocBlockSize)
+		for i := range data {
+			data[i] = byte(1 + i/fallocBlockSize)
+		}
+		t.WriteFile(name, data, 0700)
+
+		skip, err := fallocate(fs, t, name, fallocInsertRange, fallocBlockSize, fallocBlockSize)
+		if skip {
+			return
+		}
+		if err != nil {
+			t.Fatalf(
+				"[%v] Fallocate(%s): expected no error, got %v\n",
+				fs, name, err)
+		}
+
+		// man 2 fallocate
+		// The space is inserted starting at offset and of length len
+		// bytes. [...] A hole is created in the file.
+		expected := make([]byte, 3*fallocBlockSize)
+		copy(expected, data[:fallocBlockSize])
+		copy(expected[2*fallocBlockSize:], data[fallocBlockSize:])
+		checkFallocated(fs, t, name, expected)
+	}
+	TestAllImplem(t, f)
+}
+
+//-------------------------
+// Directory times and links
+//-------------------------
+
+func nlinkOf(fs FSImplem, t *T, name string) uint64 {
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatalf("[%v] Stat(%s): %v\n", fs, name, err)
+	}
+	return uint64(info.Sys().(*syscall.Stat_t).Nlink)
+}
+
+func TestMkdirNlink(t *testing.T) {
+	f := func(fs FSImplem, t *T) {
+		dir := fs.Root() + "/dir"
+		t.Mkdir(dir, 0755)
+
+		// A new directory is linked from its parent and from itself
+		if n := nlinkOf(fs, t, dir); n != 2 {
+			t.Fatalf(
+				"[%v] After mkdir(%s): expected 2 links, got %v\n",
+				fs, dir, n)
+		}
+
+		// Each subdirectory links to its parent with ..
+		t.Mkdir(dir+"/sub", 0755)
+		t.WriteFile(dir+"/file", []byte("some data"), 0700)
+		if n := nlinkOf(fs, t, dir); n != 3 {
+			t.Fatalf(
+				"[%v] After mkdir(%s/sub): expected 3 links, got %v\n",
+				fs, dir, n)
+		}
+
+		if err := os.Rename(dir+"/sub", fs.Root()+"/sub"); err != nil {
+			t.Fatalf("[%v] Rename(%s/sub): %v\n", fs, dir, err)
+		}
+		if n := nlinkOf(fs, t, dir); n != 2 {
+			t.Fatalf(
+				"[%v] After moving %s/sub away: expected 2 links, got %v\n",
+				fs, dir, n)
+		}
+		if err := os.Remove(fs.Root() + "/sub"); err != nil {
+			t.Fatalf("[%v] Rmdir(%s/sub): %v\n", fs, fs.Root(), err)
+		}
+		if n := nlinkOf(fs, t, fs.Root()); n != 3 {
+			t.Fatalf(
+				"[%v] After rmdir(%s/sub): expected 3 links, got %v\n",
+				fs, fs.Root(), n)
+		}
+	}
+	TestAllImplem(t, f)
+}
+
+func TestParentModTime(t *testing.T) {
+	f := func(fs FSImplem, t *T) {
+		dir := fs.Root() + "/dir"
+		t.Mkdir(dir, 0755)
+
+		// Each operation must change the modification time of the
+		// directory
+		ops := []struct {
+			name string
+			op   func() error
+		}{
+			{"create", func() error {
+				return ioutil.WriteFile(dir+"/file", []byte("some data"), 0700)
+			}},
+			{"rename", func() error {
+				return os.Rename(dir+"/file", dir+"/renamed")
+			}},
+			{"unlink", func() error {
+				return os.Remove(dir + "/renamed")
+			}},
+			{"mkdir", func() error {
+				return os.Mkdir(dir+"/sub", 0755)
+			}},
+			{"rmdir", func() error {
+				return os.Remove(dir + "/sub")
+			}},
+		}
+		for _, o := range ops {
+			info, _ := os.Stat(dir)
+			modTime := info.ModTime()
+
+			// Sleeping a bit to leave a chance to modtime to change
+			time.Sleep(time.Second / 100)
+			if err := o.op(); err != nil {
+				t.Fatalf("[%v] %s in %s: %v\n", fs, o.name, dir, err)
+			}
+
+			info, _ = os.Stat(dir)
+			if info.ModTime().Equal(modTime) {
+				t.Fatalf(
+					"[%v] After %s in %s: expected different modtime",
+					fs, o.name, dir)
+			}
+		}
+	}
+	TestAllImplem(t, f)
+}
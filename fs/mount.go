@@ -15,9 +15,36 @@ import (
 	"github.com/hanwen/go-fuse/fuse/pathfs"
 )
 
-func Mount(orig string, mountpoint string) {
+// Options of Mount
+type Options struct {
+	// If not empty, the buffered changes are recorded in this directory,
+	// and restored from it on the next mount
+	Journal string
+	// Whether the journal is synced after each operation, so that the
+	// changes also survive a crash of the machine
+	JournalSync bool
+	// The buffered data past MemoryBudget bytes goes to files of Scratch
+	// (the temporary directory if empty). A negative budget means no limit.
+	Scratch      string
+	MemoryBudget int64
+}
+
+// Mount mounts a BufferFS of orig on mountpoint
+func Mount(orig string, mountpoint string, opts Options) {
+	SetScratch(opts.Scratch, opts.MemoryBudget)
 	bindfs := pathfs.NewLoopbackFileSystem(orig)
 	bufferfs := NewBufferFS(bindfs)
+	mounted := bufferfs
+	if opts.Journal != "" {
+		journalfs, err := NewJournalFS(bufferfs.(*BufferFS), opts.Journal)
+		if err != nil {
+			fmt.Printf("Journal fail: %v\n", err)
+			os.Exit(1)
+		}
+		defer journalfs.Close()
+		journalfs.Sync = opts.JournalSync
+		mounted = journalfs
+	}
 	envVarExists := func(key string) bool { return os.Getenv(key) != "" }
 	absolutePath := func(name string) string {
 		res, _ := filepath.Abs(name)
@@ -34,7 +61,7 @@ func Mount(orig string, mountpoint string) {
 		ClientInodes: envVarExists("ENABLE_LINKS"),
 	}
 	//pathFs := pathfs.NewPathNodeFs(bindfs, pathNodeFsOpts)
-	pathFs := pathfs.NewPathNodeFs(bufferfs, pathNodeFsOpts)
+	pathFs := pathfs.NewPathNodeFs(mounted, pathNodeFsOpts)
 	mountOpts := &fuse.MountOptions{
 		Options:        envVarAsTokens("MOUNT_OPTIONS"),
 		Name:           path.Base(os.Args[0]),
@@ -53,6 +80,13 @@ func Mount(orig string, mountpoint string) {
 		fmt.Printf("Mount fail: %v\n", err)
 		os.Exit(1)
 	}
+	control, err := ListenControl(mountpoint)
+	if err != nil {
+		fmt.Printf("Control socket fail: %v\n", err)
+		os.Exit(1)
+	}
+	defer control.Close()
+	go ServeControl(mounted.(Controllable), control)
 	fmt.Println("Mounted!")
 	state.Serve()
 }
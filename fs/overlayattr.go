@@ -1,29 +1,44 @@
 package fs
 
 import (
+	"sort"
+	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 )
 
+// Flags of setxattr(2)
+const (
+	xattrCreate  = 0x1
+	xattrReplace = 0x2
+)
+
 type OverlayAttr interface {
 	GetAttr(out *fuse.Attr) fuse.Status
 	Chown(uid uint32, gid uint32) fuse.Status
 	Chmod(perms uint32) fuse.Status
 	Utimens(atime *time.Time, mtime *time.Time) fuse.Status
+	Touch(atime *time.Time, mtime *time.Time, now time.Time) fuse.Status
 	Size() uint64
 	SetSize(sz uint64)
+	Nlink() uint32
+	SetNlink(n uint32)
+	SetRdev(rdev uint32)
+	XAttrs
 }
 
 type DefaultOverlayAttr struct {
 	attr *fuse.Attr
+	// The extended attributes
+	xattrs map[string][]byte
 }
 
 func NewOverlayAttr(fs *BufferFS, path string, mode uint32, context *fuse.Context) OverlayAttr {
 	// If the file exists, gets its existing attr from GetAttr()
 	attr, status := fs.GetAttr(path, context)
 	if status != fuse.OK {
-		return NewOverlayAttrFromScratch(mode, context.Uid, context.Gid)
+		return NewOverlayAttrFromScratch(mode, context.Uid, context.Gid, time.Now())
 	} else {
 		return NewOverlayAttrFromExisting(attr)
 	}
@@ -35,7 +50,8 @@ func NewOverlayAttrFromExisting(attr *fuse.Attr) OverlayAttr {
 	}
 }
 
-func NewOverlayAttrFromScratch(mode, uid, gid uint32) OverlayAttr {
+// The times are those of the operation creating the path
+func NewOverlayAttrFromScratch(mode, uid, gid uint32, now time.Time) OverlayAttr {
 	fuseOwner := fuse.Owner{
 		Uid: uid,
 		Gid: gid,
@@ -57,7 +73,6 @@ func NewOverlayAttrFromScratch(mode, uid, gid uint32) OverlayAttr {
 		Blksize:   0,
 		Padding:   0,
 	}
-	now := time.Now()
 	attr.SetTimes(&now, &now, &now)
 	return &DefaultOverlayAttr{
 		attr: &attr,
@@ -72,6 +87,18 @@ func (a *DefaultOverlayAttr) SetSize(sz uint64) {
 	a.attr.Size = sz
 }
 
+func (a *DefaultOverlayAttr) Nlink() uint32 {
+	return a.attr.Nlink
+}
+
+func (a *DefaultOverlayAttr) SetNlink(n uint32) {
+	a.attr.Nlink = n
+}
+
+func (a *DefaultOverlayAttr) SetRdev(rdev uint32) {
+	a.attr.Rdev = rdev
+}
+
 func (a *DefaultOverlayAttr) GetAttr(out *fuse.Attr) (code fuse.Status) {
 	out.Ino = a.attr.Ino
 	out.Size = a.attr.Size
@@ -92,13 +119,18 @@ func (a *DefaultOverlayAttr) GetAttr(out *fuse.Attr) (code fuse.Status) {
 }
 
 func (a *DefaultOverlayAttr) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
-	now := time.Now()
+	return a.Touch(atime, mtime, time.Now())
+}
+
+// Touch sets the times which are not nil, and the change time to the time of
+// the operation
+func (a *DefaultOverlayAttr) Touch(atime *time.Time, mtime *time.Time, now time.Time) fuse.Status {
 	a.attr.SetTimes(atime, mtime, &now)
 	return fuse.OK
 }
 
 func (a *DefaultOverlayAttr) Chmod(mode uint32) fuse.Status {
-	a.attr.Mode = (a.attr.Mode & 0xfe00) | mode
+	a.attr.Mode = (a.attr.Mode & syscall.S_IFMT) | mode&07777
 	return fuse.OK
 }
 
@@ -107,3 +139,46 @@ func (a *DefaultOverlayAttr) Chown(uid uint32, gid uint32) fuse.Status {
 	a.attr.Gid = gid
 	return fuse.OK
 }
+
+func (a *DefaultOverlayAttr) GetXAttr(name string) (data []byte, code fuse.Status) {
+	data, ok := a.xattrs[name]
+	if !ok {
+		return nil, fuse.ENODATA
+	}
+	return data, fuse.OK
+}
+
+// The flags are those of setxattr(2)
+func (a *DefaultOverlayAttr) SetXAttr(name string, data []byte, flags int) fuse.Status {
+	_, ok := a.xattrs[name]
+	if ok && flags&xattrCreate != 0 {
+		return fuse.ToStatus(syscall.EEXIST)
+	}
+	if !ok && flags&xattrReplace != 0 {
+		return fuse.ENODATA
+	}
+	if a.xattrs == nil {
+		a.xattrs = make(map[string][]byte)
+	}
+	// The caller may reuse its buffer
+	a.xattrs[name] = append([]byte(nil), data...)
+	return fuse.OK
+}
+
+// The names are sorted
+func (a *DefaultOverlayAttr) ListXAttr() []string {
+	names := make([]string, 0, len(a.xattrs))
+	for name := range a.xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (a *DefaultOverlayAttr) RemoveXAttr(name string) fuse.Status {
+	if _, ok := a.xattrs[name]; !ok {
+		return fuse.ENODATA
+	}
+	delete(a.xattrs, name)
+	return fuse.OK
+}
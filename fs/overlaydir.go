@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 )
@@ -14,48 +15,140 @@ type OverlayDir struct {
 	File
 	Symlink
 	OverlayAttr
+	// The directory of the wrapped file system whose content shows in the
+	// entries that are not overlayed, or NoSource
+	source  string
 	entries []fuse.DirEntry
-	lock    sync.Mutex
+	// The position of each entry by name, built on the first lookup
+	index map[string]int
+	// Whether entries may be seen by someone else (a checkpoint, or a
+	// reader of the directory). It is then copied before being modified.
+	shared bool
+	// The lookups share the lock of the file system, and modify the index
+	// and shared: they take this one
+	lock sync.Mutex
 }
 
-func NewOverlayDir(attr OverlayAttr, entries []fuse.DirEntry) OverlayPath {
-	return &OverlayDir{
+func NewOverlayDir(attr OverlayAttr, source string, entries []fuse.DirEntry) OverlayPath {
+	d := &OverlayDir{
 		File:        NewDefaultFile(),
 		Symlink:     NewDefaultSymlink(),
 		OverlayAttr: attr,
+		source:      source,
 		entries:     entries,
 	}
+	// A directory is linked from its parent, from itself (.) and from
+	// each of its subdirectories (..)
+	nlink := uint32(2)
+	for _, e := range entries {
+		if isDirMode(e.Mode) {
+			nlink++
+		}
+	}
+	attr.SetNlink(nlink)
+	return d
+}
+
+func isDirMode(mode uint32) bool {
+	return mode&syscall.S_IFMT == syscall.S_IFDIR
+}
+
+// The entries changed: so do the times of the directory
+func (d *OverlayDir) touch(now time.Time) {
+	d.OverlayAttr.Touch(nil, &now, now)
+}
+
+func (d *OverlayDir) Locked() (unlock func()) {
+	d.lock.Lock()
+	return func() { d.lock.Unlock() }
 }
 
-func (d *OverlayDir) AddEntry(mode uint32, name string) (code fuse.Status) {
-	for _, e := range d.entries {
-		if e.Name == name {
-			return fuse.ToStatus(syscall.EEXIST)
+func (d *OverlayDir) names() map[string]int {
+	if d.index == nil {
+		d.index = make(map[string]int, len(d.entries))
+		for i, e := range d.entries {
+			d.index[e.Name] = i
 		}
 	}
+	return d.index
+}
+
+// Makes the entries ours before modifying them
+func (d *OverlayDir) own() {
+	if d.shared {
+		d.entries = append([]fuse.DirEntry(nil), d.entries...)
+		d.shared = false
+	}
+}
+
+func (d *OverlayDir) Lookup(name string) (mode uint32, code fuse.Status) {
+	defer d.Locked()()
+
+	i, ok := d.names()[name]
+	if !ok {
+		return 0, fuse.ENOENT
+	}
+	return d.entries[i].Mode, fuse.OK
+}
+
+func (d *OverlayDir) AddEntry(mode uint32, name string, now time.Time) (code fuse.Status) {
+	defer d.Locked()()
+
+	if _, ok := d.names()[name]; ok {
+		return fuse.ToStatus(syscall.EEXIST)
+	}
 	e := fuse.DirEntry{
 		Mode: mode,
 		Name: name,
 	}
+	d.own()
 	d.entries = append(d.entries, e)
+	d.index[name] = len(d.entries) - 1
+	if isDirMode(mode) {
+		d.SetNlink(d.Nlink() + 1)
+	}
+	d.touch(now)
 	return fuse.OK
 }
 
-func (d *OverlayDir) RemoveEntry(name string) (code fuse.Status) {
-	entries := make([]fuse.DirEntry, 0, len(d.entries))
-	for _, e := range d.entries {
-		if e.Name != name {
-			entries = append(entries, e)
-		}
+func (d *OverlayDir) RemoveEntry(name string, now time.Time) (code fuse.Status) {
+	defer d.Locked()()
+
+	i, ok := d.names()[name]
+	if !ok {
+		return fuse.OK
 	}
-	d.entries = entries
+	// The order of the entries does not matter: the last one takes the
+	// place of the removed one
+	d.own()
+	if isDirMode(d.entries[i].Mode) {
+		d.SetNlink(d.Nlink() - 1)
+	}
+	last := len(d.entries) - 1
+	d.entries[i] = d.entries[last]
+	d.index[d.entries[i].Name] = i
+	d.entries = d.entries[:last]
+	delete(d.index, name)
+	d.touch(now)
 	return fuse.OK
 }
 
 func (d *OverlayDir) Entries(context *fuse.Context) (stream []fuse.DirEntry, code fuse.Status) {
+	defer d.Locked()()
+
+	d.shared = true
 	return d.entries, fuse.OK
 }
 
+// Replaces the entries by entries which may be seen by someone else
+func (d *OverlayDir) setEntries(entries []fuse.DirEntry) {
+	defer d.Locked()()
+
+	d.entries = entries
+	d.index = nil
+	d.shared = true
+}
+
 func (d *OverlayDir) String() string {
 	return fmt.Sprintf("OverlayDir{%v}", d.entries)
 }
@@ -1,28 +1,117 @@
 package fs
 
 import (
+	"syscall"
+	"time"
+
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
 )
 
 type OverlayFH struct {
 	OverlayPath
+	// The flags of open(2)
+	flags   uint32
 	context *fuse.Context
-	fs      pathfs.FileSystem
+	// Who opened the file, for the permission checks
+	caller *caller
+	fs     pathfs.FileSystem
 }
 
-func NewOverlayFH(o OverlayPath, context *fuse.Context, fs pathfs.FileSystem) *OverlayFH {
+// The handle must be released, so that the file can close its source
+func NewOverlayFH(o OverlayPath, flags uint32, context *fuse.Context, fs pathfs.FileSystem) *OverlayFH {
+	if f, ok := o.(*OverlayFile); ok {
+		f.hold()
+	}
 	return &OverlayFH{
 		OverlayPath: o,
+		flags:       flags,
 		context:     context,
+		caller:      newCaller(context),
 		fs:          fs,
 	}
 }
 
+func (h *OverlayFH) readable() bool {
+	return h.flags&syscall.O_ACCMODE != syscall.O_WRONLY
+}
+
+func (h *OverlayFH) writable() bool {
+	return h.flags&syscall.O_ACCMODE != syscall.O_RDONLY
+}
+
 func (h *OverlayFH) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	if !h.readable() {
+		return nil, fuse.Status(syscall.EBADF)
+	}
 	return h.OverlayPath.Read(dest, off, h.context, h.fs)
 }
 
+// With O_APPEND, the offset is ignored: the data goes to the end of the file
 func (h *OverlayFH) Write(data []byte, off int64) (uint32, fuse.Status) {
+	if !h.writable() {
+		return 0, fuse.Status(syscall.EBADF)
+	}
+	if f, ok := h.OverlayPath.(*OverlayFile); ok && h.flags&syscall.O_APPEND != 0 {
+		return f.Append(data, h.context)
+	}
 	return h.OverlayPath.Write(data, off, h.context, h.fs)
 }
+
+// Chmod and Chown apply the same rules as on paths
+
+func (h *OverlayFH) Chmod(mode uint32) fuse.Status {
+	attr := fuse.Attr{}
+	h.OverlayPath.GetAttr(&attr)
+	mode, code := h.caller.chmod(&attr, mode)
+	if code != fuse.OK {
+		return code
+	}
+	return h.OverlayPath.Chmod(mode)
+}
+
+func (h *OverlayFH) Chown(uid uint32, gid uint32) fuse.Status {
+	attr := fuse.Attr{}
+	h.OverlayPath.GetAttr(&attr)
+	uid, gid, code := h.caller.chown(&attr, uid, gid)
+	if code != fuse.OK {
+		return code
+	}
+	return setOwner(h.OverlayPath, &attr, uid, gid)
+}
+
+func (h *OverlayFH) Allocate(off uint64, size uint64, mode uint32) fuse.Status {
+	return h.allocate(off, size, mode, time.Now())
+}
+
+// The operations changing the times also have a variant taking the time of
+// the operation, which the journal replays
+
+func (h *OverlayFH) allocate(off uint64, size uint64, mode uint32, now time.Time) fuse.Status {
+	if !h.writable() {
+		return fuse.Status(syscall.EBADF)
+	}
+	if f, ok := h.OverlayPath.(*OverlayFile); ok {
+		return f.allocate(off, size, mode, now, h.context, h.fs)
+	}
+	return h.OverlayPath.Allocate(off, size, mode, h.context, h.fs)
+}
+
+func (h *OverlayFH) Truncate(size uint64) fuse.Status {
+	return h.truncate(size, time.Now())
+}
+
+func (h *OverlayFH) truncate(size uint64, now time.Time) fuse.Status {
+	if f, ok := h.OverlayPath.(*OverlayFile); ok {
+		return f.truncate(size, now, h.context)
+	}
+	return h.OverlayPath.Truncate(size)
+}
+
+func (h *OverlayFH) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
+	return h.utimens(atime, mtime, time.Now())
+}
+
+func (h *OverlayFH) utimens(atime *time.Time, mtime *time.Time, now time.Time) fuse.Status {
+	return h.OverlayPath.Touch(atime, mtime, now)
+}
@@ -4,11 +4,12 @@ package fs
 
 import (
 	"fmt"
-	"log"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
 )
 
@@ -16,14 +17,33 @@ const (
 	NoSource = "/"
 )
 
+// Modes of fallocate(2)
+const (
+	fallocKeepSize      = 0x01
+	fallocPunchHole     = 0x02
+	fallocCollapseRange = 0x08
+	fallocZeroRange     = 0x10
+	fallocInsertRange   = 0x20
+	// Collapsing and inserting work on whole blocks of the file system. We
+	// ask for those of the common ones.
+	fallocBlockSize = 4096
+)
+
 type OverlayFile struct {
 	File
 	Dir
 	Symlink
 	OverlayAttr
 	source string
-	slices []*FileSlice
+	slices extents
 	lock   sync.Mutex
+	// The source, opened on the first read while file handles are open on
+	// us, and closed with the last of them
+	sourceFile nodefs.File
+	handles    int
+	// The names, checkpoints and handles referencing the file. The slices
+	// are released with the last of them.
+	refs int
 }
 
 func NewOverlayFile(attr OverlayAttr, source string) OverlayPath {
@@ -46,51 +66,47 @@ func (f *OverlayFile) String() string {
 }
 
 func (f *OverlayFile) Truncate(offset uint64) fuse.Status {
+	return f.truncate(offset, time.Now(), nil)
+}
+
+// Truncates at the time of the operation, for the caller of ctx
+func (f *OverlayFile) truncate(offset uint64, now time.Time, ctx *fuse.Context) fuse.Status {
 	defer f.Locked()()
 
+	f.dropPrivileges(ctx)
 	if offset == f.Size() {
 		return fuse.OK
 	}
 
 	off := int64(offset)
-	slices := make([]*FileSlice, 0, len(f.slices)+1)
-	// Remove all the slices after the truncation
-	for _, s := range f.slices {
-		// the slice is entirely before the truncation
-		if s.End() <= off {
-			slices = append(slices, s)
-		}
-		// this slice is truncated but not empty (no point in having an
-		// empty slice)
-		if s.Beg() < off && s.End() > off {
-			// cut the slice
-			slices = append(slices, s.Truncated(off))
-		}
-	}
+	// Remove everything after the truncation
+	slices := f.slices.Truncate(off)
 
 	if offset > f.Size() {
 		// The cut strictly extends the slice. man 2 truncate says we
-		// need to extend the file with 0. We add a slice from the end of
-		// the file.
-		s := &FileSlice{
+		// need to extend the file with 0. We add a hole from the end of
+		// the file, which also hides what the wrapped file has there.
+		slices = slices.Write(&FileSlice{
 			offset: int64(f.Size()),
-			data:   make([]byte, offset-f.Size()),
-		}
-		slices = append(slices, s)
+			hole:   off - int64(f.Size()),
+		})
 	}
 
-	f.slices = slices
+	f.setSlices(slices)
 	f.SetSize(offset)
 
 	// We modified the size, so we need to update the time attributes
-	now := time.Now()
-	f.OverlayAttr.Utimens(&now, &now)
+	f.OverlayAttr.Touch(&now, &now, now)
 	return fuse.OK
 }
 
 func (f *OverlayFile) Read(buf []byte, off int64, ctx *fuse.Context, fs pathfs.FileSystem) (fuse.ReadResult, fuse.Status) {
 	defer f.Locked()()
+	return f.read(buf, off, ctx, fs)
+}
 
+// The caller holds the lock
+func (f *OverlayFile) read(buf []byte, off int64, ctx *fuse.Context, fs pathfs.FileSystem) (fuse.ReadResult, fuse.Status) {
 	res := &FileSlice{
 		offset: off,
 		data:   buf,
@@ -107,86 +123,348 @@ func (f *OverlayFile) Read(buf []byte, off int64, ctx *fuse.Context, fs pathfs.F
 	}
 
 	// First, read what we want from the wrapped file
+	var b []byte
 	if f.source != NoSource {
-		file, status := fs.Open(f.source, fuse.R_OK, ctx)
-		if status != fuse.OK {
-			log.Fatalf("Could not open the underlying file in read mode\n")
+		file := f.sourceFile
+		if file == nil {
+			var status fuse.Status
+			file, status = fs.Open(f.source, syscall.O_RDONLY, ctx)
+			if status != fuse.OK {
+				return nil, contentStatus(status)
+			}
+			// Without handles, nobody would close it
+			if f.handles > 0 {
+				f.sourceFile = file
+			} else {
+				defer file.Release()
+			}
 		}
 		r, status := file.Read(buf, off)
 		if status != fuse.OK {
-			log.Fatalf("Could not read the underlying file\n")
+			return nil, contentStatus(status)
+		}
+		b, status = r.Bytes(buf)
+		if status != fuse.OK {
+			return nil, contentStatus(status)
 		}
-		b, _ := r.Bytes(buf)
-		res.data = b
-		file.Release()
 	}
 
-	// Merge all overlapping existing data into the result
-	for _, s := range f.slices {
-		if res.Overlaps(s) {
-			res.Write(s)
-		}
+	// The wrapped file may be shorter than the overlay (or absent): what
+	// it does not provide reads as zeros, unless the slices say otherwise
+	n := len(buf)
+	if uint64(off)+uint64(n) > f.Size() {
+		n = int(f.Size() - uint64(off))
+	}
+	res.data = buf[:n]
+	copied := copy(res.data, b)
+	for i := copied; i < n; i++ {
+		res.data[i] = 0
 	}
 
+	// Merge all overlapping existing data into the result
+	f.slices.Visit(res.Beg(), res.End(), func(s *FileSlice) bool {
+		res.Write(s)
+		return true
+	})
+
 	return res.Truncated(int64(f.Size())), fuse.OK
 }
 
 func (f *OverlayFile) Write(data []byte, off int64, ctx *fuse.Context, fs pathfs.FileSystem) (uint32, fuse.Status) {
 	defer f.Locked()()
+	return f.write(data, off, ctx)
+}
+
+// Append writes at the end of the file, as it is when the write comes
+func (f *OverlayFile) Append(data []byte, ctx *fuse.Context) (uint32, fuse.Status) {
+	defer f.Locked()()
+	return f.write(data, int64(f.Size()), ctx)
+}
+
+// Somebody else than the owner may not leave a setuid program behind: the
+// setuid and setgid bits go when the caller of ctx changes the content. The
+// caller holds the lock.
+func (f *OverlayFile) dropPrivileges(ctx *fuse.Context) {
+	attr := fuse.Attr{}
+	f.OverlayAttr.GetAttr(&attr)
+	if ctx != nil && ctx.Uid != 0 && ctx.Uid != attr.Owner.Uid {
+		if mode := withoutPrivileges(attr.Mode); mode != attr.Mode {
+			f.OverlayAttr.Chmod(mode & 07777)
+		}
+	}
+}
+
+// The caller holds the lock
+func (f *OverlayFile) write(data []byte, off int64, ctx *fuse.Context) (uint32, fuse.Status) {
+	f.dropPrivileges(ctx)
 
 	// go-fuse seems to reuse the write buffer, we need to copy the input
-	input := make([]byte, len(data))
-	copy(input, data)
-	toInsert := &FileSlice{
-		data:   input,
-		offset: off,
+	toInsert, code := newFileSlice(off, len(data))
+	if code != fuse.OK {
+		return 0, code
+	}
+	copy(toInsert.data, data)
+
+	// Writing past the end of the file leaves a hole, which must not show
+	// what the wrapped file may have there
+	slices := f.slices
+	if size := int64(f.Size()); off > size {
+		slices = slices.Write(&FileSlice{
+			offset: size,
+			hole:   off - size,
+		})
+	}
+
+	// Our slice replaces what it overlaps. Slices are not merged, so that
+	// a write only costs what it writes.
+	f.setSlices(slices.Write(toInsert))
+
+	// Update the file size if needed
+	eow := uint64(int(off) + len(data))
+	if eow > f.Size() {
+		f.SetSize(eow)
+	}
+
+	return uint32(len(data)), fuse.OK
+}
+
+// Allocate follows fallocate(2). Preallocating has nothing to reserve in the
+// buffer: it only extends the file, with a hole.
+func (f *OverlayFile) Allocate(off uint64, size uint64, mode uint32, ctx *fuse.Context, fs pathfs.FileSystem) fuse.Status {
+	return f.allocate(off, size, mode, time.Now(), ctx, fs)
+}
+
+// Allocates at the time of the operation
+func (f *OverlayFile) allocate(off uint64, size uint64, mode uint32, now time.Time, ctx *fuse.Context, fs pathfs.FileSystem) fuse.Status {
+	defer f.Locked()()
+
+	if int64(off) < 0 || int64(size) <= 0 {
+		return fuse.EINVAL
 	}
+	end := int64(off + size)
+	if end < int64(off) {
+		return fuse.Status(syscall.EFBIG)
+	}
+	f.dropPrivileges(ctx)
+	beg := int64(off)
+	fileSize := int64(f.Size())
 
-	// Merge all overlapping slices together, starting from the end
-	for i := len(f.slices) - 1; i >= 0; i-- {
-		s := f.slices[i]
-		// Slices are non overlapping and ordered. If we meet a slice that
-		// is strictly before us, we can be sure there is no longer a chance
-		// to meet an overlapping slice.
-		if s.End() <= toInsert.Beg() {
-			break
+	switch mode &^ fallocKeepSize {
+	case 0:
+		if mode&fallocKeepSize != 0 || end <= fileSize {
+			return fuse.OK
+		}
+		f.setSlices(f.slices.Write(&FileSlice{
+			offset: fileSize,
+			hole:   end - fileSize,
+		}))
+		f.SetSize(uint64(end))
+	case fallocPunchHole, fallocZeroRange:
+		// man 2 fallocate: FALLOC_FL_PUNCH_HOLE must be ORed with
+		// FALLOC_FL_KEEP_SIZE
+		if mode&fallocPunchHole != 0 && mode&fallocKeepSize == 0 {
+			return fuse.Status(syscall.EOPNOTSUPP)
+		}
+		if mode&fallocKeepSize != 0 && end > fileSize {
+			end = fileSize
+		}
+		// Zeroing past the end of the file also zeroes the gap
+		if beg > fileSize {
+			beg = fileSize
+		}
+		if beg < end {
+			f.setSlices(f.slices.Write(&FileSlice{
+				offset: beg,
+				hole:   end - beg,
+			}))
+		}
+		if end > fileSize {
+			f.SetSize(uint64(end))
+		}
+	case fallocCollapseRange, fallocInsertRange:
+		if mode&fallocKeepSize != 0 {
+			return fuse.EINVAL
+		}
+		if beg%fallocBlockSize != 0 || (end-beg)%fallocBlockSize != 0 {
+			return fuse.EINVAL
+		}
+		if mode == fallocCollapseRange && end >= fileSize {
+			return fuse.EINVAL
+		}
+		if mode == fallocInsertRange && beg >= fileSize {
+			return fuse.EINVAL
+		}
+		// The content moves: what the wrapped file shows must not
+		// depend on the offsets anymore
+		if code := f.detach(beg, fileSize, ctx, fs); code != fuse.OK {
+			return code
 		}
-		if toInsert.Overlaps(s) {
-			toInsert = s.MergedIn(toInsert)
+		if mode == fallocCollapseRange {
+			f.setSlices(f.slices.Collapse(beg, end-beg))
+			f.SetSize(uint64(fileSize - (end - beg)))
+		} else {
+			f.setSlices(f.slices.Insert(beg, end-beg))
+			f.SetSize(uint64(fileSize + (end - beg)))
 		}
+	default:
+		return fuse.Status(syscall.EOPNOTSUPP)
 	}
 
-	// Keep the slice sorted by offset and non overlapping
-	slices := make([]*FileSlice, 0, len(f.slices)+1)
-	isInserted := false
-	for _, s := range f.slices {
-		if !toInsert.Overlaps(s) {
-			// insert every non-overlapping slice
-			if s.Beg() > toInsert.Beg() && !isInserted {
-				// insert our slice before any other starting after
-				slices = append(slices, toInsert)
-				isInserted = true
+	f.OverlayAttr.Touch(&now, &now, now)
+	return fuse.OK
+}
+
+// Copies what the wrapped file shows in [beg, end[ into the slices. The
+// caller holds the lock.
+func (f *OverlayFile) detach(beg int64, end int64, ctx *fuse.Context, fs pathfs.FileSystem) fuse.Status {
+	if f.source == NoSource {
+		return fuse.OK
+	}
+	// The ranges that no slice covers
+	gaps := make([][2]int64, 0)
+	f.slices.Visit(beg, end, func(s *FileSlice) bool {
+		if s.Beg() > beg {
+			gaps = append(gaps, [2]int64{beg, s.Beg()})
+		}
+		beg = s.End()
+		return true
+	})
+	if beg < end {
+		gaps = append(gaps, [2]int64{beg, end})
+	}
+
+	for _, gap := range gaps {
+		s, code := newFileSlice(gap[0], int(gap[1]-gap[0]))
+		if code != fuse.OK {
+			return code
+		}
+		for i := 0; i < len(s.data); i += copyBufferSize {
+			j := i + copyBufferSize
+			if j > len(s.data) {
+				j = len(s.data)
+			}
+			if _, code := f.read(s.data[i:j], s.offset+int64(i), ctx, fs); code != fuse.OK {
+				s.drop()
+				return code
 			}
-			slices = append(slices, s)
 		}
+		f.setSlices(f.slices.Write(s))
 	}
-	// If we did not insert the slice previously, do it now
-	if !isInserted {
-		slices = append(slices, toInsert)
+	return fuse.OK
+}
+
+// The blocks are those of the buffered data, and those of the wrapped file
+// where it shows through
+func (f *OverlayFile) GetAttr(out *fuse.Attr) fuse.Status {
+	defer f.Locked()()
+	f.OverlayAttr.GetAttr(out)
+
+	data, holes := f.slices.Sizes()
+	// The wrapped file can only provide the blocks it has
+	shown := int64(f.Size()) - data - holes
+	if wrapped := int64(out.Blocks) * 512; shown > wrapped {
+		shown = wrapped
 	}
+	out.Blocks = uint64(data+shown+511) / 512
+	return fuse.OK
+}
+
+// The attributes change along with the content: they take the same lock
+
+func (f *OverlayFile) Chmod(mode uint32) fuse.Status {
+	defer f.Locked()()
+	return f.OverlayAttr.Chmod(mode)
+}
+
+func (f *OverlayFile) Chown(uid uint32, gid uint32) fuse.Status {
+	defer f.Locked()()
+	return f.OverlayAttr.Chown(uid, gid)
+}
+
+func (f *OverlayFile) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
+	return f.Touch(atime, mtime, time.Now())
+}
+
+func (f *OverlayFile) Touch(atime *time.Time, mtime *time.Time, now time.Time) fuse.Status {
+	defer f.Locked()()
+	return f.OverlayAttr.Touch(atime, mtime, now)
+}
+
+// Drops the buffered data: the content is read from the given path only
+func (f *OverlayFile) rebase(source string) {
+	defer f.Locked()()
+	f.setSource(source)
+	f.setSlices(extents{})
+}
+
+// Replaces the slices. The data that only the previous ones referenced is
+// given back. The caller holds the lock.
+func (f *OverlayFile) setSlices(slices extents) {
+	slices.retain()
+	f.slices.release()
 	f.slices = slices
+}
 
-	// Update the file size if needed
-	eow := uint64(int(off) + len(data))
-	if eow > f.Size() {
-		f.SetSize(eow)
+// Takes a reference on the file, for a name, a checkpoint or a handle
+func (f *OverlayFile) retain() {
+	defer f.Locked()()
+	f.refs++
+}
+
+func (f *OverlayFile) release() {
+	defer f.Locked()()
+	f.unref()
+}
+
+// Drops a reference. Nothing can read the slices after the last one: they
+// are released. The caller holds the lock.
+func (f *OverlayFile) unref() {
+	f.refs--
+	if f.refs == 0 {
+		f.setSlices(extents{})
 	}
+}
 
-	return uint32(len(data)), fuse.OK
+// Helpers for the overlays of any kind: only the files hold data
+
+func retainOverlay(o OverlayPath) {
+	if f, ok := o.(*OverlayFile); ok {
+		f.retain()
+	}
+}
+
+func releaseOverlay(o OverlayPath) {
+	if f, ok := o.(*OverlayFile); ok {
+		f.release()
+	}
+}
+
+// Changes the path of the wrapped file, which is reopened on the next read.
+// The caller holds the lock.
+func (f *OverlayFile) setSource(source string) {
+	if f.sourceFile != nil {
+		f.sourceFile.Release()
+		f.sourceFile = nil
+	}
+	f.source = source
+}
+
+// Registers a new file handle. The source stays open until all of them are
+// released.
+func (f *OverlayFile) hold() {
+	defer f.Locked()()
+	f.handles++
+	f.refs++
 }
 
 func (f *OverlayFile) Release() {
-	// Do we want to do something?
+	defer f.Locked()()
+	f.handles--
+	if f.handles == 0 && f.sourceFile != nil {
+		f.sourceFile.Release()
+		f.sourceFile = nil
+	}
+	f.unref()
 }
 
 func (f *OverlayFile) Flush() fuse.Status {
@@ -21,12 +21,16 @@ type OverlayPath interface {
 	Chown(uid uint32, gid uint32) fuse.Status
 	Chmod(perms uint32) fuse.Status
 	Utimens(atime *time.Time, mtime *time.Time) fuse.Status
-	Allocate(off uint64, size uint64, mode uint32) (code fuse.Status)
+
+	// Methods from OverlayAttr
+	Touch(atime *time.Time, mtime *time.Time, now time.Time) fuse.Status
+	XAttrs
 
 	// Methods from Dir
 	Entries(*fuse.Context) (stream []fuse.DirEntry, code fuse.Status)
-	AddEntry(mode uint32, name string) (code fuse.Status)
-	RemoveEntry(name string) (code fuse.Status)
+	Lookup(name string) (mode uint32, code fuse.Status)
+	AddEntry(mode uint32, name string, now time.Time) (code fuse.Status)
+	RemoveEntry(name string, now time.Time) (code fuse.Status)
 
 	// Methods from symlink
 	Target() (target string, code fuse.Status)
@@ -34,4 +38,5 @@ type OverlayPath interface {
 	// Methods from filehandle
 	Read(dest []byte, off int64, ctx *fuse.Context, fs pathfs.FileSystem) (fuse.ReadResult, fuse.Status)
 	Write(data []byte, off int64, ctx *fuse.Context, fs pathfs.FileSystem) (written uint32, code fuse.Status)
+	Allocate(off uint64, size uint64, mode uint32, ctx *fuse.Context, fs pathfs.FileSystem) (code fuse.Status)
 }
@@ -0,0 +1,29 @@
+// copyright 2016 Christophe-Marie Duquesne
+
+package fs
+
+import (
+	"fmt"
+)
+
+// A FIFO, a socket or a device node. The attributes hold its type and its
+// device number: there is no content to buffer.
+type OverlaySpecial struct {
+	File
+	Dir
+	Symlink
+	OverlayAttr
+}
+
+func NewOverlaySpecial(attr OverlayAttr) OverlayPath {
+	return &OverlaySpecial{
+		File:        NewDefaultFile(),
+		Dir:         NewDefaultDir(),
+		Symlink:     NewDefaultSymlink(),
+		OverlayAttr: attr,
+	}
+}
+
+func (s *OverlaySpecial) String() string {
+	return fmt.Sprintf("OverlaySpecial{}")
+}
@@ -0,0 +1,274 @@
+// copyright 2016 Christophe-Marie Duquesne
+
+package fs
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// The overlayed paths, in a tree that follows the directories. Moving a path
+// moves its node along with everything below it, whatever the size of the
+// subtree. Each name holds a reference on its overlay: a tree that is thrown
+// away must be cleared.
+type OverlayTree struct {
+	root *overlayNode
+	// Number of overlayed paths
+	count int
+	// The nodes of each overlay, so that we find its paths wherever it
+	// moved
+	index map[OverlayPath][]*overlayNode
+}
+
+type overlayNode struct {
+	name     string
+	parent   *overlayNode
+	children map[string]*overlayNode
+	// Nil when the node only leads to overlayed paths
+	path OverlayPath
+}
+
+func NewOverlayTree() *OverlayTree {
+	return &OverlayTree{
+		root:  &overlayNode{},
+		index: make(map[OverlayPath][]*overlayNode),
+	}
+}
+
+func pathComponents(name string) []string {
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+// Returns the node of a path, or nil. If create is set, the missing nodes
+// are created.
+func (t *OverlayTree) node(name string, create bool) *overlayNode {
+	n := t.root
+	for _, base := range pathComponents(name) {
+		child := n.children[base]
+		if child == nil {
+			if !create {
+				return nil
+			}
+			if n.children == nil {
+				n.children = make(map[string]*overlayNode)
+			}
+			child = &overlayNode{name: base, parent: n}
+			n.children[base] = child
+		}
+		n = child
+	}
+	return n
+}
+
+// Number of overlayed paths in the subtree of the node
+func (n *overlayNode) size() int {
+	size := 0
+	if n.path != nil {
+		size++
+	}
+	for _, child := range n.children {
+		size += child.size()
+	}
+	return size
+}
+
+// Removes the node from the tree, along with the nodes which only led to it
+func (t *OverlayTree) detach(n *overlayNode) {
+	for n != t.root {
+		parent := n.parent
+		delete(parent.children, n.name)
+		n.parent = nil
+		if parent.path != nil || len(parent.children) > 0 {
+			return
+		}
+		n = parent
+	}
+}
+
+// Get returns the overlay of a path, or nil if it is not overlayed
+func (t *OverlayTree) Get(name string) OverlayPath {
+	if n := t.node(name, false); n != nil {
+		return n.path
+	}
+	return nil
+}
+
+// Set overlays a path
+func (t *OverlayTree) Set(name string, o OverlayPath) {
+	n := t.node(name, true)
+	if n.path == nil {
+		t.count++
+	}
+	if n.path != o {
+		retainOverlay(o)
+		t.unset(n)
+		t.index[o] = append(t.index[o], n)
+	}
+	n.path = o
+}
+
+// Drops the overlay of a node
+func (t *OverlayTree) unset(n *overlayNode) {
+	if n.path == nil {
+		return
+	}
+	releaseOverlay(n.path)
+	nodes := t.index[n.path]
+	for i := range nodes {
+		if nodes[i] == n {
+			nodes = append(nodes[:i], nodes[i+1:]...)
+			break
+		}
+	}
+	if len(nodes) == 0 {
+		delete(t.index, n.path)
+	} else {
+		t.index[n.path] = nodes
+	}
+	n.path = nil
+}
+
+// Delete drops the overlay of a path and of everything below it
+func (t *OverlayTree) Delete(name string) {
+	n := t.node(name, false)
+	if n == nil {
+		return
+	}
+	t.count -= n.size()
+	t.unsetAll(n)
+	if n == t.root {
+		t.root = &overlayNode{}
+		return
+	}
+	t.detach(n)
+}
+
+// Move moves the overlay of a path and of everything below it to another
+// path, replacing what was overlayed there
+func (t *OverlayTree) Move(oldName string, newName string) {
+	n := t.node(oldName, false)
+	if n == nil || oldName == newName {
+		return
+	}
+	t.Delete(newName)
+	t.detach(n)
+	dir, base := pathSplit(newName)
+	parent := t.node(dir, true)
+	if parent.children == nil {
+		parent.children = make(map[string]*overlayNode)
+	}
+	n.name = base
+	n.parent = parent
+	parent.children[base] = n
+}
+
+func (t *OverlayTree) unsetAll(n *overlayNode) {
+	t.unset(n)
+	for _, child := range n.children {
+		t.unsetAll(child)
+	}
+}
+
+// Path returns one of the paths where an overlay is, or false if it is not
+// in the tree anymore
+func (t *OverlayTree) Path(o OverlayPath) (name string, ok bool) {
+	nodes := t.index[o]
+	if len(nodes) == 0 {
+		return "", false
+	}
+	var names []string
+	for n := nodes[0]; n != t.root; n = n.parent {
+		names = append(names, n.name)
+	}
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	return strings.Join(names, "/"), true
+}
+
+// Clear drops the overlays of all the paths
+func (t *OverlayTree) Clear() {
+	t.Delete("")
+}
+
+// Len returns the number of overlayed paths
+func (t *OverlayTree) Len() int {
+	return t.count
+}
+
+// Walk calls fn on all the overlayed paths, in no particular order
+func (t *OverlayTree) Walk(fn func(name string, o OverlayPath)) {
+	t.root.walk("", fn)
+}
+
+func (n *overlayNode) walk(name string, fn func(name string, o OverlayPath)) {
+	if n.path != nil {
+		fn(name, n.path)
+	}
+	for base, child := range n.children {
+		child.walk(path.Join(name, base), fn)
+	}
+}
+
+// Names returns the overlayed paths, sorted so that parents come before
+// their children
+func (t *OverlayTree) Names() []string {
+	names := make([]string, 0, t.count)
+	t.Walk(func(name string, o OverlayPath) {
+		names = append(names, name)
+	})
+	sort.Strings(names)
+	return names
+}
+
+// Source returns the path of the wrapped file system that a path shows when
+// it is not overlayed, or NoSource if it shows nothing. It is the path itself,
+// unless a parent directory comes from elsewhere: below a renamed directory
+// are the paths below its source.
+func (t *OverlayTree) Source(name string) string {
+	_, source, _ := t.resolve(name, false)
+	return source
+}
+
+// Lookup returns the overlay of a path, or nil if it is not overlayed, along
+// with its source. The overlayed directories on the way must list the path,
+// otherwise it does not exist.
+func (t *OverlayTree) Lookup(name string) (o OverlayPath, source string, code fuse.Status) {
+	return t.resolve(name, true)
+}
+
+func (t *OverlayTree) resolve(name string, check bool) (o OverlayPath, source string, code fuse.Status) {
+	n := t.root
+	if d, ok := n.path.(*OverlayDir); ok {
+		source = d.source
+	}
+	for _, base := range pathComponents(name) {
+		if check && n != nil && n.path != nil {
+			if _, code := n.path.Lookup(base); code != fuse.OK {
+				return nil, NoSource, code
+			}
+		}
+		if source != NoSource {
+			source = path.Join(source, base)
+		}
+		if n != nil {
+			n = n.children[base]
+		}
+		if n == nil {
+			continue
+		}
+		if d, ok := n.path.(*OverlayDir); ok {
+			source = d.source
+		}
+	}
+	if n == nil {
+		return nil, source, fuse.OK
+	}
+	return n.path, source, fuse.OK
+}
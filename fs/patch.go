@@ -0,0 +1,723 @@
+// copyright 2016 Christophe-Marie Duquesne
+
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+const (
+	// Lines of context around the hunks
+	patchContext = 3
+	// Like git, we consider a file binary if it has a NUL byte in its
+	// first bytes
+	binaryCheckSize = 8000
+	nullHash        = "0000000000000000000000000000000000000000"
+)
+
+// A file as seen by git: a mode and a content
+type patchBlob struct {
+	mode    uint32
+	content []byte
+}
+
+// WritePatch writes the pending changes as a patch that 'git apply' can
+// apply on the wrapped file system. Git does not know about directories,
+// owners and times: these changes are not part of the patch.
+func (fs *BufferFS) WritePatch(w io.Writer) error {
+	defer fs.Locked()()
+
+	changes, code := fs.changes()
+	if code != fuse.OK {
+		return statusError(code)
+	}
+	context := ownContext()
+	out := bufio.NewWriter(w)
+
+	// The paths of the wrapped file system that moved elsewhere
+	moved := make(map[string]bool)
+	for _, c := range changes {
+		if c.Kind == Renamed {
+			moved[c.From] = true
+		}
+	}
+
+	for _, c := range changes {
+		var err error
+		switch c.Kind {
+		case Created:
+			var blob *patchBlob
+			blob, err = fs.overlayBlob(c.Path, context)
+			if err == nil && blob != nil {
+				err = writeFilePatch(out, "", c.Path, nil, blob)
+			}
+		case Deleted:
+			err = fs.writeDeletionPatch(out, fs.origin(c.Path), context)
+		case Renamed:
+			// Git only knows about files: a renamed directory is the
+			// rename of each of them
+			if a, code := fs.Wrapped.GetAttr(c.From, context); code == fuse.OK && a.IsDir() {
+				err = fs.writeDirRenamePatch(out, c.From, c.Path, moved, context)
+				break
+			}
+			// A rename that also modifies the content is reported twice
+			// by Changes; the modification is part of the rename.
+			var old, blob *patchBlob
+			old, err = wrappedBlob(fs.Wrapped, c.From, context)
+			if err == nil {
+				blob, err = fs.overlayBlob(c.Path, context)
+			}
+			if err == nil {
+				err = writeFilePatch(out, c.From, c.Path, old, blob)
+			}
+		case Modified, Retargeted, AttrChanged:
+			// The rename of the file or of a directory above it carries
+			// the change
+			if isRenamed(changes, c.Path) || fs.origin(c.Path) != c.Path {
+				continue
+			}
+			var old, blob *patchBlob
+			old, err = wrappedBlob(fs.Wrapped, c.Path, context)
+			if err == nil {
+				blob, err = fs.overlayBlob(c.Path, context)
+			}
+			if err == nil && old != nil && blob != nil {
+				err = writeFilePatch(out, c.Path, c.Path, old, blob)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+func isRenamed(changes []Change, name string) bool {
+	for _, c := range changes {
+		if c.Kind == Renamed && c.Path == name {
+			return true
+		}
+	}
+	return false
+}
+
+// The git mode of a file, or 0 if git does not handle this kind of file
+func gitMode(mode uint32) uint32 {
+	switch mode & syscall.S_IFMT {
+	case fuse.S_IFLNK:
+		return 0120000
+	case fuse.S_IFREG:
+		if mode&0100 != 0 {
+			return 0100755
+		}
+		return 0100644
+	}
+	return 0
+}
+
+// Returns the blob of an overlayed path, or nil for what git does not handle
+// (directories and special files)
+func (fs *BufferFS) overlayBlob(name string, context *fuse.Context) (blob *patchBlob, err error) {
+	o, source, code := fs.shown(name, context)
+	if code != fuse.OK {
+		return nil, statusError(code)
+	}
+	if o == nil {
+		return wrappedBlob(fs.Wrapped, source, context)
+	}
+	attr := fuse.Attr{}
+	o.GetAttr(&attr)
+	blob = &patchBlob{mode: gitMode(attr.Mode)}
+	switch {
+	case attr.IsSymlink():
+		target, code := o.Target()
+		if code != fuse.OK {
+			return nil, statusError(code)
+		}
+		blob.content = []byte(target)
+	case attr.IsRegular():
+		h := NewOverlayFH(o, syscall.O_RDONLY, context, fs.Wrapped)
+		defer h.Release()
+		blob.content = make([]byte, attr.Size)
+		for off := 0; off < len(blob.content); {
+			r, code := h.Read(blob.content[off:], int64(off))
+			if code != fuse.OK {
+				return nil, statusError(code)
+			}
+			b, _ := r.Bytes(blob.content[off:])
+			if len(b) == 0 {
+				break
+			}
+			copy(blob.content[off:], b)
+			off += len(b)
+		}
+	default:
+		return nil, nil
+	}
+	return blob, nil
+}
+
+// Returns the blob of a path of the wrapped file system, or nil for what git
+// does not handle
+func wrappedBlob(wrapped pathfs.FileSystem, name string, context *fuse.Context) (blob *patchBlob, err error) {
+	attr, code := wrapped.GetAttr(name, context)
+	if code != fuse.OK {
+		return nil, statusError(code)
+	}
+	blob = &patchBlob{mode: gitMode(attr.Mode)}
+	switch {
+	case attr.IsSymlink():
+		target, code := wrapped.Readlink(name, context)
+		if code != fuse.OK {
+			return nil, statusError(code)
+		}
+		blob.content = []byte(target)
+	case attr.IsRegular():
+		file, code := wrapped.Open(name, syscall.O_RDONLY, context)
+		if code != fuse.OK {
+			return nil, statusError(code)
+		}
+		defer file.Release()
+		blob.content = make([]byte, attr.Size)
+		off := 0
+		for off < len(blob.content) {
+			r, code := file.Read(blob.content[off:], int64(off))
+			if code != fuse.OK {
+				return nil, statusError(code)
+			}
+			b, _ := r.Bytes(blob.content[off:])
+			if len(b) == 0 {
+				break
+			}
+			copy(blob.content[off:], b)
+			off += len(b)
+		}
+		blob.content = blob.content[:off]
+	default:
+		return nil, nil
+	}
+	return blob, nil
+}
+
+// Writes the deletion of a path of the wrapped file system, recursively
+func (fs *BufferFS) writeDeletionPatch(w io.Writer, name string, context *fuse.Context) error {
+	attr, code := fs.Wrapped.GetAttr(name, context)
+	if code != fuse.OK {
+		return statusError(code)
+	}
+	if attr.IsDir() {
+		entries, code := fs.Wrapped.OpenDir(name, context)
+		if code != fuse.OK {
+			return statusError(code)
+		}
+		for _, e := range entries {
+			err := fs.writeDeletionPatch(w, path.Join(name, e.Name), context)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	old, err := wrappedBlob(fs.Wrapped, name, context)
+	if err != nil || old == nil || old.mode == 0 {
+		return err
+	}
+	return writeFilePatch(w, name, "", old, nil)
+}
+
+// Writes the renames of the files below a renamed directory. A file that
+// its new path does not show anymore moved elsewhere, was deleted (which
+// the deletion of its new path covers) or was replaced, in which case it is
+// deleted.
+func (fs *BufferFS) writeDirRenamePatch(w io.Writer, from string, to string, moved map[string]bool, context *fuse.Context) error {
+	entries, code := fs.Wrapped.OpenDir(from, context)
+	if code != fuse.OK {
+		return statusError(code)
+	}
+	for _, e := range entries {
+		oldName, newName := path.Join(from, e.Name), path.Join(to, e.Name)
+		if moved[oldName] {
+			continue
+		}
+		if e.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			if err := fs.writeDirRenamePatch(w, oldName, newName, moved, context); err != nil {
+				return err
+			}
+			continue
+		}
+		old, err := wrappedBlob(fs.Wrapped, oldName, context)
+		if err != nil {
+			return err
+		}
+		if fs.shows(newName, oldName, e.Mode) {
+			blob, err := fs.overlayBlob(newName, context)
+			if err == nil {
+				err = writeFilePatch(w, oldName, newName, old, blob)
+			}
+			if err != nil {
+				return err
+			}
+		} else if _, code := fs.getAttr(newName, context); code == fuse.OK {
+			if err := writeFilePatch(w, oldName, "", old, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Whether a path shows a path of the wrapped file system, possibly modified
+func (fs *BufferFS) shows(name string, source string, mode uint32) bool {
+	o, shown, code := fs.Overlayed.Lookup(name)
+	if code != fuse.OK {
+		return false
+	}
+	if o == nil {
+		return shown == source
+	}
+	if f, ok := o.(*OverlayFile); ok {
+		return f.source == source
+	}
+	attr := &fuse.Attr{}
+	o.GetAttr(attr)
+	return attr.Mode&syscall.S_IFMT == mode&syscall.S_IFMT && fs.origin(name) == source
+}
+
+func isBinary(content []byte) bool {
+	if len(content) > binaryCheckSize {
+		content = content[:binaryCheckSize]
+	}
+	return bytes.IndexByte(content, 0) >= 0
+}
+
+// The git object name of a blob
+func blobHash(b *patchBlob) string {
+	if b == nil {
+		return nullHash
+	}
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(b.content))
+	h.Write(b.content)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// Writes the patch of a single file. An empty oldName (with a nil old blob)
+// means a creation, an empty newName (with a nil new blob) a deletion.
+func writeFilePatch(w io.Writer, oldName string, newName string, old *patchBlob, new *patchBlob) error {
+	if (old != nil && old.mode == 0) || (new != nil && new.mode == 0) {
+		// Not something git knows about
+		return nil
+	}
+	a, b := oldName, newName
+	if a == "" {
+		a = b
+	}
+	if b == "" {
+		b = a
+	}
+	sameContent := old != nil && new != nil && bytes.Equal(old.content, new.content)
+	if old != nil && new != nil && oldName == newName && sameContent && old.mode == new.mode {
+		return nil
+	}
+
+	hdr := &bytes.Buffer{}
+	fmt.Fprintf(hdr, "diff --git %s %s\n", gitQuote("a/"+a), gitQuote("b/"+b))
+	switch {
+	case old == nil:
+		fmt.Fprintf(hdr, "new file mode %06o\n", new.mode)
+	case new == nil:
+		fmt.Fprintf(hdr, "deleted file mode %06o\n", old.mode)
+	default:
+		if old.mode != new.mode {
+			fmt.Fprintf(hdr, "old mode %06o\nnew mode %06o\n", old.mode, new.mode)
+		}
+		if oldName != newName {
+			fmt.Fprintf(hdr, "rename from %s\nrename to %s\n", gitQuote(oldName), gitQuote(newName))
+		}
+	}
+	if _, err := w.Write(hdr.Bytes()); err != nil {
+		return err
+	}
+	if sameContent {
+		return nil
+	}
+
+	var oldContent, newContent []byte
+	if old != nil {
+		oldContent = old.content
+	}
+	if new != nil {
+		newContent = new.content
+	}
+	fromName, toName := gitQuote("a/"+a)+gitTab(a), gitQuote("b/"+b)+gitTab(b)
+	if old == nil {
+		fromName = "/dev/null"
+	}
+	if new == nil {
+		toName = "/dev/null"
+	}
+
+	if isBinary(oldContent) || isBinary(newContent) {
+		return writeBinaryPatch(w, old, new)
+	}
+	if len(oldContent) == 0 && len(newContent) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintf(w, "--- %s\n+++ %s\n", fromName, toName); err != nil {
+		return err
+	}
+	return writeHunks(w, splitLines(oldContent), splitLines(newContent))
+}
+
+// Quotes a name as git does: names with double quotes, backslashes, control
+// or non-ASCII characters are written as C strings
+func gitQuote(name string) string {
+	quoted := &bytes.Buffer{}
+	needed := false
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '"' || c == '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(c)
+		case c >= '\a' && c <= '\r':
+			quoted.WriteByte('\\')
+			quoted.WriteByte("abtnvfr"[c-'\a'])
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(quoted, "\\%03o", c)
+		default:
+			quoted.WriteByte(c)
+			continue
+		}
+		needed = true
+	}
+	if !needed {
+		return name
+	}
+	return `"` + quoted.String() + `"`
+}
+
+// Git ends the names of the ---/+++ lines with a tab when they have spaces,
+// so that they are not mistaken for a trailing timestamp
+func gitTab(name string) string {
+	if strings.ContainsRune(name, ' ') {
+		return "\t"
+	}
+	return ""
+}
+
+// Writes a binary patch, as 'git diff --binary' does
+func writeBinaryPatch(w io.Writer, old *patchBlob, new *patchBlob) error {
+	var oldContent, newContent []byte
+	if old != nil {
+		oldContent = old.content
+	}
+	if new != nil {
+		newContent = new.content
+	}
+	_, err := fmt.Fprintf(w, "index %s..%s\nGIT binary patch\n", blobHash(old), blobHash(new))
+	if err != nil {
+		return err
+	}
+	// The forward data, then the reverse data (for 'git apply -R')
+	for _, content := range [][]byte{newContent, oldContent} {
+		if err := writeBinaryLiteral(w, content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const base85Alphabet = "0123456789" +
+	"ABCDEFGHIJKLMNOPQRSTUVWXYZ" +
+	"abcdefghijklmnopqrstuvwxyz" +
+	"!#$%&()*+-;<=>?@^_`{|}~"
+
+// Writes a zlib compressed, base85 encoded block, in the format of git
+func writeBinaryLiteral(w io.Writer, content []byte) error {
+	compressed := &bytes.Buffer{}
+	z := zlib.NewWriter(compressed)
+	z.Write(content)
+	z.Close()
+
+	if _, err := fmt.Fprintf(w, "literal %d\n", len(content)); err != nil {
+		return err
+	}
+	data := compressed.Bytes()
+	for len(data) > 0 {
+		n := len(data)
+		if n > 52 {
+			n = 52
+		}
+		line := make([]byte, 0, 1+(n+3)/4*5+1)
+		if n <= 26 {
+			line = append(line, byte('A'+n-1))
+		} else {
+			line = append(line, byte('a'+n-27))
+		}
+		for i := 0; i < n; i += 4 {
+			var acc uint32
+			for j := 0; j < 4; j++ {
+				acc <<= 8
+				if i+j < n {
+					acc |= uint32(data[i+j])
+				}
+			}
+			var chunk [5]byte
+			for j := 4; j >= 0; j-- {
+				chunk[j] = base85Alphabet[acc%85]
+				acc /= 85
+			}
+			line = append(line, chunk[:]...)
+		}
+		line = append(line, '\n')
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// Splits content in lines, keeping the line terminators
+func splitLines(content []byte) [][]byte {
+	lines := make([][]byte, 0)
+	for len(content) > 0 {
+		i := bytes.IndexByte(content, '\n')
+		if i < 0 {
+			i = len(content) - 1
+		}
+		lines = append(lines, content[:i+1])
+		content = content[i+1:]
+	}
+	return lines
+}
+
+// An edit of the script transforming the old lines into the new lines
+type lineEdit struct {
+	op   byte // ' ', '-' or '+'
+	line []byte
+}
+
+// Computes the shortest edit script with the linear space variant of the
+// algorithm of Myers ("An O(ND) Difference Algorithm and Its Variations",
+// section 4b): the middle snake of the script splits it in two shorter
+// scripts, which are computed the same way.
+func diffLines(a [][]byte, b [][]byte) []lineEdit {
+	max := (len(a)+len(b)+1)/2 + 1
+	d := &differ{
+		a:        a,
+		b:        b,
+		forward:  make([]int, 2*max+1),
+		backward: make([]int, 2*max+1),
+		offset:   max,
+		edits:    make([]lineEdit, 0, len(a)+len(b)),
+	}
+	d.diff(0, len(a), 0, len(b))
+	return d.edits
+}
+
+type differ struct {
+	a, b [][]byte
+	// The furthest reaching paths, by diagonal, from the start of the
+	// lines and from their end
+	forward, backward []int
+	offset            int
+	edits             []lineEdit
+}
+
+// Appends the script transforming a[aBeg:aEnd] into b[bBeg:bEnd]
+func (d *differ) diff(aBeg int, aEnd int, bBeg int, bEnd int) {
+	for aBeg < aEnd && bBeg < bEnd && bytes.Equal(d.a[aBeg], d.b[bBeg]) {
+		d.edits = append(d.edits, lineEdit{' ', d.a[aBeg]})
+		aBeg++
+		bBeg++
+	}
+	common := 0
+	for aBeg < aEnd && bBeg < bEnd && bytes.Equal(d.a[aEnd-1], d.b[bEnd-1]) {
+		aEnd--
+		bEnd--
+		common++
+	}
+	switch {
+	case aBeg == aEnd:
+		for ; bBeg < bEnd; bBeg++ {
+			d.edits = append(d.edits, lineEdit{'+', d.b[bBeg]})
+		}
+	case bBeg == bEnd:
+		for ; aBeg < aEnd; aBeg++ {
+			d.edits = append(d.edits, lineEdit{'-', d.a[aBeg]})
+		}
+	default:
+		// Both ends differ, so the script has an edit on each side of
+		// the snake
+		x, y, u, v := d.middleSnake(aBeg, aEnd, bBeg, bEnd)
+		d.diff(aBeg, x, bBeg, y)
+		for ; x < u; x++ {
+			d.edits = append(d.edits, lineEdit{' ', d.a[x]})
+		}
+		d.diff(u, aEnd, v, bEnd)
+	}
+	for i := 0; i < common; i++ {
+		d.edits = append(d.edits, lineEdit{' ', d.a[aEnd+i]})
+	}
+}
+
+// Finds the snake in the middle of the shortest script transforming
+// a[aBeg:aEnd] into b[bBeg:bEnd], from (x, y) to (u, v), by searching from
+// both ends until the paths overlap
+func (d *differ) middleSnake(aBeg int, aEnd int, bBeg int, bEnd int) (x, y, u, v int) {
+	n, m := aEnd-aBeg, bEnd-bBeg
+	delta := n - m
+	odd := delta%2 != 0
+	// The diagonals k = x - y are relative to the start for the forward
+	// paths, and to the end for the backward ones. The diagonal k of the
+	// forward paths is the diagonal delta - k of the backward ones.
+	f, b := d.forward, d.backward
+	o := d.offset
+	f[o+1], b[o+1] = 0, 0
+	for D := 0; D <= (n+m+1)/2; D++ {
+		for k := -D; k <= D; k += 2 {
+			var x int
+			if k == -D || (k != D && f[o+k-1] < f[o+k+1]) {
+				x = f[o+k+1]
+			} else {
+				x = f[o+k-1] + 1
+			}
+			y := x - k
+			startX, startY := x, y
+			for x < n && y < m && bytes.Equal(d.a[aBeg+x], d.b[bBeg+y]) {
+				x++
+				y++
+			}
+			f[o+k] = x
+			if c := delta - k; odd && c >= -(D-1) && c <= D-1 && x+b[o+c] >= n {
+				return aBeg + startX, bBeg + startY, aBeg + x, bBeg + y
+			}
+		}
+		for c := -D; c <= D; c += 2 {
+			var x int
+			if c == -D || (c != D && b[o+c-1] < b[o+c+1]) {
+				x = b[o+c+1]
+			} else {
+				x = b[o+c-1] + 1
+			}
+			y := x - c
+			startX, startY := x, y
+			for x < n && y < m && bytes.Equal(d.a[aEnd-x-1], d.b[bEnd-y-1]) {
+				x++
+				y++
+			}
+			b[o+c] = x
+			if k := delta - c; !odd && k >= -D && k <= D && x+f[o+k] >= n {
+				return aEnd - x, bEnd - y, aEnd - startX, bEnd - startY
+			}
+		}
+	}
+	// Not reached: the paths meet after (n+m+1)/2 edits at most
+	return aBeg, bBeg, aBeg, bBeg
+}
+
+// Writes the unified hunks transforming the old lines into the new lines
+func writeHunks(w io.Writer, a [][]byte, b [][]byte) error {
+	edits := diffLines(a, b)
+
+	for start := 0; start < len(edits); {
+		// Find the next change
+		for start < len(edits) && edits[start].op == ' ' {
+			start++
+		}
+		if start == len(edits) {
+			break
+		}
+		// Extend the hunk until we meet enough unchanged lines
+		end := start
+		for end < len(edits) {
+			if edits[end].op != ' ' {
+				end++
+				continue
+			}
+			unchanged := end
+			for unchanged < len(edits) && edits[unchanged].op == ' ' {
+				unchanged++
+			}
+			if unchanged == len(edits) || unchanged-end > 2*patchContext {
+				break
+			}
+			end = unchanged
+		}
+		from := start - patchContext
+		if from < 0 {
+			from = 0
+		}
+		to := end + patchContext
+		if to > len(edits) {
+			to = len(edits)
+		}
+
+		// Line numbers of the hunk
+		oldLine, newLine := 1, 1
+		for _, e := range edits[:from] {
+			if e.op != '+' {
+				oldLine++
+			}
+			if e.op != '-' {
+				newLine++
+			}
+		}
+		oldCount, newCount := 0, 0
+		for _, e := range edits[from:to] {
+			if e.op != '+' {
+				oldCount++
+			}
+			if e.op != '-' {
+				newCount++
+			}
+		}
+		if oldCount == 0 {
+			oldLine--
+		}
+		if newCount == 0 {
+			newLine--
+		}
+		_, err := fmt.Fprintf(w, "@@ -%s +%s @@\n",
+			hunkRange(oldLine, oldCount), hunkRange(newLine, newCount))
+		if err != nil {
+			return err
+		}
+		for _, e := range edits[from:to] {
+			if _, err := w.Write([]byte{e.op}); err != nil {
+				return err
+			}
+			if _, err := w.Write(e.line); err != nil {
+				return err
+			}
+			if e.line[len(e.line)-1] != '\n' {
+				if _, err := io.WriteString(w, "\n\\ No newline at end of file\n"); err != nil {
+					return err
+				}
+			}
+		}
+		start = to
+	}
+	return nil
+}
+
+func hunkRange(line int, count int) string {
+	if count == 1 {
+		return fmt.Sprintf("%d", line)
+	}
+	return fmt.Sprintf("%d,%d", line, count)
+}
@@ -0,0 +1,290 @@
+// copyright 2016 Christophe-Marie Duquesne
+
+package fs
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Where the data of the overlayed files goes. Up to the memory budget, the
+// slices are allocated on the heap. Past it, they are carved out of a single
+// scratch file, mapped by arenas, so that the kernel can write them back to
+// the disk instead of keeping them in RAM. When the scratch file has no room
+// left, the writes fail with ENOSPC.
+type scratchSpace struct {
+	dir string
+	// Negative means no limit
+	budget int64
+	// Bytes of slices currently on the heap
+	used int64
+	// Where the new arenas are mapped from, created when first needed
+	file *scratchFile
+	lock sync.Mutex
+}
+
+var scratch = &scratchSpace{budget: -1}
+
+const (
+	// The size of the arenas. Larger slices get an arena of their own.
+	scratchArenaSize = 64 << 20
+	// The slices of the arenas start on multiples of this, which limits
+	// the fragmentation
+	scratchAlign = 64
+)
+
+// SetScratch sets the memory budget of the buffered data of all the
+// BufferFS, after which the data goes to a file of dir. A negative budget
+// means no limit.
+func SetScratch(dir string, budget int64) {
+	scratch.lock.Lock()
+	defer scratch.lock.Unlock()
+	if dir != scratch.dir {
+		// The arenas of the previous file keep it open until they are
+		// released
+		scratch.file = nil
+	}
+	scratch.dir = dir
+	scratch.budget = budget
+}
+
+// The memory behind the data of FileSlices. FileSlices sharing data share
+// the buffer, which is given back when no extent references it anymore.
+type sliceBuffer struct {
+	data []byte
+	// Where data is mapped from, or nil if it is on the heap
+	arena  *scratchArena
+	offset int
+	// Number of extent nodes referencing the buffer
+	refs int32
+}
+
+func (b *sliceBuffer) retain() {
+	if b != nil {
+		atomic.AddInt32(&b.refs, 1)
+	}
+}
+
+func (b *sliceBuffer) release() {
+	if b != nil && atomic.AddInt32(&b.refs, -1) == 0 {
+		scratch.free(b)
+	}
+}
+
+// Gives back a buffer that never made it into extents
+func (b *sliceBuffer) drop() {
+	if b != nil && atomic.LoadInt32(&b.refs) == 0 {
+		scratch.free(b)
+	}
+}
+
+// A scratch file. It is removed right away: the descriptor keeps it alive,
+// and nothing is left behind when ploufs stops.
+type scratchFile struct {
+	f *os.File
+	// Sorted by offset
+	arenas []*scratchArena
+}
+
+// A range of the scratch file, mapped in memory
+type scratchArena struct {
+	file   *scratchFile
+	offset int64
+	data   []byte
+	// The ranges of data that are not allocated, sorted and coalesced
+	free []scratchRange
+	used int
+}
+
+type scratchRange struct {
+	offset int
+	size   int
+}
+
+// Allocates a zero filled buffer
+func (s *scratchSpace) alloc(size int) (*sliceBuffer, fuse.Status) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if size == 0 || s.budget < 0 || s.used+int64(size) <= s.budget {
+		s.used += int64(size)
+		return &sliceBuffer{data: make([]byte, size)}, fuse.OK
+	}
+	b, err := s.carve(size)
+	if err != nil {
+		log.Printf("Could not allocate %d bytes of scratch space: %v\n", size, err)
+		return nil, fuse.Status(syscall.ENOSPC)
+	}
+	return b, fuse.OK
+}
+
+// Takes a buffer from the arenas of the scratch file, mapping a new arena
+// when none has room for it
+func (s *scratchSpace) carve(size int) (*sliceBuffer, error) {
+	if s.file == nil {
+		f, err := newScratchFile(s.dir)
+		if err != nil {
+			return nil, err
+		}
+		s.file = f
+	}
+	n := alignScratch(size)
+	for _, a := range s.file.arenas {
+		if off, ok := a.take(n); ok {
+			return a.buffer(off, size), nil
+		}
+	}
+	a, err := s.file.grow(n)
+	if err != nil {
+		if len(s.file.arenas) == 0 {
+			s.file.f.Close()
+			s.file = nil
+		}
+		return nil, err
+	}
+	off, _ := a.take(n)
+	return a.buffer(off, size), nil
+}
+
+// Gives the memory of a buffer back. The arenas left empty are unmapped,
+// and their range of the scratch file released.
+func (s *scratchSpace) free(b *sliceBuffer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	a := b.arena
+	if a == nil {
+		s.used -= int64(len(b.data))
+		return
+	}
+	a.give(b.offset, alignScratch(len(b.data)))
+	if a.used > 0 {
+		return
+	}
+	f := a.file
+	syscall.Munmap(a.data)
+	syscall.Fallocate(int(f.f.Fd()), fallocPunchHole|fallocKeepSize, a.offset, int64(len(a.data)))
+	for i := range f.arenas {
+		if f.arenas[i] == a {
+			f.arenas = append(f.arenas[:i], f.arenas[i+1:]...)
+			break
+		}
+	}
+	if len(f.arenas) == 0 {
+		f.f.Close()
+		if s.file == f {
+			s.file = nil
+		}
+	}
+}
+
+func alignScratch(size int) int {
+	return (size + scratchAlign - 1) &^ (scratchAlign - 1)
+}
+
+func newScratchFile(dir string) (*scratchFile, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	f, err := ioutil.TempFile(dir, "ploufs-")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	return &scratchFile{f: f}, nil
+}
+
+// Maps a new arena of at least size bytes, in the first range of the file
+// that no arena uses
+func (f *scratchFile) grow(size int) (*scratchArena, error) {
+	length := scratchArenaSize
+	if size > length {
+		length = (size + scratchArenaSize - 1) / scratchArenaSize * scratchArenaSize
+	}
+	offset := int64(0)
+	i := 0
+	for ; i < len(f.arenas); i++ {
+		if f.arenas[i].offset-offset >= int64(length) {
+			break
+		}
+		offset = f.arenas[i].offset + int64(len(f.arenas[i].data))
+	}
+
+	// Writing to a mapping whose file cannot grow on the disk is fatal, so
+	// we reserve the space upfront
+	fd := int(f.f.Fd())
+	if err := syscall.Fallocate(fd, 0, offset, int64(length)); err != nil {
+		return nil, err
+	}
+	data, err := syscall.Mmap(fd, offset, length, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		syscall.Fallocate(fd, fallocPunchHole|fallocKeepSize, offset, int64(length))
+		return nil, err
+	}
+	a := &scratchArena{
+		file:   f,
+		offset: offset,
+		data:   data,
+		free:   []scratchRange{{offset: 0, size: length}},
+	}
+	f.arenas = append(f.arenas, nil)
+	copy(f.arenas[i+1:], f.arenas[i:])
+	f.arenas[i] = a
+	return a, nil
+}
+
+// Allocates size bytes from the first free range large enough
+func (a *scratchArena) take(size int) (int, bool) {
+	for i, r := range a.free {
+		if r.size < size {
+			continue
+		}
+		if r.size == size {
+			a.free = append(a.free[:i], a.free[i+1:]...)
+		} else {
+			a.free[i] = scratchRange{offset: r.offset + size, size: r.size - size}
+		}
+		a.used += size
+		return r.offset, true
+	}
+	return 0, false
+}
+
+// Frees a range, merging it with the free ranges around it
+func (a *scratchArena) give(offset int, size int) {
+	a.used -= size
+	i := sort.Search(len(a.free), func(i int) bool {
+		return a.free[i].offset > offset
+	})
+	before := i > 0 && a.free[i-1].offset+a.free[i-1].size == offset
+	after := i < len(a.free) && offset+size == a.free[i].offset
+	switch {
+	case before && after:
+		a.free[i-1].size += size + a.free[i].size
+		a.free = append(a.free[:i], a.free[i+1:]...)
+	case before:
+		a.free[i-1].size += size
+	case after:
+		a.free[i] = scratchRange{offset: offset, size: size + a.free[i].size}
+	default:
+		a.free = append(a.free, scratchRange{})
+		copy(a.free[i+1:], a.free[i:])
+		a.free[i] = scratchRange{offset: offset, size: size}
+	}
+}
+
+// The buffer of an allocated range. What was freed there before is cleared.
+func (a *scratchArena) buffer(offset int, size int) *sliceBuffer {
+	data := a.data[offset : offset+size : offset+size]
+	for i := range data {
+		data[i] = 0
+	}
+	return &sliceBuffer{data: data, arena: a, offset: offset}
+}
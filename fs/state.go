@@ -0,0 +1,314 @@
+// copyright 2016 Christophe-Marie Duquesne
+
+package fs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+const (
+	stateMagic = "ploufss"
+	// Increase when the format changes. LoadState reads the older versions.
+	// 2: holes in the files
+	// 3: sources of the directories
+	// 4: hard links
+	// 5: extended attributes
+	// 6: special files
+	stateVersion = 6
+	// Checksum of the whole file
+	stateTrailerSize = 4
+	// Bounds of the strings of a state: a path (PATH_MAX), an extended
+	// attribute (XATTR_SIZE_MAX), the data of a slice
+	stateMaxName  = 4096
+	stateMaxXAttr = 1 << 16
+	stateMaxData  = 1 << 62
+)
+
+// Kinds of overlayed paths in a state file
+const (
+	stateFile byte = iota + 1
+	stateDir
+	stateSymlink
+	// Another name of a file saved before
+	stateLink
+	stateSpecial
+)
+
+// SaveState writes the buffered changes to w. LoadState reads them back,
+// possibly in another BufferFS wrapping a copy of the same file system.
+func (fs *BufferFS) SaveState(w io.Writer) error {
+	defer fs.Locked()()
+	return encodeState(w, fs.Overlayed)
+}
+
+// Writes the state of the overlayed paths of a tree
+func encodeState(w io.Writer, overlayed *OverlayTree) error {
+	crc := crc32.NewIEEE()
+	b := &binaryWriter{w: io.MultiWriter(w, crc)}
+	b.write([]byte(stateMagic))
+	b.write([]byte{stateVersion})
+
+	names := overlayed.Names()
+	saved := make(map[OverlayPath]string)
+	b.putUint(uint64(len(names)))
+	for _, name := range names {
+		o := overlayed.Get(name)
+		b.putString(name)
+		if first, ok := saved[o]; ok {
+			b.write([]byte{stateLink})
+			b.putString(first)
+			continue
+		}
+		saved[o] = name
+		attr := &fuse.Attr{}
+		o.GetAttr(attr)
+		switch p := o.(type) {
+		case *OverlayFile:
+			b.write([]byte{stateFile})
+			b.putAttr(attr)
+			b.putXAttrs(o)
+			p.lock.Lock()
+			b.putString(p.source)
+			slices := p.slices.Slices()
+			b.putUint(uint64(len(slices)))
+			for _, s := range slices {
+				b.putUint(uint64(s.offset))
+				b.putUint(uint64(s.hole))
+				b.putBytes(s.data)
+			}
+			p.lock.Unlock()
+		case *OverlayDir:
+			b.write([]byte{stateDir})
+			b.putAttr(attr)
+			b.putXAttrs(o)
+			b.putString(p.source)
+			b.putUint(uint64(len(p.entries)))
+			for _, e := range p.entries {
+				b.putString(e.Name)
+				b.putUint(uint64(e.Mode))
+				b.putUint(e.Ino)
+			}
+		case *OverlaySymlink:
+			b.write([]byte{stateSymlink})
+			b.putAttr(attr)
+			b.putXAttrs(o)
+			b.putString(p.target)
+		case *OverlaySpecial:
+			b.write([]byte{stateSpecial})
+			b.putAttr(attr)
+			b.putXAttrs(o)
+		default:
+			return fmt.Errorf("%s: cannot save %v", name, o)
+		}
+	}
+	if b.err != nil {
+		return b.err
+	}
+
+	trailer := make([]byte, stateTrailerSize)
+	binary.BigEndian.PutUint32(trailer, crc.Sum32())
+	_, err := w.Write(trailer)
+	return err
+}
+
+// LoadState replaces the buffered changes by the ones saved by SaveState,
+// and drops the checkpoints. In case of error, the buffered changes are left
+// untouched.
+func (fs *BufferFS) LoadState(r io.Reader) error {
+	overlayed, err := decodeState(r)
+	if err != nil {
+		return err
+	}
+	fs.invalidate(fs.replace(overlayed)...)
+	return nil
+}
+
+// Replaces the overlay, and returns the paths that the kernel must forget
+func (fs *BufferFS) replace(overlayed *OverlayTree) (stale []string) {
+	defer fs.Locked()()
+
+	stale = append(fs.Overlayed.Names(), overlayed.Names()...)
+	fs.Overlayed.Clear()
+	fs.Overlayed = overlayed
+	fs.indexLinks()
+	fs.dropCheckpoints()
+	return stale
+}
+
+// Reads a state as it comes. The checksum covers everything before the
+// trailer, which must end the state.
+func decodeState(r io.Reader) (overlayed *OverlayTree, err error) {
+	src := bufio.NewReader(r)
+	crc := crc32.NewIEEE()
+	content := &checksummedReader{r: src, crc: crc}
+
+	header := make([]byte, len(stateMagic)+1)
+	if _, err := io.ReadFull(content, header); err != nil || string(header[:len(stateMagic)]) != stateMagic {
+		return nil, errors.New("not a ploufs state")
+	}
+	version := header[len(stateMagic)]
+	if version > stateVersion {
+		return nil, fmt.Errorf("unsupported state version %d", version)
+	}
+
+	b := newBinaryReader(content)
+	n := b.getUint()
+	overlayed = NewOverlayTree()
+	// What was read of a state we reject goes back to the scratch space
+	defer func(t *OverlayTree) {
+		if err != nil {
+			t.Clear()
+		}
+	}(overlayed)
+	for i := uint64(0); i < n && b.err == nil; i++ {
+		name := b.getString(stateMaxName)
+		if b.err == nil && !validStatePath(name) {
+			return nil, fmt.Errorf("corrupted state: invalid path %q", name)
+		}
+		kind := b.getByte()
+		if kind == stateLink {
+			f, ok := overlayed.Get(b.getString(stateMaxName)).(*OverlayFile)
+			if !ok {
+				if b.err == nil {
+					return nil, errors.New("corrupted state: link to a missing file")
+				}
+				break
+			}
+			overlayed.Set(name, f)
+			continue
+		}
+		attr := NewOverlayAttrFromExisting(b.getAttr())
+		if version >= 5 {
+			count := b.getUint()
+			for j := uint64(0); j < count && b.err == nil; j++ {
+				attr.SetXAttr(b.getString(stateMaxName), b.getBytes(stateMaxXAttr), 0)
+			}
+		}
+		switch kind {
+		case stateFile:
+			source := b.getString(stateMaxName)
+			if b.err == nil && !validStateSource(source) {
+				return nil, fmt.Errorf("corrupted state: invalid source %q", source)
+			}
+			f := NewOverlayFile(attr, source).(*OverlayFile)
+			overlayed.Set(name, f)
+			count := b.getUint()
+			for j := uint64(0); j < count && b.err == nil; j++ {
+				offset := int64(b.getUint())
+				hole := int64(0)
+				if version >= 2 {
+					hole = int64(b.getUint())
+				}
+				data := b.getBytes(stateMaxData)
+				if hole > 0 {
+					f.setSlices(f.slices.Write(&FileSlice{offset: offset, hole: hole}))
+					continue
+				}
+				// The slices outlive the state, keep them within the
+				// memory budget
+				s, code := newFileSlice(offset, len(data))
+				if code != fuse.OK {
+					return nil, fmt.Errorf("cannot buffer %q: %v", name, code)
+				}
+				copy(s.data, data)
+				f.setSlices(f.slices.Write(s))
+			}
+		case stateDir:
+			// Before, renaming a directory overlayed its whole content
+			source := name
+			if version >= 3 {
+				source = b.getString(stateMaxName)
+			}
+			if b.err == nil && !validStateSource(source) {
+				return nil, fmt.Errorf("corrupted state: invalid source %q", source)
+			}
+			count := b.getUint()
+			entries := make([]fuse.DirEntry, 0)
+			for j := uint64(0); j < count && b.err == nil; j++ {
+				e := fuse.DirEntry{Name: b.getString(stateMaxName)}
+				if b.err == nil && !validEntryName(e.Name) {
+					return nil, fmt.Errorf("corrupted state: invalid entry %q in %q", e.Name, name)
+				}
+				e.Mode = uint32(b.getUint())
+				e.Ino = b.getUint()
+				entries = append(entries, e)
+			}
+			overlayed.Set(name, NewOverlayDir(attr, source, entries))
+		case stateSymlink:
+			overlayed.Set(name, NewOverlaySymlink(attr, b.getString(stateMaxName)))
+		case stateSpecial:
+			overlayed.Set(name, NewOverlaySpecial(attr))
+		default:
+			if b.err == nil {
+				return nil, fmt.Errorf("corrupted state: unknown kind %d", kind)
+			}
+		}
+	}
+	if b.err != nil {
+		return nil, fmt.Errorf("corrupted state: %v", b.err)
+	}
+
+	trailer := make([]byte, stateTrailerSize)
+	if _, err := io.ReadFull(src, trailer); err != nil {
+		return nil, fmt.Errorf("corrupted state: %v", err)
+	}
+	if crc.Sum32() != binary.BigEndian.Uint32(trailer) {
+		return nil, errors.New("corrupted state: checksum mismatch")
+	}
+	if _, err := src.ReadByte(); err != io.EOF {
+		return nil, errors.New("corrupted state: data after the end")
+	}
+	return overlayed, nil
+}
+
+// Hashes what is read through it
+type checksummedReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+}
+
+func (c *checksummedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.crc.Write(p[:n])
+	return n, err
+}
+
+func (c *checksummedReader) ReadByte() (byte, error) {
+	v, err := c.r.ReadByte()
+	if err == nil {
+		c.crc.Write([]byte{v})
+	}
+	return v, err
+}
+
+// A state may come from elsewhere: its paths must stay in the tree, or
+// committing it would change what is outside. The root is the empty path,
+// the others are clean and relative, and do not climb out.
+func validStatePath(name string) bool {
+	if name == "" {
+		return true
+	}
+	return path.Clean(name) == name && !path.IsAbs(name) && name != "." &&
+		name != ".." && !strings.HasPrefix(name, "../") &&
+		!strings.ContainsRune(name, 0)
+}
+
+func validStateSource(source string) bool {
+	return source == NoSource || validStatePath(source)
+}
+
+// The entries of a directory are names within it
+func validEntryName(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		!strings.ContainsAny(name, "/\x00")
+}
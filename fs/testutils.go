@@ -136,11 +136,9 @@ func (implem *BufferFSImplem) Setup(dirname string) {
 	pnfs := pathfs.NewPathNodeFs(bfs, &pathfs.PathNodeFsOptions{ClientInodes: true})
 	implem.connector = nodefs.NewFileSystemConnector(pnfs.Root(),
 		&nodefs.Options{})
+	// Without default_permissions: the permissions are checked by ploufs
 	implem.state, err = fuse.NewServer(
-		fuse.NewRawFileSystem(implem.connector.RawFS()), mnt, &fuse.MountOptions{
-			SingleThreaded: true,
-			Options:        []string{"default_permissions"},
-		})
+		fuse.NewRawFileSystem(implem.connector.RawFS()), mnt, &fuse.MountOptions{})
 
 	if err != nil {
 		implem.t.Fatal("NewServer", err)
@@ -0,0 +1,350 @@
+// copyright 2016 Christophe-Marie Duquesne
+
+package fs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+const (
+	// Without the privileges to create a whiteout device or to set a
+	// trusted xattr, we fall back to the aufs conventions, which most of the
+	// layer tooling understands
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+	opaqueXattr    = "trusted.overlay.opaque"
+	copyBufferSize = 128 * 1024
+)
+
+// ExportUpper writes the buffered state in dir, as an overlayfs upper
+// directory that would give the current view when stacked on top of the
+// wrapped file system. Changed paths are copied in full, removed paths
+// become whiteouts and directories that replace a whole directory are
+// marked opaque. As root, the overlayfs whiteouts (0/0 character devices)
+// and the trusted.overlay.opaque xattr are used; otherwise the .wh. files
+// are. The directory is created if needed and must be empty.
+func (fs *BufferFS) ExportUpper(dir string) error {
+	changes, code := fs.Changes()
+	if code != fuse.OK {
+		return statusError(code)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	_, err = d.Readdirnames(1)
+	d.Close()
+	if err != io.EOF {
+		if err == nil {
+			err = fmt.Errorf("%s is not empty", dir)
+		}
+		return err
+	}
+
+	defer fs.Locked()()
+	context := ownContext()
+	privileged := os.Geteuid() == 0
+
+	layer, err := fs.upperLayer(changes, context)
+	if err != nil {
+		return err
+	}
+
+	// The first name exported of each file with several names
+	links := make(map[OverlayPath]string)
+	for _, name := range layer.names {
+		if err := fs.exportPath(dir, name, links, context); err != nil {
+			return err
+		}
+		if layer.opaque[name] {
+			err = writeOpaque(filepath.Join(dir, name), privileged)
+			if err != nil {
+				return err
+			}
+		}
+		for _, base := range layer.whiteouts[name] {
+			err = writeWhiteout(filepath.Join(dir, name), base, privileged)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Children first, so that the times of the directories are kept
+	for i := len(layer.names) - 1; i >= 0; i-- {
+		name := layer.names[i]
+		attr, code := fs.getAttr(name, context)
+		if code != fuse.OK {
+			return statusError(code)
+		}
+		// Before the mode, which may not let us write them
+		if !attr.IsSymlink() {
+			xattrs, code := fs.xattrs(name, context)
+			if code != fuse.OK {
+				return statusError(code)
+			}
+			err := exportXAttrs(filepath.Join(dir, name), xattrs, privileged)
+			if err != nil {
+				return err
+			}
+		}
+		err := exportAttr(filepath.Join(dir, name), attr, privileged)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// What a layer stacked on top of the wrapped file system must contain to
+// give the current view
+type upperLayer struct {
+	// The paths to copy in full, sorted so that parents come first
+	names []string
+	// For each directory, the entries of the wrapped file system to hide
+	whiteouts map[string][]string
+	// The directories that hide all the entries of the wrapped file system
+	// (they have no whiteouts)
+	opaque map[string]bool
+}
+
+// Computes the layer from the pending changes. The file system must be
+// locked.
+func (fs *BufferFS) upperLayer(changes []Change, context *fuse.Context) (*upperLayer, error) {
+	layer := &upperLayer{
+		whiteouts: make(map[string][]string),
+		opaque:    make(map[string]bool),
+	}
+
+	exported := make(map[string]bool)
+	hidden := make([]string, 0)
+	for _, c := range changes {
+		switch c.Kind {
+		case Deleted:
+			// Below a renamed directory, the wrapped file system may
+			// have nothing to hide
+			if _, code := fs.Wrapped.GetAttr(c.Path, context); code == fuse.OK {
+				hidden = append(hidden, c.Path)
+			}
+		case Renamed:
+			// What a renamed directory holds moved along with it
+			if err := fs.exportTree(c.Path, exported, context); err != nil {
+				return nil, err
+			}
+			if _, code := fs.getAttr(c.From, context); code == fuse.ENOENT {
+				hidden = append(hidden, c.From)
+			}
+		default:
+			exported[c.Path] = true
+		}
+	}
+	// A path that changed type is both deleted and created: the new path
+	// already hides the old one
+	for _, name := range hidden {
+		if exported[name] {
+			continue
+		}
+		parent, base := pathSplit(name)
+		layer.whiteouts[parent] = append(layer.whiteouts[parent], base)
+	}
+	for name, bases := range layer.whiteouts {
+		// The parents of what we write must exist in the layer
+		exported[name] = true
+		entries, code := fs.Wrapped.OpenDir(name, context)
+		if code != fuse.OK {
+			return nil, statusError(code)
+		}
+		if len(bases) == len(entries) {
+			layer.opaque[name] = true
+			delete(layer.whiteouts, name)
+		} else {
+			sort.Strings(bases)
+		}
+	}
+	for name := range exported {
+		for name != "" {
+			name, _ = pathSplit(name)
+			exported[name] = true
+		}
+	}
+
+	layer.names = make([]string, 0, len(exported))
+	for name := range exported {
+		layer.names = append(layer.names, name)
+	}
+	sort.Strings(layer.names)
+	return layer, nil
+}
+
+// Adds a path of the current view to the exported paths, along with what it
+// holds if it is a directory
+func (fs *BufferFS) exportTree(name string, exported map[string]bool, context *fuse.Context) error {
+	exported[name] = true
+	attr, code := fs.getAttr(name, context)
+	if code != fuse.OK {
+		return statusError(code)
+	}
+	if !attr.IsDir() {
+		return nil
+	}
+	entries, code := fs.openDir(name, context)
+	if code != fuse.OK {
+		return statusError(code)
+	}
+	for _, e := range entries {
+		if err := fs.exportTree(path.Join(name, e.Name), exported, context); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copies a path of the current view in the upper directory. The other
+// names of a file are linked to the first one exported.
+func (fs *BufferFS) exportPath(dir string, name string, links map[OverlayPath]string, context *fuse.Context) error {
+	attr, code := fs.getAttr(name, context)
+	if code != fuse.OK {
+		return statusError(code)
+	}
+	dest := filepath.Join(dir, name)
+	if f := fs.linkedName(name, attr); f != nil {
+		if first, ok := links[f]; ok {
+			return os.Link(filepath.Join(dir, first), dest)
+		}
+		links[f] = name
+	}
+	switch {
+	case attr.IsDir():
+		// The permissions are set later on, but we need to be able to
+		// populate the directory in the meantime
+		err := os.Mkdir(dest, 0700)
+		if err != nil && !(name == "" && os.IsExist(err)) {
+			return err
+		}
+		return nil
+	case attr.IsSymlink():
+		target, code := fs.readlink(name, context)
+		if code != fuse.OK {
+			return statusError(code)
+		}
+		return os.Symlink(target, dest)
+	case attr.IsRegular():
+		return fs.exportFile(dest, name, attr.Size, context)
+	case isSpecial(attr.Mode):
+		return syscall.Mknod(dest, attr.Mode&syscall.S_IFMT|0600, int(attr.Rdev))
+	}
+	return fmt.Errorf("%s: unsupported file type %o", name, attr.Mode&syscall.S_IFMT)
+}
+
+func (fs *BufferFS) exportFile(dest string, name string, size uint64, context *fuse.Context) error {
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := fs.copyFile(out, name, size, context); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Writes the content of an overlayed file
+func (fs *BufferFS) copyFile(w io.Writer, name string, size uint64, context *fuse.Context) error {
+	o, source, code := fs.shown(name, context)
+	if code != fuse.OK {
+		return statusError(code)
+	}
+	if o == nil {
+		// A file below a renamed directory: a transient overlay, that
+		// the tree does not keep, reads its source
+		attr, code := fs.Wrapped.GetAttr(source, context)
+		if code != fuse.OK {
+			return statusError(code)
+		}
+		o = NewOverlayFile(NewOverlayAttrFromExisting(attr), source)
+	}
+	// Through a handle, so that the source stays open between the reads
+	h := NewOverlayFH(o, syscall.O_RDONLY, context, fs.Wrapped)
+	defer h.Release()
+	buf := make([]byte, copyBufferSize)
+	for off := int64(0); uint64(off) < size; {
+		r, code := h.Read(buf, off)
+		if code != fuse.OK {
+			return statusError(code)
+		}
+		b, _ := r.Bytes(buf)
+		if len(b) == 0 {
+			break
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		off += int64(len(b))
+	}
+	return nil
+}
+
+func writeWhiteout(dir string, base string, privileged bool) error {
+	if privileged {
+		return syscall.Mknod(filepath.Join(dir, base), syscall.S_IFCHR, 0)
+	}
+	return createEmpty(filepath.Join(dir, whiteoutPrefix+base))
+}
+
+func writeOpaque(dir string, privileged bool) error {
+	if privileged {
+		return syscall.Setxattr(dir, opaqueXattr, []byte("y"), 0)
+	}
+	return createEmpty(filepath.Join(dir, opaqueWhiteout))
+}
+
+func createEmpty(name string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Without privileges, only the user namespace can be written
+func exportXAttrs(dest string, xattrs map[string][]byte, privileged bool) error {
+	for name, data := range xattrs {
+		if !privileged && !strings.HasPrefix(name, "user.") {
+			continue
+		}
+		if err := syscall.Setxattr(dest, name, data, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exportAttr(dest string, attr *fuse.Attr, privileged bool) error {
+	if privileged {
+		err := os.Lchown(dest, int(attr.Owner.Uid), int(attr.Owner.Gid))
+		if err != nil {
+			return err
+		}
+	}
+	// There is no portable way to set the mode and the times of a symlink
+	if attr.IsSymlink() {
+		return nil
+	}
+	if err := syscall.Chmod(dest, attr.Mode&07777); err != nil {
+		return err
+	}
+	return os.Chtimes(dest, attr.AccessTime(), attr.ModTime())
+}
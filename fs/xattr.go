@@ -0,0 +1,245 @@
+// copyright 2016 Christophe-Marie Duquesne
+
+package fs
+
+import (
+	"bytes"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// The extended attributes of a path are copied when it is overlayed, so
+// that they follow it when it is renamed. Those of a symlink are left
+// alone: the wrapped file system follows symlinks for them.
+
+// The extended attributes of an overlayed path
+type XAttrs interface {
+	GetXAttr(name string) (data []byte, code fuse.Status)
+	SetXAttr(name string, data []byte, flags int) fuse.Status
+	ListXAttr() []string
+	RemoveXAttr(name string) fuse.Status
+}
+
+// Copies the extended attributes of a path of the wrapped file system
+func copyWrappedXAttrs(attr XAttrs, source string, wrapped pathfs.FileSystem, context *fuse.Context) (code fuse.Status) {
+	names, code := wrapped.ListXAttr(source, context)
+	if !xattrSupported(code) {
+		return fuse.OK
+	}
+	if code != fuse.OK {
+		return code
+	}
+	for _, name := range names {
+		data, code := wrapped.GetXAttr(source, name, context)
+		if code == fuse.ENODATA {
+			// Removed in the meantime
+			continue
+		}
+		if code != fuse.OK {
+			return contentStatus(code)
+		}
+		attr.SetXAttr(name, data, 0)
+	}
+	return fuse.OK
+}
+
+// Whether the status does not tell that the file system has no extended
+// attributes at all
+func xattrSupported(code fuse.Status) bool {
+	return code != fuse.ENOSYS && code != fuse.Status(syscall.ENOTSUP)
+}
+
+func copyXAttrs(dst XAttrs, src XAttrs) {
+	for _, name := range src.ListXAttr() {
+		data, _ := src.GetXAttr(name)
+		dst.SetXAttr(name, data, 0)
+	}
+}
+
+func (fs *BufferFS) GetXAttr(name string, attribute string, context *fuse.Context) (data []byte, code fuse.Status) {
+	defer fs.RLocked()()
+
+	if code := fs.checkXAttr(name, attribute, accessRead, context); code != fuse.OK {
+		return nil, code
+	}
+	o, source, code := fs.shown(name, context)
+	if code != fuse.OK {
+		return nil, code
+	}
+	if o != nil {
+		return o.GetXAttr(attribute)
+	}
+	return fs.Wrapped.GetXAttr(source, attribute, context)
+}
+
+func (fs *BufferFS) ListXAttr(name string, context *fuse.Context) (attributes []string, code fuse.Status) {
+	defer fs.RLocked()()
+
+	if code := fs.checkLookup(name, 0, context); code != fuse.OK {
+		return nil, code
+	}
+	o, source, code := fs.shown(name, context)
+	if code != fuse.OK {
+		return nil, code
+	}
+	if o != nil {
+		attributes = o.ListXAttr()
+	} else {
+		attributes, code = fs.Wrapped.ListXAttr(source, context)
+	}
+	if context == nil || context.Uid == 0 {
+		return attributes, code
+	}
+	// The trusted attributes are hidden from the others
+	listed := make([]string, 0, len(attributes))
+	for _, a := range attributes {
+		if !strings.HasPrefix(a, "trusted.") {
+			listed = append(listed, a)
+		}
+	}
+	return listed, code
+}
+
+// Checks that the caller may look the path up and access its extended
+// attribute
+func (fs *BufferFS) checkXAttr(name string, attribute string, mode uint32, context *fuse.Context) fuse.Status {
+	if code := fs.checkLookup(name, 0, context); code != fuse.OK {
+		return code
+	}
+	if context == nil {
+		return fuse.OK
+	}
+	attr, code := fs.getAttr(name, context)
+	if code != fuse.OK {
+		return code
+	}
+	return newCaller(context).xattr(attr, attribute, mode)
+}
+
+func (fs *BufferFS) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	return fs.setXAttr(name, attr, data, flags, newRequest(context))
+}
+
+func (fs *BufferFS) setXAttr(name string, attr string, data []byte, flags int, req *request) fuse.Status {
+	defer fs.Locked()()
+
+	o, code := fs.overlayForXAttr(name, attr, req)
+	if code != fuse.OK {
+		return code
+	}
+	return o.SetXAttr(attr, data, flags)
+}
+
+func (fs *BufferFS) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	return fs.removeXAttr(name, attr, newRequest(context))
+}
+
+func (fs *BufferFS) removeXAttr(name string, attr string, req *request) fuse.Status {
+	defer fs.Locked()()
+
+	o, code := fs.overlayForXAttr(name, attr, req)
+	if code != fuse.OK {
+		return code
+	}
+	return o.RemoveXAttr(attr)
+}
+
+// Overlays the path whose extended attribute the caller changes, if it may
+func (fs *BufferFS) overlayForXAttr(name string, xattr string, req *request) (o OverlayPath, code fuse.Status) {
+	if code := fs.checkSearch(name, req); code != fuse.OK {
+		return nil, code
+	}
+	attr, code := fs.getAttr(name, req.Context)
+	if code != fuse.OK {
+		return nil, code
+	}
+	if attr.IsSymlink() {
+		return nil, fuse.EPERM
+	}
+	if code := req.caller.xattr(attr, xattr, accessWrite); code != fuse.OK {
+		return nil, code
+	}
+	return fs.overlayExisting(name, attr, req)
+}
+
+// Gives the wrapped path the extended attributes of its overlay
+func commitXAttrs(name string, o OverlayPath, wrapped pathfs.FileSystem, context *fuse.Context) (code fuse.Status) {
+	names, code := wrapped.ListXAttr(name, context)
+	if !xattrSupported(code) && len(o.ListXAttr()) == 0 {
+		return fuse.OK
+	}
+	if code != fuse.OK {
+		return code
+	}
+	for _, n := range names {
+		if _, code := o.GetXAttr(n); code == fuse.ENODATA {
+			code = wrapped.RemoveXAttr(name, n, context)
+			if code != fuse.OK {
+				return code
+			}
+		}
+	}
+	for _, n := range o.ListXAttr() {
+		data, _ := o.GetXAttr(n)
+		existing, code := wrapped.GetXAttr(name, n, context)
+		if code == fuse.OK && bytes.Equal(existing, data) {
+			continue
+		}
+		code = wrapped.SetXAttr(name, n, data, 0, context)
+		if code != fuse.OK {
+			return code
+		}
+	}
+	return fuse.OK
+}
+
+// Returns the extended attributes that show at a path. The file system must
+// be locked.
+func (fs *BufferFS) xattrs(name string, context *fuse.Context) (xattrs map[string][]byte, code fuse.Status) {
+	o, source, code := fs.shown(name, context)
+	if code != fuse.OK {
+		return nil, code
+	}
+	xattrs = make(map[string][]byte)
+	if o != nil {
+		for _, n := range o.ListXAttr() {
+			xattrs[n], _ = o.GetXAttr(n)
+		}
+		return xattrs, fuse.OK
+	}
+	attr := &DefaultOverlayAttr{}
+	code = copyWrappedXAttrs(attr, source, fs.Wrapped, context)
+	if code != fuse.OK {
+		return nil, code
+	}
+	for _, n := range attr.ListXAttr() {
+		xattrs[n], _ = attr.GetXAttr(n)
+	}
+	return xattrs, fuse.OK
+}
+
+// Whether the extended attributes of the overlay differ from those of the
+// wrapped path
+func xattrsChanged(name string, o OverlayPath, wrapped pathfs.FileSystem, context *fuse.Context) bool {
+	names, code := wrapped.ListXAttr(name, context)
+	if code != fuse.OK {
+		return len(o.ListXAttr()) > 0
+	}
+	if len(names) != len(o.ListXAttr()) {
+		return true
+	}
+	for _, n := range names {
+		data, code := o.GetXAttr(n)
+		if code != fuse.OK {
+			return true
+		}
+		existing, code := wrapped.GetXAttr(name, n, context)
+		if code != fuse.OK || !bytes.Equal(existing, data) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,20 +2,141 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/chmduquesne/ploufs/fs"
 )
 
+// Commands sent to a mounted ploufs
+var commands = []struct {
+	name string
+	args string
+	help string
+	// Whether the arguments are paths, which the mount resolves from
+	// another working directory
+	paths bool
+	// Whether the arguments are paths in the mount, which it receives
+	// relative to its root
+	mounted bool
+}{
+	{"diff", "<mnt>", "list the changes pending in the mount", false, false},
+	{"patch", "<mnt>", "print the pending changes as a git patch", false, false},
+	{"upper", "<mnt> <dir>", "write the pending changes as an overlayfs upper dir", true, false},
+	{"export", "[--format=oci-layer] <mnt>", "print the pending changes as an image layer tar", false, false},
+	{"save", "<mnt> <file>", "save the pending changes in a state file", true, false},
+	{"load", "<mnt> <file>", "replace the pending changes by the saved ones", true, false},
+	{"checkpoint", "<mnt> [<name>]", "record the pending changes as a checkpoint, or list them", false, false},
+	{"rollback", "<mnt> <name>", "restore the pending changes of a checkpoint", false, false},
+	{"discard", "<mnt> [<path>]", "drop the pending changes, or those of a path and below", false, true},
+	{"commit", "<mnt>", "apply the pending changes to the original directory", false, false},
+}
+
+func usage() {
+	fmt.Printf("Usage: %s [options] <orig> <mnt>\n", os.Args[0])
+	fmt.Printf("       %s <command> <mnt> [args...]\n\n", os.Args[0])
+
+	fmt.Printf("Options:\n")
+	fmt.Printf("  --journal=<dir>  record the changes in dir, to restore them on the next mount\n")
+	fmt.Printf("  --sync           sync the journal after each change, to survive a crash of the machine\n")
+	fmt.Printf("  --memory=<size>  keep at most size bytes (suffixes K, M, G, T) of changes in RAM\n")
+	fmt.Printf("  --scratch=<dir>  where the changes past the memory budget go (default: %s)\n\n", os.TempDir())
+
+	fmt.Printf("Commands:\n")
+	for _, c := range commands {
+		fmt.Printf("  %-36s %s\n", c.name+" "+c.args, c.help)
+	}
+	fmt.Printf("\n")
+
+	fmt.Printf("Environment variables:\n")
+	fmt.Printf("  ENABLE_LINKS:   if not empty, enable hard link support\n")
+	fmt.Printf("  DEBUG:          if not empty, enable debugging\n")
+	fmt.Printf("  MOUNT_OPTIONS:  comma separated options from man 8 mount.fuse\n")
+	os.Exit(1)
+}
+
 func main() {
-	if len(os.Args) != 3 {
-		fmt.Printf("Usage: %s <orig> <mnt>\n\n", os.Args[0])
-
-		fmt.Printf("Environment variables:\n")
-		fmt.Printf("  ENABLE_LINKS:   if not empty, enable hard link support\n")
-		fmt.Printf("  DEBUG:          if not empty, enable debugging\n")
-		fmt.Printf("  MOUNT_OPTIONS:  comma separated options from man 8 mount.fuse\n")
-		os.Exit(1)
+	if len(os.Args) < 3 {
+		usage()
+	}
+	for _, c := range commands {
+		if c.name != os.Args[1] {
+			continue
+		}
+		// Options may come before the mount point
+		mountpoint := ""
+		args := []string{c.name}
+		for _, arg := range os.Args[2:] {
+			switch {
+			case strings.HasPrefix(arg, "--"):
+			case mountpoint == "":
+				mountpoint = arg
+				continue
+			case c.paths:
+				arg, _ = filepath.Abs(arg)
+			case c.mounted:
+				root, _ := filepath.Abs(mountpoint)
+				abs, _ := filepath.Abs(arg)
+				rel, err := filepath.Rel(root, abs)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s: %v\n", c.name, err)
+					os.Exit(1)
+				}
+				arg = rel
+			}
+			args = append(args, arg)
+		}
+		if mountpoint == "" {
+			usage()
+		}
+		if err := fs.Control(mountpoint, args, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", c.name, err)
+			os.Exit(1)
+		}
+		return
+	}
+	opts := fs.Options{MemoryBudget: -1}
+	args := make([]string, 0, 2)
+	for _, arg := range os.Args[1:] {
+		switch {
+		case strings.HasPrefix(arg, "--journal="):
+			opts.Journal = strings.TrimPrefix(arg, "--journal=")
+		case arg == "--sync":
+			opts.JournalSync = true
+		case strings.HasPrefix(arg, "--scratch="):
+			opts.Scratch = strings.TrimPrefix(arg, "--scratch=")
+		case strings.HasPrefix(arg, "--memory="):
+			size, err := parseSize(strings.TrimPrefix(arg, "--memory="))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", arg, err)
+				os.Exit(1)
+			}
+			opts.MemoryBudget = size
+		default:
+			args = append(args, arg)
+		}
+	}
+	if len(args) != 2 {
+		usage()
+	}
+	fs.Mount(args[0], args[1], opts)
+}
+
+// Parses a size in bytes, with an optional binary suffix (4G is 4 GiB)
+func parseSize(s string) (int64, error) {
+	shift := uint(0)
+	if s != "" {
+		if i := strings.IndexByte("KMGT", s[len(s)-1]); i >= 0 {
+			shift = 10 * uint(i+1)
+			s = s[:len(s)-1]
+		}
+	}
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || size < 0 || size > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("invalid size")
 	}
-	fs.Mount(os.Args[1], os.Args[2])
+	return size << shift, nil
 }